@@ -0,0 +1,161 @@
+package lox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AssertionError is raised when an assert in a test fails
+type AssertionError struct {
+	Message string
+}
+
+func (e AssertionError) Error() string {
+	return "AssertionError: " + e.Message
+}
+
+// Declares assert, assertEqual and assertThrows, which tests run by
+// TestRunner can use
+func declareAssertions(env *ScopeEnv) {
+	env.Declare("assert", assertFn)
+	env.Declare("assertEqual", assertEqualFn)
+	env.Declare("assertThrows", assertThrowsFn)
+}
+
+// Uses the optional message argument at i in place of the default
+func assertMessage(fn string, args []Value, i int, message string) (string, error) {
+	if len(args) <= i {
+		return message, nil
+	}
+	return stringArg(fn, args, i)
+}
+
+var assertFn = &NativeFunction{
+	Name:     "assert",
+	MinArity: 1,
+	MaxArity: 2,
+	Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		message, err := assertMessage("assert", args, 1, "assertion failed")
+		if err != nil {
+			return nil, err
+		}
+		if !isTruthy(args[0]) {
+			return nil, AssertionError{Message: message}
+		}
+		return Null(nil), nil
+	},
+}
+
+var assertEqualFn = &NativeFunction{
+	Name:     "assertEqual",
+	MinArity: 2,
+	MaxArity: 3,
+	Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		actual, expected := args[0], args[1]
+		message, err := assertMessage("assertEqual", args, 2, "")
+		if err != nil {
+			return nil, err
+		}
+		if deepEqual(actual, expected) {
+			return Null(nil), nil
+		}
+		if message == "" {
+			message = fmt.Sprintf("expected %s, got %s", reprValue(expected), reprValue(actual))
+		}
+		return nil, AssertionError{Message: message}
+	},
+}
+
+// assertThrows(fn, [text]) calls fn and fails unless it raises an error
+// containing text. It returns the error's message.
+var assertThrowsFn = &NativeFunction{
+	Name:     "assertThrows",
+	MinArity: 1,
+	MaxArity: 2,
+	Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		fn, ok := args[0].(LoxCallable)
+		if !ok {
+			return nil, argError("assertThrows", 0, "a function", args[0])
+		}
+		text, err := assertMessage("assertThrows", args, 1, "")
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = rs.call(fn, nil)
+		if isStopError(err) {
+			return nil, err
+		}
+		if err == nil {
+			return nil, AssertionError{Message: fmt.Sprintf("expected %s to throw", stringify(fn))}
+		}
+		if !strings.Contains(err.Error(), text) {
+			return nil, AssertionError{Message: fmt.Sprintf("expected an error containing %q, got %q", text, err.Error())}
+		}
+		return err.Error(), nil
+	},
+}
+
+// Compares lists and maps by their contents and instances of the same
+// class by their fields. Anything else compares like ==.
+func deepEqual(lhs, rhs Value) bool {
+	return deepEqualSeen(lhs, rhs, make(map[[2]any]bool))
+}
+
+// seen holds the pairs of collections being compared further up, so a
+// collection that contains itself doesn't recurse forever
+func deepEqualSeen(lhs, rhs Value, seen map[[2]any]bool) bool {
+	switch l := lhs.(type) {
+	case *LoxList:
+		r, ok := rhs.(*LoxList)
+		if !ok || len(l.Elements) != len(r.Elements) {
+			return false
+		}
+		pair := [2]any{l, r}
+		if l == r || seen[pair] {
+			return true
+		}
+		seen[pair] = true
+		for i := range l.Elements {
+			if !deepEqualSeen(l.Elements[i], r.Elements[i], seen) {
+				return false
+			}
+		}
+		return true
+	case *LoxMap:
+		r, ok := rhs.(*LoxMap)
+		if !ok || l.Len() != r.Len() {
+			return false
+		}
+		pair := [2]any{l, r}
+		if l == r || seen[pair] {
+			return true
+		}
+		seen[pair] = true
+		for i, key := range l.keys {
+			value, found, _ := r.Get(key)
+			if !found || !deepEqualSeen(l.values[i], value, seen) {
+				return false
+			}
+		}
+		return true
+	case *LoxInstance:
+		r, ok := rhs.(*LoxInstance)
+		if !ok || l.Class != r.Class || len(l.Fields) != len(r.Fields) {
+			return false
+		}
+		pair := [2]any{l, r}
+		if l == r || seen[pair] {
+			return true
+		}
+		seen[pair] = true
+		for name, value := range l.Fields {
+			other, found := r.Fields[name]
+			if !found || !deepEqualSeen(value, other, seen) {
+				return false
+			}
+		}
+		return true
+	}
+	return isEqual(lhs, rhs)
+}
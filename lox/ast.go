@@ -15,6 +15,12 @@ type Expr interface {
 
 type Stmt interface {
 	stmtNode()
+	// The line the statement starts on, from its Line field
+	line() int
+}
+
+type Pattern interface {
+	patternNode()
 }
 
 type ProgramNode struct {
@@ -25,73 +31,225 @@ func (_ ProgramNode) isNode() {}
 
 type ExprStmt struct {
 	Expr Expr
+	Line int
 }
 
 func (_ ExprStmt) isNode()   {}
 func (_ ExprStmt) stmtNode() {}
+func (s ExprStmt) line() int { return s.Line }
 
 type PrintStmt struct {
 	Expr Expr
+	Line int
 }
 
 func (_ PrintStmt) isNode()   {}
 func (_ PrintStmt) stmtNode() {}
+func (s PrintStmt) line() int { return s.Line }
 
 type BlockStmt struct {
 	Statements []Stmt
+	Line       int
+	// The line of the closing brace, for the formatter to keep comments
+	// before it. Zero for blocks the parser makes up.
+	EndLine int
 }
 
 func (_ BlockStmt) isNode()   {}
 func (_ BlockStmt) stmtNode() {}
+func (s BlockStmt) line() int { return s.Line }
 
 type DeclarationStmt struct {
 	Name string
 	Expr *Expr
+	Line int
 }
 
 func (_ DeclarationStmt) isNode()   {}
 func (_ DeclarationStmt) stmtNode() {}
+func (s DeclarationStmt) line() int { return s.Line }
+
+// Parameter is a single entry in a function's parameter list
+type Parameter struct {
+	Name string
+	// Default is evaluated at call time when the argument is omitted
+	Default Expr
+	// Rest collects any remaining arguments into a list
+	Rest bool
+}
 
 type FunctionDeclarationStmt struct {
 	Name       string
-	Parameters []string
+	Parameters []Parameter
 	Body       BlockStmt
+	// Declared with `fun*`, so calling it returns a generator
+	IsGenerator bool
+	// Declared with `async`, so calling it returns a promise
+	IsAsync bool
+	Line    int
 }
 
 func (_ FunctionDeclarationStmt) isNode()   {}
 func (_ FunctionDeclarationStmt) stmtNode() {}
+func (s FunctionDeclarationStmt) line() int { return s.Line }
 
 type ClassDeclarationStmt struct {
 	Name      string
 	Functions []FunctionDeclarationStmt
+	Line      int
+	// The line of the closing brace
+	EndLine int
 }
 
 func (_ ClassDeclarationStmt) isNode()   {}
 func (_ ClassDeclarationStmt) stmtNode() {}
+func (s ClassDeclarationStmt) line() int { return s.Line }
+
+// ImportStmt loads a module and binds it to Alias. Without an explicit
+// alias the module's file name (minus extension) is used.
+type ImportStmt struct {
+	Path  string
+	Alias string
+	Line  int
+}
+
+func (_ ImportStmt) isNode()   {}
+func (_ ImportStmt) stmtNode() {}
+func (s ImportStmt) line() int { return s.Line }
+
+// ExportStmt wraps a top level var, fun or class declaration whose name
+// is visible to importers
+type ExportStmt struct {
+	Declaration Stmt
+	Line        int
+}
+
+func (_ ExportStmt) isNode()   {}
+func (_ ExportStmt) stmtNode() {}
+func (s ExportStmt) line() int { return s.Line }
 
 type ReturnStmt struct {
 	Value Expr
+	Line  int
 }
 
 func (_ ReturnStmt) isNode()   {}
 func (_ ReturnStmt) stmtNode() {}
+func (s ReturnStmt) line() int { return s.Line }
 
 type IfStmt struct {
 	Condition  Expr
 	ThenBranch Stmt
 	ElseBranch Stmt
+	Line       int
+	// Branches are told apart by column, for coverage
+	Column int
 }
 
 func (_ IfStmt) isNode()   {}
 func (_ IfStmt) stmtNode() {}
+func (s IfStmt) line() int { return s.Line }
 
 type WhileStmt struct {
 	Condition Expr
 	Body      Stmt
+	Line      int
+	Column    int
 }
 
 func (_ WhileStmt) isNode()   {}
 func (_ WhileStmt) stmtNode() {}
+func (s WhileStmt) line() int { return s.Line }
+
+// ForInStmt runs its body once for each value of a list, map (its
+// keys), string (its characters), iterator or generator
+type ForInStmt struct {
+	Name     string
+	Iterable Expr
+	Body     Stmt
+	Line     int
+}
+
+func (_ ForInStmt) isNode()   {}
+func (_ ForInStmt) stmtNode() {}
+func (s ForInStmt) line() int { return s.Line }
+
+// MatchStmt runs the body of the first case whose pattern matches the
+// subject and whose guard, if any, is truthy
+type MatchStmt struct {
+	Subject Expr
+	Cases   []MatchCase
+	Line    int
+	// The line of the closing brace
+	EndLine int
+}
+
+func (_ MatchStmt) isNode()   {}
+func (_ MatchStmt) stmtNode() {}
+func (s MatchStmt) line() int { return s.Line }
+
+type MatchCase struct {
+	Pattern Pattern
+	Guard   Expr
+	Body    Stmt
+}
+
+// LiteralPattern matches values equal to a literal, including nil
+type LiteralPattern struct {
+	Value Expr
+}
+
+func (_ LiteralPattern) isNode()      {}
+func (_ LiteralPattern) patternNode() {}
+
+// WildcardPattern (`_`) matches anything without binding it
+type WildcardPattern struct{}
+
+func (_ WildcardPattern) isNode()      {}
+func (_ WildcardPattern) patternNode() {}
+
+// BindingPattern matches anything and binds it to a name
+type BindingPattern struct {
+	Name string
+}
+
+func (_ BindingPattern) isNode()      {}
+func (_ BindingPattern) patternNode() {}
+
+// TypePattern matches a builtin type (Number, String...) or instances of
+// a class, optionally binding the value
+type TypePattern struct {
+	TypeName string
+	Binding  string
+}
+
+func (_ TypePattern) isNode()      {}
+func (_ TypePattern) patternNode() {}
+
+// ListPattern destructures a list. Without a rest binding the list
+// length must match exactly.
+type ListPattern struct {
+	Elements []Pattern
+	HasRest  bool
+	Rest     string
+}
+
+func (_ ListPattern) isNode()      {}
+func (_ ListPattern) patternNode() {}
+
+// MapPattern destructures a map. Every key must be present, other keys
+// are ignored.
+type MapPattern struct {
+	Entries []MapPatternEntry
+}
+
+func (_ MapPattern) isNode()      {}
+func (_ MapPattern) patternNode() {}
+
+type MapPatternEntry struct {
+	Key     Expr
+	Pattern Pattern
+}
 
 type CallExpr struct {
 	Callee Expr
@@ -125,6 +283,106 @@ type BinaryExpr struct {
 func (_ BinaryExpr) isNode()   {}
 func (_ BinaryExpr) exprNode() {}
 
+// SpreadExpr expands a list in a call's argument list or a list literal
+type SpreadExpr struct {
+	Operand Expr
+}
+
+func (_ SpreadExpr) isNode()   {}
+func (_ SpreadExpr) exprNode() {}
+
+type ListExpr struct {
+	Elements []Expr
+}
+
+func (_ ListExpr) isNode()   {}
+func (_ ListExpr) exprNode() {}
+
+type MapExpr struct {
+	Entries []MapEntry
+}
+
+func (_ MapExpr) isNode()   {}
+func (_ MapExpr) exprNode() {}
+
+type MapEntry struct {
+	Key   Expr
+	Value Expr
+}
+
+type IndexExpr struct {
+	Object Expr
+	Index  Expr
+}
+
+func (_ IndexExpr) isNode()   {}
+func (_ IndexExpr) exprNode() {}
+
+type GetExpr struct {
+	Object Expr
+	Name   string
+	// Optional is set for `?.`, which short-circuits the enclosing
+	// OptionalChainExpr when the object is nil
+	Optional bool
+}
+
+func (_ GetExpr) isNode()   {}
+func (_ GetExpr) exprNode() {}
+
+// OptionalChainExpr wraps a call/property chain containing `?.` and
+// evaluates to nil if any optional access in it hits a nil object
+type OptionalChainExpr struct {
+	Expr Expr
+}
+
+func (_ OptionalChainExpr) isNode()   {}
+func (_ OptionalChainExpr) exprNode() {}
+
+type ThisExpr struct{}
+
+func (_ ThisExpr) isNode()   {}
+func (_ ThisExpr) exprNode() {}
+
+type SetExpr struct {
+	Object Expr
+	Name   string
+	Value  Expr
+}
+
+func (_ SetExpr) isNode()   {}
+func (_ SetExpr) exprNode() {}
+
+type IndexSetExpr struct {
+	Object Expr
+	Index  Expr
+	Value  Expr
+}
+
+func (_ IndexSetExpr) isNode()   {}
+func (_ IndexSetExpr) exprNode() {}
+
+// CompoundAssignExpr is `target op= value`. Target is a VarExpr,
+// GetExpr or IndexExpr and Operation is the arithmetic operator applied.
+type CompoundAssignExpr struct {
+	Target    Expr
+	Operation TokenType
+	Value     Expr
+}
+
+func (_ CompoundAssignExpr) isNode()   {}
+func (_ CompoundAssignExpr) exprNode() {}
+
+// IncrementExpr is `++`/`--` in prefix or postfix position. Operation
+// is PLUS or MINUS.
+type IncrementExpr struct {
+	Target    Expr
+	Operation TokenType
+	Prefix    bool
+}
+
+func (_ IncrementExpr) isNode()   {}
+func (_ IncrementExpr) exprNode() {}
+
 type VarExpr struct {
 	Name string
 }
@@ -132,15 +390,67 @@ type VarExpr struct {
 func (_ VarExpr) isNode()   {}
 func (_ VarExpr) exprNode() {}
 
+type ConditionalExpr struct {
+	Condition Expr
+	ThenExpr  Expr
+	ElseExpr  Expr
+}
+
+func (_ ConditionalExpr) isNode()   {}
+func (_ ConditionalExpr) exprNode() {}
+
+// YieldExpr suspends a generator, producing Value (nil when omitted).
+// It evaluates to the value passed to the generator's send().
+type YieldExpr struct {
+	Value Expr
+}
+
+func (_ YieldExpr) isNode()   {}
+func (_ YieldExpr) exprNode() {}
+
+// SpawnExpr starts a call on its own task and evaluates to the task
+type SpawnExpr struct {
+	Call CallExpr
+}
+
+func (_ SpawnExpr) isNode()   {}
+func (_ SpawnExpr) exprNode() {}
+
+// AwaitExpr waits for a task to finish or a promise to settle and
+// evaluates to the result
+type AwaitExpr struct {
+	Operand Expr
+}
+
+func (_ AwaitExpr) isNode()   {}
+func (_ AwaitExpr) exprNode() {}
+
+// LogicalExpr is a short-circuiting `and`, `or` or `??`
 type LogicalExpr struct {
 	Operation TokenType
 	Lhs       Expr
 	Rhs       Expr
+	// Where the operator is
+	Line   int
+	Column int
 }
 
 func (_ LogicalExpr) isNode()   {}
 func (_ LogicalExpr) exprNode() {}
 
+// FunctionExpr is an anonymous function. Arrow functions are desugared
+// into one of these with a single return statement as the body.
+type FunctionExpr struct {
+	Parameters  []Parameter
+	Body        BlockStmt
+	IsGenerator bool
+	IsAsync     bool
+	Line        int
+}
+
+func (_ FunctionExpr) isNode()   {}
+func (_ FunctionExpr) exprNode() {}
+
 type AssignExpr struct {
 	Name  string
 	Value Expr
@@ -149,6 +459,14 @@ type AssignExpr struct {
 func (_ AssignExpr) isNode()   {}
 func (_ AssignExpr) exprNode() {}
 
+// A /.../flags literal, compiled when it's parsed
+type RegexExpr struct {
+	Regex *LoxRegex
+}
+
+func (_ RegexExpr) isNode()   {}
+func (_ RegexExpr) exprNode() {}
+
 type LiteralExpr[T any] struct {
 	value T
 }
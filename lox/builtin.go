@@ -1,11 +1,106 @@
 package lox
 
-import "time"
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
 
+// Reference point for clock(). time.Since uses the monotonic clock, so
+// wall clock adjustments don't affect the result.
+var clockStart = time.Now()
+
+// ClockFn returns the seconds elapsed since the interpreter started, as
+// a float, for timing code
 type ClockFn struct{}
 
-func (c ClockFn) Call(runtime *RuntimeState, arguments []Value) any {
-	return time.Now().Second()
+func (c ClockFn) Call(runtime *RuntimeState, arguments []Value) (any, error) {
+	if err := runtime.require(CapTime, "clock"); err != nil {
+		return nil, err
+	}
+	return time.Since(clockStart).Seconds(), nil
+}
+
+func (c ClockFn) Arity() (int, int) { return 0, 0 }
+
+func (c ClockFn) String() string { return "<native fn clock>" }
+
+// NativeFunction adapts a Go function into a LoxCallable. It's used by
+// pointer so that functions compare by identity.
+type NativeFunction struct {
+	Name     string
+	MinArity int
+	// MaxArity may be VARIADIC
+	MaxArity int
+	Fn       func(rs *RuntimeState, args []Value) (Value, error)
+}
+
+func (f *NativeFunction) Call(rs *RuntimeState, arguments []Value) (any, error) {
+	return f.Fn(rs, arguments)
+}
+
+func (f *NativeFunction) Arity() (int, int) { return f.MinArity, f.MaxArity }
+
+func (f *NativeFunction) String() string {
+	return fmt.Sprintf("<native fn %s>", f.Name)
+}
+
+// Builds a module of native functions and constants
+func newNativeModule(name string, functions []*NativeFunction, constants map[string]Value) *LoxModule {
+	module := &LoxModule{Name: name, Path: "<native>", Exports: make(map[string]Value)}
+	for _, f := range functions {
+		module.Exports[f.Name] = f
+	}
+	for k, v := range constants {
+		module.Exports[k] = v
+	}
+	return module
 }
 
-func (c ClockFn) Arity() int { return 0 }
+// Helpers for checking native function arguments. They produce Lox
+// RuntimeErrors naming the function and argument position.
+
+func argError(fn string, i int, want string, got Value) error {
+	return RuntimeError{
+		message: fmt.Sprintf("%s() argument %d must be %s, got %s", fn, i+1, want, reprValue(got)),
+	}
+}
+
+func numberArg(fn string, args []Value, i int) (Value, error) {
+	if !isNumber(args[i]) {
+		return nil, argError(fn, i, "a number", args[i])
+	}
+	return args[i], nil
+}
+
+func floatArg(fn string, args []Value, i int) (float64, error) {
+	n, err := numberArg(fn, args, i)
+	if err != nil {
+		return 0, err
+	}
+	return toFloat(n), nil
+}
+
+func intArg(fn string, args []Value, i int) (int64, error) {
+	n, ok := args[i].(int64)
+	if !ok {
+		return 0, argError(fn, i, "an integer", args[i])
+	}
+	return n, nil
+}
+
+// Like intArg, but also accepts big integers
+func integerArg(fn string, args []Value, i int) (*big.Int, error) {
+	if !isInteger(args[i]) {
+		return nil, argError(fn, i, "an integer", args[i])
+	}
+	return toBigInt(args[i]), nil
+}
+
+func stringArg(fn string, args []Value, i int) (string, error) {
+	s, ok := args[i].(string)
+	if !ok {
+		return "", argError(fn, i, "a string", args[i])
+	}
+	return s, nil
+}
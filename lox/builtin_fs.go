@@ -0,0 +1,218 @@
+package lox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Builds the `fs` module. Every function goes through rs.FS, so a host
+// can root scripts in a directory or deny file access altogether.
+func newFSModule() *LoxModule {
+	functions := []*NativeFunction{
+		{Name: "readFile", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			fsys, name, err := rs.fileArg("readFile", args)
+			if err != nil {
+				return nil, err
+			}
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return nil, fileError("readFile", err)
+			}
+			return string(data), nil
+		}},
+		writeFunction("writeFile", WriteFS.WriteFile),
+		writeFunction("appendFile", WriteFS.AppendFile),
+		{Name: "readLines", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			fsys, name, err := rs.fileArg("readLines", args)
+			if err != nil {
+				return nil, err
+			}
+			f, err := fsys.Open(name)
+			if err != nil {
+				return nil, fileError("readLines", err)
+			}
+
+			reader := bufio.NewReader(f)
+			return NewLoxIterator("readLines", func() (Value, bool, error) {
+				line, ok, err := readLine(reader)
+				if err != nil {
+					return nil, false, fileError("readLines", err)
+				}
+				return line, ok, nil
+			}, f.Close), nil
+		}},
+		{Name: "listDir", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			fsys, name, err := rs.fileArg("listDir", args)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := fs.ReadDir(fsys, name)
+			if err != nil {
+				return nil, fileError("listDir", err)
+			}
+			names := make([]string, len(entries))
+			for i, entry := range entries {
+				names[i] = entry.Name()
+			}
+			return stringList(names), nil
+		}},
+		{Name: "exists", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			fsys, name, err := rs.fileArg("exists", args)
+			if err != nil {
+				return nil, err
+			}
+			_, err = fs.Stat(fsys, name)
+			return err == nil, nil
+		}},
+		{Name: "stat", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			fsys, name, err := rs.fileArg("stat", args)
+			if err != nil {
+				return nil, err
+			}
+			info, err := fs.Stat(fsys, name)
+			if err != nil {
+				return nil, fileError("stat", err)
+			}
+
+			stat := NewLoxMap()
+			stat.Set("name", info.Name())
+			stat.Set("size", info.Size())
+			stat.Set("isDir", info.IsDir())
+			stat.Set("mode", info.Mode().String())
+			// Milliseconds since the epoch, like time.now()
+			stat.Set("modTime", info.ModTime().UnixMilli())
+			return stat, nil
+		}},
+		{Name: "mkdir", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			fsys, name, err := rs.writableFileArg("mkdir", args)
+			if err != nil {
+				return nil, err
+			}
+			return Null(nil), fileError("mkdir", fsys.MkdirAll(name))
+		}},
+		{Name: "remove", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			fsys, name, err := rs.writableFileArg("remove", args)
+			if err != nil {
+				return nil, err
+			}
+			return Null(nil), fileError("remove", fsys.Remove(name))
+		}},
+	}
+
+	return newNativeModule("fs", functions, nil)
+}
+
+// Builds the `io` module with the runtime's standard streams
+func newIOModule() *LoxModule {
+	stdin := newNativeModule("stdin", []*NativeFunction{
+		{Name: "readLine", MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if rs.InReader == nil {
+				return nil, RuntimeError{message: "Standard input is not available"}
+			}
+			if rs.stdin == nil {
+				rs.stdin = bufio.NewReader(rs.InReader)
+			}
+
+			var line string
+			var ok bool
+			var err error
+			rs.blocking(func() { line, ok, err = readLine(rs.stdin) })
+			if err != nil {
+				return nil, RuntimeError{message: fmt.Sprintf("readLine() failed: %v", err)}
+			}
+			if !ok {
+				return Null(nil), nil
+			}
+			return line, nil
+		}},
+	}, nil)
+
+	stderr := newNativeModule("stderr", []*NativeFunction{
+		{Name: "write", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if rs.ErrWriter == nil {
+				return nil, RuntimeError{message: "Standard error is not available"}
+			}
+			_, err := io.WriteString(rs.ErrWriter, stringify(args[0]))
+			if err != nil {
+				return nil, RuntimeError{message: fmt.Sprintf("write() failed: %v", err)}
+			}
+			return Null(nil), nil
+		}},
+	}, nil)
+
+	return newNativeModule("io", nil, map[string]Value{"stdin": stdin, "stderr": stderr})
+}
+
+// Builds writeFile or appendFile, which take a path and a string
+func writeFunction(name string, write func(WriteFS, string, []byte) error) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		fsys, file, err := rs.writableFileArg(name, args)
+		if err != nil {
+			return nil, err
+		}
+		data, err := stringArg(name, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return Null(nil), fileError(name, write(fsys, file, []byte(data)))
+	}}
+}
+
+// Checks the path argument of a file function and the runtime's
+// permission to read it
+func (rs *RuntimeState) fileArg(fn string, args []Value) (fs.FS, string, error) {
+	p, err := stringArg(fn, args, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := rs.require(CapFSRead, "fs."+fn); err != nil {
+		return nil, "", err
+	}
+	fsys, err := rs.readFS()
+	if err != nil {
+		return nil, "", err
+	}
+	return fsys, rs.fsName(p), nil
+}
+
+// Like fileArg, but for functions that modify the file system
+func (rs *RuntimeState) writableFileArg(fn string, args []Value) (WriteFS, string, error) {
+	p, err := stringArg(fn, args, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := rs.require(CapFSWrite, "fs."+fn); err != nil {
+		return nil, "", err
+	}
+	fsys, err := rs.writeFS()
+	if err != nil {
+		return nil, "", err
+	}
+	return fsys, rs.fsName(p), nil
+}
+
+func fileError(fn string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return RuntimeError{message: fmt.Sprintf("%s() failed: %v", fn, err)}
+}
+
+// Reads a line without its line ending. The last line of the input
+// doesn't need one. Returns false at the end of the input.
+func readLine(r *bufio.Reader) (string, bool, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF {
+		if line == "" {
+			return "", false, nil
+		}
+		err = nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), true, nil
+}
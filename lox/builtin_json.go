@@ -0,0 +1,302 @@
+package lox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Nesting deeper than this is reported as an error rather than risking
+// the Go stack, e.g. when toJSON() keeps returning new instances
+const maxJSONDepth = 1000
+
+func newJSONModule() *LoxModule {
+	functions := []*NativeFunction{
+		{Name: "parse", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			text, err := stringArg("parse", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return parseJSON(text)
+		}},
+		{Name: "stringify", MinArity: 1, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			indent := ""
+			if len(args) > 1 {
+				switch n := args[1].(type) {
+				case int64:
+					if n < 0 || n > 10 {
+						return nil, RuntimeError{message: fmt.Sprintf("stringify() indent must be between 0 and 10, got %d", n)}
+					}
+					indent = strings.Repeat(" ", int(n))
+				case string:
+					indent = n
+				default:
+					return nil, argError("stringify", 1, "an integer or string", args[1])
+				}
+			}
+
+			e := jsonEncoder{rs: rs, visiting: make(map[any]bool)}
+			err := e.encode(args[0], 0)
+			if err != nil {
+				return nil, err
+			}
+			if indent == "" {
+				return e.buf.String(), nil
+			}
+
+			var out bytes.Buffer
+			err = json.Indent(&out, e.buf.Bytes(), "", indent)
+			if err != nil {
+				return nil, RuntimeError{message: fmt.Sprintf("stringify() failed: %v", err)}
+			}
+			return out.String(), nil
+		}},
+	}
+
+	return newNativeModule("json", functions, nil)
+}
+
+// Parses JSON text into Lox values. Objects become maps that keep
+// their key order, and numbers become integers unless they have a
+// fraction or exponent.
+func parseJSON(text string) (Value, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+
+	value, err := decodeJSON(dec, 0)
+	if err == nil {
+		// Only whitespace may follow the value
+		if _, err = dec.Token(); err == io.EOF {
+			return value, nil
+		} else if err == nil {
+			err = errors.New("unexpected data after the value")
+		}
+	}
+
+	offset := dec.InputOffset()
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		offset = syntaxErr.Offset
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		offset = int64(len(text))
+		err = errors.New("unexpected end of JSON input")
+	}
+	line, column := textPosition(text, int(offset))
+	return nil, RuntimeError{message: fmt.Sprintf("parse() failed at line %d, column %d: %v", line, column, err)}
+}
+
+func decodeJSON(dec *json.Decoder, depth int) (Value, error) {
+	if depth > maxJSONDepth {
+		return nil, errors.New("input is nested too deeply")
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case nil:
+		return Null(nil), nil
+	case bool, string:
+		return t, nil
+	case json.Number:
+		return jsonNumber(t)
+	case json.Delim:
+		switch t {
+		case '[':
+			elements := make([]Value, 0)
+			for dec.More() {
+				el, err := decodeJSON(dec, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, el)
+			}
+			_, err := dec.Token()
+			return NewLoxList(elements), err
+		case '{':
+			m := NewLoxMap()
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeJSON(dec, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				m.Set(key.(string), value)
+			}
+			_, err := dec.Token()
+			return m, err
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %v", tok)
+}
+
+func jsonNumber(n json.Number) (Value, error) {
+	text := n.String()
+	if strings.ContainsAny(text, ".eE") {
+		return strconv.ParseFloat(text, 64)
+	}
+	i, ok := new(big.Int).SetString(text, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %s", text)
+	}
+	return normalizeInt(i), nil
+}
+
+// Converts a byte offset into a 1-based line and column, counting
+// columns in runes
+func textPosition(text string, offset int) (int, int) {
+	offset = min(offset, len(text))
+	before := text[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:]) + 1
+	return line, column
+}
+
+type jsonEncoder struct {
+	rs  *RuntimeState
+	buf bytes.Buffer
+	// Lists, maps and instances currently being encoded, used to
+	// detect cycles
+	visiting map[any]bool
+}
+
+func (e *jsonEncoder) encode(v Value, depth int) error {
+	if depth > maxJSONDepth {
+		return RuntimeError{message: "stringify() value is nested too deeply"}
+	}
+
+	switch val := v.(type) {
+	case nil, Null:
+		e.buf.WriteString("null")
+		return nil
+	case bool:
+		e.buf.WriteString(strconv.FormatBool(val))
+		return nil
+	case string:
+		e.writeString(val)
+		return nil
+	case int64, *big.Int, *big.Rat:
+		e.buf.WriteString(stringify(val))
+		return nil
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return RuntimeError{message: fmt.Sprintf("stringify() can't represent %s in JSON", stringify(val))}
+		}
+		e.buf.WriteString(strconv.FormatFloat(val, 'g', -1, 64))
+		return nil
+	}
+
+	switch val := v.(type) {
+	case *LoxList, *LoxMap, *LoxInstance:
+		if e.visiting[val] {
+			return RuntimeError{message: "stringify() found a cycle"}
+		}
+		e.visiting[val] = true
+		defer delete(e.visiting, val)
+	}
+
+	switch val := v.(type) {
+	case *LoxList:
+		e.buf.WriteByte('[')
+		for i, el := range val.Elements {
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			if err := e.encode(el, depth+1); err != nil {
+				return err
+			}
+		}
+		e.buf.WriteByte(']')
+		return nil
+	case *LoxMap:
+		e.buf.WriteByte('{')
+		for i, key := range val.Keys() {
+			name, err := jsonKey(key)
+			if err != nil {
+				return err
+			}
+			value, _, _ := val.Get(key)
+
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.writeString(name)
+			e.buf.WriteByte(':')
+			if err := e.encode(value, depth+1); err != nil {
+				return err
+			}
+		}
+		e.buf.WriteByte('}')
+		return nil
+	case *LoxInstance:
+		if _, ok := val.Class.Methods["toJSON"]; ok {
+			toJSON, err := getProperty(val, "toJSON")
+			if err != nil {
+				return err
+			}
+			result, err := e.rs.call(toJSON.(LoxCallable), nil)
+			if err != nil {
+				return err
+			}
+			return e.encode(result, depth+1)
+		}
+
+		// Fields are sorted since instances don't remember their order
+		names := make([]string, 0, len(val.Fields))
+		for name := range val.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		e.buf.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.writeString(name)
+			e.buf.WriteByte(':')
+			if err := e.encode(val.Fields[name], depth+1); err != nil {
+				return err
+			}
+		}
+		e.buf.WriteByte('}')
+		return nil
+	}
+
+	return RuntimeError{message: fmt.Sprintf("stringify() can't convert %s to JSON", stringify(v))}
+}
+
+func (e *jsonEncoder) writeString(s string) {
+	enc := json.NewEncoder(&e.buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	// Encode always ends with a newline
+	e.buf.Truncate(e.buf.Len() - 1)
+}
+
+// JSON object keys must be strings, so other scalar keys are written
+// the way print shows them
+func jsonKey(key Value) (string, error) {
+	switch k := key.(type) {
+	case string:
+		return k, nil
+	case nil, Null, bool, int64, *big.Int, *big.Rat, float64:
+		return stringify(k), nil
+	}
+	return "", RuntimeError{message: fmt.Sprintf("stringify() can't use %s as a JSON object key", stringify(key))}
+}
@@ -0,0 +1,202 @@
+package lox
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"time"
+)
+
+// Builds the `math` module. Each runtime gets its own random source so
+// that seeding it in one script doesn't affect another.
+func newMathModule() *LoxModule {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	functions := []*NativeFunction{
+		floatFunction("sqrt", math.Sqrt),
+		floatFunction("sin", math.Sin),
+		floatFunction("cos", math.Cos),
+		floatFunction("tan", math.Tan),
+		floatFunction("log", math.Log),
+		floatFunction("log10", math.Log10),
+		floatFunction("exp", math.Exp),
+		{Name: "atan2", MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			y, err := floatArg("atan2", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			x, err := floatArg("atan2", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			return math.Atan2(y, x), nil
+		}},
+		{Name: "pow", MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			base, err := numberArg("pow", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			exp, err := numberArg("pow", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			return power(rs, base, exp)
+		}},
+		{Name: "abs", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			n, err := numberArg("abs", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			if c, _ := compareNumbers(n, int64(0)); c < 0 {
+				return negate(n)
+			}
+			if f, ok := n.(float64); ok {
+				// Clears the sign of -0.0
+				return math.Abs(f), nil
+			}
+			return n, nil
+		}},
+		roundingFunction("floor", math.Floor, ratFloor),
+		roundingFunction("ceil", math.Ceil, ratCeil),
+		roundingFunction("round", math.Round, ratRound),
+		roundingFunction("trunc", math.Trunc, ratTrunc),
+		extremumFunction("min", -1),
+		extremumFunction("max", 1),
+		{Name: "isNaN", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			n, err := numberArg("isNaN", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			f, ok := n.(float64)
+			return ok && math.IsNaN(f), nil
+		}},
+		{Name: "isFinite", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			n, err := numberArg("isFinite", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			f, ok := n.(float64)
+			return !ok || !(math.IsNaN(f) || math.IsInf(f, 0)), nil
+		}},
+		{Name: "random", MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return rng.Float64(), nil
+		}},
+		{Name: "randomInt", MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			lo, err := integerArg("randomInt", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			hi, err := integerArg("randomInt", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if lo.Cmp(hi) > 0 {
+				return nil, RuntimeError{message: fmt.Sprintf("randomInt() lower bound %s is greater than upper bound %s", lo, hi)}
+			}
+
+			// Both bounds are inclusive
+			span := new(big.Int).Sub(hi, lo)
+			span.Add(span, big.NewInt(1))
+			n := new(big.Int).Rand(rng, span)
+			return normalizeInt(n.Add(n, lo)), nil
+		}},
+		{Name: "seed", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			seed, err := intArg("seed", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			rng.Seed(seed)
+			return Null(nil), nil
+		}},
+	}
+
+	return newNativeModule("math", functions, map[string]Value{
+		"pi":  math.Pi,
+		"e":   math.E,
+		"inf": math.Inf(1),
+		"nan": math.NaN(),
+	})
+}
+
+// Wraps a float function of one argument
+func floatFunction(name string, fn func(float64) float64) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		x, err := floatArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return fn(x), nil
+	}}
+}
+
+// Wraps a rounding function. Integers are returned as they are, and
+// finite floats and decimals are rounded to an integer.
+func roundingFunction(name string, floatFn func(float64) float64, ratFn func(*big.Rat) *big.Int) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		n, err := numberArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		switch x := n.(type) {
+		case *big.Rat:
+			return normalizeInt(ratFn(x)), nil
+		case float64:
+			rounded := floatFn(x)
+			if math.IsNaN(rounded) || math.IsInf(rounded, 0) {
+				return rounded, nil
+			}
+			i, _ := big.NewFloat(rounded).Int(nil)
+			return normalizeInt(i), nil
+		}
+		return n, nil
+	}}
+}
+
+func ratCeil(r *big.Rat) *big.Int {
+	floor := ratFloor(new(big.Rat).Neg(r))
+	return floor.Neg(floor)
+}
+
+func ratTrunc(r *big.Rat) *big.Int {
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// Rounds half away from zero, like math.Round
+func ratRound(r *big.Rat) *big.Int {
+	abs := new(big.Rat).Abs(r)
+	rounded := ratFloor(abs.Add(abs, big.NewRat(1, 2)))
+	if r.Sign() < 0 {
+		rounded.Neg(rounded)
+	}
+	return rounded
+}
+
+// Builds min (sign -1) or max (sign 1). NaN wins over every other
+// argument, since it can't be ordered.
+func extremumFunction(name string, sign int) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 1, MaxArity: VARIADIC, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		var best Value
+		nan := false
+		for i := range args {
+			n, err := numberArg(name, args, i)
+			if err != nil {
+				return nil, err
+			}
+			if f, ok := n.(float64); ok && math.IsNaN(f) {
+				nan = true
+			}
+
+			if best == nil {
+				best = n
+			} else if c, _ := compareNumbers(n, best); c*sign > 0 {
+				best = n
+			}
+		}
+		if nan {
+			return math.NaN(), nil
+		}
+		return best, nil
+	}}
+}
@@ -0,0 +1,137 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// ExitError is returned by Run when a script calls os.exit. It unwinds
+// the interpreter like any other error so the host decides what to do
+// with the exit code.
+type ExitError struct {
+	Code int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// SetArgs exposes command-line arguments to scripts as the global `args`
+// list
+func (rs *RuntimeState) SetArgs(args []string) {
+	rs.Args = args
+	rs.GlobalEnv.Declare("args", stringList(args))
+}
+
+func newOSModule() *LoxModule {
+	functions := []*NativeFunction{
+		{Name: "env", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if err := rs.require(CapEnv, "os.env"); err != nil {
+				return nil, err
+			}
+			name, err := stringArg("env", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return Null(nil), nil
+			}
+			return value, nil
+		}},
+		{Name: "setEnv", MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if err := rs.require(CapEnv, "os.setEnv"); err != nil {
+				return nil, err
+			}
+			name, err := stringArg("setEnv", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			value, err := stringArg("setEnv", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			err = os.Setenv(name, value)
+			if err != nil {
+				return nil, RuntimeError{message: fmt.Sprintf("setEnv() failed: %v", err)}
+			}
+			return Null(nil), nil
+		}},
+		{Name: "exit", MinArity: 0, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			code := int64(0)
+			if len(args) > 0 {
+				var err error
+				code, err = intArg("exit", args, 0)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if code < 0 || code > 255 {
+				return nil, RuntimeError{message: fmt.Sprintf("exit() code must be between 0 and 255, got %d", code)}
+			}
+			return nil, ExitError{Code: int(code)}
+		}},
+		{Name: "cwd", MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if err := rs.require(CapFSRead, "os.cwd"); err != nil {
+				return nil, err
+			}
+			dir := rs.fsName(".")
+			if dir == "." {
+				return "/", nil
+			}
+			return "/" + dir, nil
+		}},
+		{Name: "run", MinArity: 1, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if err := rs.require(CapProcess, "os.run"); err != nil {
+				return nil, err
+			}
+			name, err := stringArg("run", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			var cmdArgs []string
+			if len(args) > 1 {
+				list, ok := args[1].(*LoxList)
+				if !ok {
+					return nil, argError("run", 1, "a list", args[1])
+				}
+				for _, arg := range list.Elements {
+					s, ok := arg.(string)
+					if !ok {
+						return nil, RuntimeError{message: fmt.Sprintf("run() arguments must be strings, got %s", reprValue(arg))}
+					}
+					cmdArgs = append(cmdArgs, s)
+				}
+			}
+
+			var stdout, stderr bytes.Buffer
+			// The subprocess is killed if the run stops while it's going
+			ctx := rs.context()
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			cmd := exec.CommandContext(ctx, name, cmdArgs...)
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+
+			// A non-zero exit is reported through the code, not as an error
+			rs.blocking(func() { err = cmd.Run() })
+			var exitErr *exec.ExitError
+			if err != nil && !errors.As(err, &exitErr) {
+				return nil, RuntimeError{message: fmt.Sprintf("run() failed: %v", err)}
+			}
+
+			result := NewLoxMap()
+			result.Set("stdout", stdout.String())
+			result.Set("stderr", stderr.String())
+			result.Set("code", int64(cmd.ProcessState.ExitCode()))
+			return result, nil
+		}},
+	}
+
+	return newNativeModule("os", functions, nil)
+}
@@ -0,0 +1,427 @@
+package lox
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Functions of the `strings` module. Positions and lengths count runes,
+// the same way the lexer treats source text.
+var stringFunctions = []*NativeFunction{
+	{Name: "len", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg("len", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return int64(utf8.RuneCountInString(s)), nil
+	}},
+	{Name: "substr", MinArity: 2, MaxArity: 3, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg("substr", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		runes := stringToRunes(s)
+		start, end, err := runeRange("substr", runes, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(runes[start:end]), nil
+	}},
+	{Name: "indexOf", MinArity: 2, MaxArity: 3, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg("indexOf", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		sub, err := stringArg("indexOf", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		runes := stringToRunes(s)
+		from := 0
+		if len(args) > 2 {
+			from, _, err = runeRange("indexOf", runes, args, 2)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		i := strings.Index(string(runes[from:]), sub)
+		if i < 0 {
+			return int64(-1), nil
+		}
+		return int64(from + utf8.RuneCountInString(string(runes[from:])[:i])), nil
+	}},
+	{Name: "split", MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg("split", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		sep, err := stringArg("split", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return stringList(strings.Split(s, sep)), nil
+	}},
+	{Name: "join", MinArity: 1, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		list, ok := args[0].(*LoxList)
+		if !ok {
+			return nil, argError("join", 0, "a list", args[0])
+		}
+		sep := ""
+		if len(args) > 1 {
+			var err error
+			sep, err = stringArg("join", args, 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		parts := make([]string, len(list.Elements))
+		for i, el := range list.Elements {
+			parts[i] = stringify(el)
+		}
+		return strings.Join(parts, sep), nil
+	}},
+	stringTransform("trim", strings.TrimSpace),
+	stringTransform("trimStart", func(s string) string { return strings.TrimLeftFunc(s, unicode.IsSpace) }),
+	stringTransform("trimEnd", func(s string) string { return strings.TrimRightFunc(s, unicode.IsSpace) }),
+	stringTransform("upper", strings.ToUpper),
+	stringTransform("lower", strings.ToLower),
+	{Name: "replace", MinArity: 3, MaxArity: 3, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, old, replacement, err := stringArgs3("replace", args)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Replace(s, old, replacement, 1), nil
+	}},
+	{Name: "replaceAll", MinArity: 3, MaxArity: 3, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, old, replacement, err := stringArgs3("replaceAll", args)
+		if err != nil {
+			return nil, err
+		}
+		return strings.ReplaceAll(s, old, replacement), nil
+	}},
+	stringPredicate("startsWith", strings.HasPrefix),
+	stringPredicate("endsWith", strings.HasSuffix),
+	{Name: "repeat", MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg("repeat", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		n, err := intArg("repeat", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, RuntimeError{message: fmt.Sprintf("repeat() count must not be negative, got %d", n)}
+		}
+		if len(s) > 0 && n > math.MaxInt32/int64(len(s)) {
+			return nil, RuntimeError{message: "repeat() result is too long"}
+		}
+		if err := rs.canAllocate(int64(len(s)) * n); err != nil {
+			return nil, err
+		}
+		return strings.Repeat(s, int(n)), nil
+	}},
+	padFunction("padStart", true),
+	padFunction("padEnd", false),
+	{Name: "chars", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg("chars", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		chars := make([]string, 0, len(s))
+		for _, r := range s {
+			chars = append(chars, string(r))
+		}
+		return stringList(chars), nil
+	}},
+	{Name: "codepointAt", MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg("codepointAt", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		runes := stringToRunes(s)
+		i, err := runeIndex("codepointAt", runes, args[1])
+		if err != nil {
+			return nil, err
+		}
+		return int64(runes[i]), nil
+	}},
+	{Name: "fromCodepoint", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		n, err := intArg("fromCodepoint", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > unicode.MaxRune || !utf8.ValidRune(rune(n)) {
+			return nil, RuntimeError{message: fmt.Sprintf("fromCodepoint() got invalid codepoint %d", n)}
+		}
+		return string(rune(n)), nil
+	}},
+	{Name: "format", MinArity: 1, MaxArity: VARIADIC, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		format, err := stringArg("format", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return formatString(format, args[1:])
+	}},
+	{Name: "toNumber", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg("toNumber", args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return parseNumber(s), nil
+	}},
+	{Name: "toString", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		return stringify(args[0]), nil
+	}},
+}
+
+// Functions that can't be called as methods because their first
+// argument isn't the string
+var nonStringMethods = map[string]bool{"join": true, "fromCodepoint": true}
+
+var stringMethods = func() map[string]*NativeFunction {
+	methods := make(map[string]*NativeFunction)
+	for _, f := range stringFunctions {
+		if !nonStringMethods[f.Name] {
+			methods[f.Name] = f
+		}
+	}
+	return methods
+}()
+
+func newStringsModule() *LoxModule {
+	return newNativeModule("strings", stringFunctions, nil)
+}
+
+// Looks up a method on a string value, binding the string as the
+// first argument, so `s.upper()` is `strings.upper(s)`
+func stringMethod(s string, name string) (Value, error) {
+	f, ok := stringMethods[name]
+	if !ok {
+		return nil, RuntimeError{message: fmt.Sprintf("Undefined string method '%s'", name)}
+	}
+
+	maxArity := f.MaxArity
+	if maxArity != VARIADIC {
+		maxArity--
+	}
+	return &NativeFunction{
+		Name:     f.Name,
+		MinArity: f.MinArity - 1,
+		MaxArity: maxArity,
+		Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return f.Fn(rs, append([]Value{s}, args...))
+		},
+	}, nil
+}
+
+func stringTransform(name string, fn func(string) string) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return fn(s), nil
+	}}
+}
+
+func stringPredicate(name string, fn func(string, string) bool) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		other, err := stringArg(name, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return fn(s, other), nil
+	}}
+}
+
+// Builds padStart or padEnd, which pad a string to a width in runes
+// with an optional pad string that defaults to a space
+func padFunction(name string, atStart bool) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 2, MaxArity: 3, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		s, err := stringArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		width, err := intArg(name, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		pad := " "
+		if len(args) > 2 {
+			pad, err = stringArg(name, args, 2)
+			if err != nil {
+				return nil, err
+			}
+			if pad == "" {
+				return nil, RuntimeError{message: fmt.Sprintf("%s() pad string must not be empty", name)}
+			}
+		}
+		if width > math.MaxInt32 {
+			return nil, RuntimeError{message: fmt.Sprintf("%s() result is too long", name)}
+		}
+
+		missing := int(width) - utf8.RuneCountInString(s)
+		if missing <= 0 {
+			return s, nil
+		}
+		if err := rs.canAllocate(int64(missing) * utf8.UTFMax); err != nil {
+			return nil, err
+		}
+		padRunes := stringToRunes(pad)
+		fill := make([]rune, missing)
+		for i := range fill {
+			fill[i] = padRunes[i%len(padRunes)]
+		}
+		if atStart {
+			return string(fill) + s, nil
+		}
+		return s + string(fill), nil
+	}}
+}
+
+func stringArgs3(fn string, args []Value) (string, string, string, error) {
+	var strs [3]string
+	for i := range strs {
+		s, err := stringArg(fn, args, i)
+		if err != nil {
+			return "", "", "", err
+		}
+		strs[i] = s
+	}
+	return strs[0], strs[1], strs[2], nil
+}
+
+func stringList(strs []string) *LoxList {
+	elements := make([]Value, len(strs))
+	for i, s := range strs {
+		elements[i] = s
+	}
+	return NewLoxList(elements)
+}
+
+// Checks an index into a string's runes
+func runeIndex(fn string, runes []rune, idx Value) (int, error) {
+	i, ok := toInt(idx)
+	if !ok {
+		return 0, argError(fn, 1, "an integer", idx)
+	}
+	if i < 0 || i >= len(runes) {
+		return 0, RuntimeError{message: fmt.Sprintf("%s() index %d out of range for string of length %d", fn, i, len(runes))}
+	}
+	return i, nil
+}
+
+// Checks the [start, end) range arguments used by substr and indexOf,
+// starting at args[first]. The end defaults to the length of the string.
+func runeRange(fn string, runes []rune, args []Value, first int) (int, int, error) {
+	start, ok := toInt(args[first])
+	if !ok {
+		return 0, 0, argError(fn, first, "an integer", args[first])
+	}
+	end := len(runes)
+	if len(args) > first+1 {
+		end, ok = toInt(args[first+1])
+		if !ok {
+			return 0, 0, argError(fn, first+1, "an integer", args[first+1])
+		}
+	}
+
+	if start < 0 || end > len(runes) || start > end {
+		return 0, 0, RuntimeError{
+			message: fmt.Sprintf("%s() range [%d, %d) out of range for string of length %d", fn, start, end, len(runes)),
+		}
+	}
+	return start, end, nil
+}
+
+// Parses a number the way it would be written in source, returning nil
+// when the text isn't a number
+func parseNumber(s string) Value {
+	text := strings.TrimSpace(s)
+	digits := strings.TrimLeft(text, "+-")
+	if digits == "" || !unicode.IsDigit(rune(digits[0])) || len(text)-len(digits) > 1 {
+		return Null(nil)
+	}
+
+	n, err := parseNumberLiteral(digits)
+	if err != nil {
+		return Null(nil)
+	}
+	if text[0] == '-' {
+		n, _ = negate(n)
+	}
+	return n
+}
+
+// Formats values printf style. Supported verbs are %s and %v (any value),
+// %q (quoted), %d, %x, %o and %b (integers), %f, %e and %g (numbers) and
+// %% for a literal percent sign. Flags, width and precision work as in Go.
+func formatString(format string, args []Value) (Value, error) {
+	var out strings.Builder
+	next := 0
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			out.WriteByte(format[i])
+			continue
+		}
+
+		// Scan flags, width and precision up to the verb
+		j := i + 1
+		for j < len(format) && strings.IndexByte("+-# 0123456789.", format[j]) >= 0 {
+			j++
+		}
+		if j >= len(format) {
+			return nil, RuntimeError{message: "format() string ends in the middle of a verb"}
+		}
+		spec, verb := format[i:j+1], format[j]
+		i = j
+
+		if verb == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		if next >= len(args) {
+			return nil, RuntimeError{message: fmt.Sprintf("format() is missing an argument for %s", spec)}
+		}
+		arg := args[next]
+		next++
+
+		var operand any
+		switch verb {
+		case 's', 'v':
+			operand = stringify(arg)
+		case 'q':
+			operand = reprValue(arg)
+			spec = spec[:len(spec)-1] + "s"
+		case 'd', 'x', 'X', 'o', 'b':
+			if !isInteger(arg) {
+				return nil, RuntimeError{message: fmt.Sprintf("format() %s needs an integer, got %s", spec, reprValue(arg))}
+			}
+			operand = toBigInt(arg)
+		case 'f', 'e', 'g':
+			if !isNumber(arg) {
+				return nil, RuntimeError{message: fmt.Sprintf("format() %s needs a number, got %s", spec, reprValue(arg))}
+			}
+			operand = toFloat(arg)
+		default:
+			return nil, RuntimeError{message: fmt.Sprintf("format() has unknown verb %s", spec)}
+		}
+		fmt.Fprintf(&out, spec, operand)
+	}
+
+	if next < len(args) {
+		return nil, RuntimeError{message: fmt.Sprintf("format() got %d arguments but the format uses %d", len(args), next)}
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,523 @@
+package lox
+
+import (
+	"bytes"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestMath(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"constants", "print math.pi; print math.e; print math.inf; print -math.inf;",
+			"3.141592653589793\n2.718281828459045\n+Inf\n-Inf\n"},
+		{"sqrt", "print math.sqrt(16); print math.sqrt(2);", "4\n1.4142135623730951\n"},
+		{"pow", "print math.pow(2, 10); print math.pow(2, 0.5); print math.pow(1.5d, 2);",
+			"1024\n1.4142135623730951\n2.25\n"},
+		{"abs keeps the numeric type",
+			"print math.abs(-3); print math.abs(-2.5); print math.abs(-1.10d); print math.abs(-9223372036854775808);",
+			"3\n2.5\n1.1\n9223372036854775808\n"},
+		{"rounding floats",
+			"print math.floor(-2.5); print math.ceil(-2.5); print math.round(-2.5); print math.trunc(-2.5);",
+			"-3\n-2\n-3\n-2\n"},
+		{"rounding decimals",
+			"print math.floor(2.5d); print math.ceil(2.1d); print math.round(2.5d); print math.trunc(-2.9d);",
+			"2\n3\n3\n-2\n"},
+		{"rounding large floats gives big integers", "print math.floor(100000000000000000000.5);", "100000000000000000000\n"},
+		{"rounding infinity", "print math.floor(math.inf);", "+Inf\n"},
+		{"min and max", "print math.min(3, 1.5, 2); print math.max(3, 1.5, 2); print math.max(1);", "1.5\n3\n1\n"},
+		{"min with NaN", "print math.isNaN(math.min(1, math.nan));", "true\n"},
+		{"trigonometry", "print math.sin(0); print math.cos(0); print math.tan(0); print math.atan2(1, 1) * 4;",
+			"0\n1\n0\n3.141592653589793\n"},
+		{"logarithms", "print math.log(math.e); print math.log10(1000); print math.exp(0);", "1\n3\n1\n"},
+		{"isNaN and isFinite",
+			"print math.isNaN(math.nan); print math.isNaN(1); print math.isFinite(1); print math.isFinite(math.inf);",
+			"true\nfalse\ntrue\nfalse\n"},
+		{"seeded random is repeatable",
+			`math.seed(42);
+            var a = math.random();
+            var b = math.randomInt(1, 100);
+            math.seed(42);
+            print a == math.random();
+            print b == math.randomInt(1, 100);`,
+			"true\ntrue\n"},
+		{"random range",
+			`var ok = true;
+            for (var i = 0; i < 100; i++) {
+                var r = math.random();
+                var n = math.randomInt(-2, 2);
+                if (r < 0 or r >= 1 or n < -2 or n > 2) ok = false;
+            }
+            print ok;
+            print math.randomInt(7, 7);`,
+			"true\n7\n"},
+		{"native functions print their name", "print math.sqrt;", "<native fn sqrt>\n"},
+		{"type errors", `math.sqrt("4");`, "RuntimeError: sqrt() argument 1 must be a number, got \"4\"\n"},
+		{"integer arguments", "math.randomInt(1, 2.5);", "RuntimeError: randomInt() argument 2 must be an integer, got 2.5\n"},
+		{"empty random range", "math.randomInt(2, 1);", "RuntimeError: randomInt() lower bound 2 is greater than upper bound 1\n"},
+		{"arity errors", "math.max();", "RuntimeError: Function expected at least 1 argument but got 0\n"},
+		{"missing function", "math.nope();", "RuntimeError: Module 'math' has no export 'nope'\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+
+			s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestStrings(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"concatenation", `print "foo" + "bar"; var s = "a"; s += "b"; print s;`, "foobar\nab\n"},
+		{"concatenating other types", `print "a" + 1;`,
+			"RuntimeError: Operands of '+' must be two numbers or two strings, got \"a\" and 1\n"},
+		{"len counts runes", `print strings.len("héllo"); print strings.len("");`, "5\n0\n"},
+		{"substr", `print strings.substr("héllo", 1, 3); print strings.substr("héllo", 2);`, "él\nllo\n"},
+		{"substr out of range", `strings.substr("abc", 2, 5);`,
+			"RuntimeError: substr() range [2, 5) out of range for string of length 3\n"},
+		{"indexOf", `print strings.indexOf("héllo", "l"); print strings.indexOf("héllo", "l", 3); print strings.indexOf("abc", "z");`,
+			"2\n3\n-1\n"},
+		{"split and join", `var parts = strings.split("a,b,c", ","); print parts; print strings.join(parts, "-"); print strings.join([1, nil, true]);`,
+			"[\"a\", \"b\", \"c\"]\na-b-c\n1niltrue\n"},
+		{"trim", `print "[" + strings.trim("  a b ") + "]"; print "[" + strings.trimStart("  a ") + "]"; print "[" + strings.trimEnd("  a ") + "]";`,
+			"[a b]\n[a ]\n[  a]\n"},
+		{"case", `print strings.upper("héllo"); print strings.lower("ABC");`, "HÉLLO\nabc\n"},
+		{"replace", `print strings.replace("aaa", "a", "b"); print strings.replaceAll("aaa", "a", "b");`, "baa\nbbb\n"},
+		{"prefixes", `print strings.startsWith("hello", "he"); print strings.endsWith("hello", "he");`, "true\nfalse\n"},
+		{"repeat", `print strings.repeat("ab", 3); print strings.repeat("ab", 0) == "";`, "ababab\ntrue\n"},
+		{"repeat negative", `strings.repeat("ab", -1);`, "RuntimeError: repeat() count must not be negative, got -1\n"},
+		{"padding", `print strings.padStart("7", 3, "0"); print strings.padEnd("ab", 5, "xy") + "|"; print strings.padStart("long", 2);`,
+			"007\nabxyx|\nlong\n"},
+		{"chars", `print strings.chars("hé!");`, "[\"h\", \"é\", \"!\"]\n"},
+		{"codepoints", `print strings.codepointAt("hé", 1); print strings.fromCodepoint(233);`, "233\né\n"},
+		{"invalid codepoint", `strings.fromCodepoint(55296);`, "RuntimeError: fromCodepoint() got invalid codepoint 55296\n"},
+		{"format", `print strings.format("%s has %d items costing %.2f (%q) 100%%", "cart", 3, 9.5, "x");`,
+			"cart has 3 items costing 9.50 (\"x\") 100%\n"},
+		{"format big integers", `print strings.format("%d %x", 18446744073709551616, 255);`, "18446744073709551616 ff\n"},
+		{"format type errors", `strings.format("%d", "x");`, "RuntimeError: format() %d needs an integer, got \"x\"\n"},
+		{"format missing argument", `strings.format("%s %s", 1);`, "RuntimeError: format() is missing an argument for %s\n"},
+		{"format extra argument", `strings.format("%s", 1, 2);`, "RuntimeError: format() got 2 arguments but the format uses 1\n"},
+		{"toNumber", `print strings.toNumber("42"); print strings.toNumber(" -1.5 "); print strings.toNumber("0x10"); print strings.toNumber("1.10d"); print strings.toNumber("abc");`,
+			"42\n-1.5\n16\n1.1\nnil\n"},
+		{"toString", `print strings.toString([1, "a"]) + "!";`, "[1, \"a\"]!\n"},
+		{"methods", `var s = " Hi "; print s.trim().upper(); print "a-b".split("-"); print "%d!".format(3); print "abc".len();`,
+			"HI\n[\"a\", \"b\"]\n3!\n3\n"},
+		{"method arity", `"abc".upper(1);`, "RuntimeError: Function expected 0 arguments but got 1\n"},
+		{"unknown method", `"abc".nope();`, "RuntimeError: Undefined string method 'nope'\n"},
+		{"indexing by rune", `var s = "héllo"; print s[1]; print s[4];`, "é\no\n"},
+		{"index out of range", `print "abc"[3];`, "RuntimeError: String index 3 out of range\n"},
+		{"type errors", `strings.upper(1);`, "RuntimeError: upper() argument 1 must be a string, got 1\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+
+			s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestRegex(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"literal", `var r = /a+b/i; print r; print r.source; print r.flags; print r.test("xAAb"); print r.test("b");`,
+			"/a+b/i\na+b\ni\ntrue\nfalse\n"},
+		{"constructor", `var r = Regex("a/b", "s"); print r; print r.test("a/b");`, "/a/b/s\ntrue\n"},
+		{"slashes in classes and escapes", `print /[/]x\/y/.test("/x/y");`, "true\n"},
+		{"division still works", `var a = 8; var b = 2; print a / b / 2; a /= 2; print a;`, "2\n4\n"},
+		{"match groups", `print /(\w+)@(\w+)?x/.match("me@x"); print /z/.match("abc");`, "[\"me@x\", \"me\", nil]\nnil\n"},
+		{"named groups", `var m = /(?P<key>\w+)=(?P<value>\w+)/.match("a=1"); print m["key"]; print m["value"]; print m[0];`,
+			"a\n1\na=1\n"},
+		{"matchAll", `print /\d+/.matchAll("a1b22c333");`, "[[\"1\"], [\"22\"], [\"333\"]]\n"},
+		{"replace with a string", `print /(\w)(\d)/.replace("a1 b2", "$2$1");`, "1a 2b\n"},
+		{"replace with a callback", `print /\d+/.replace("3 apples and 12 pears", (m) => strings.repeat("#", strings.toNumber(m[0])));`,
+			"### apples and ############ pears\n"},
+		{"replace callback must return a string", `/a/.replace("a", (m) => 1);`,
+			"RuntimeError: replace() callback must return a string, got 1\n"},
+		{"split", `print /\s*,\s*/.split("a , b,c");`, "[\"a\", \"b\", \"c\"]\n"},
+		{"literals are compiled once per site",
+			`fun re() { return /x/; }
+            print re() == re();
+            print /x/ == /x/;`,
+			"true\nfalse\n"},
+		{"type pattern", `match (/x/) { case Regex r => print r.source; }`, "x\n"},
+		{"invalid literal", `var r = /(/;`,
+			"Parse Error: Invalid regex /(/: error parsing regexp: missing closing ): `(`\n"},
+		{"unknown flag", `var r = /x/g;`, "Parse Error: Invalid regex /x/g: unknown regex flag 'g'\n"},
+		{"invalid constructor pattern", `Regex("[");`,
+			"RuntimeError: Invalid regex: error parsing regexp: missing closing ]: `[`\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+
+			s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestFS(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"write and read",
+			`fs.writeFile("a.txt", "hello
+");
+            fs.appendFile("a.txt", "world");
+            print fs.readFile("a.txt");`,
+			"hello\nworld\n"},
+		{"readLines streams lines",
+			`fs.writeFile("lines.txt", "one
+two
+
+three");
+            var lines = fs.readLines("lines.txt");
+            while (lines.hasNext()) print lines.next();
+            print lines.hasNext();`,
+			"one\ntwo\n\nthree\nfalse\n"},
+		{"exhausted iterator", `fs.writeFile("e.txt", ""); fs.readLines("e.txt").next();`,
+			"RuntimeError: Iterator readLines is exhausted\n"},
+		{"directories",
+			`fs.mkdir("d/sub");
+            fs.writeFile("d/b.txt", "");
+            fs.writeFile("d/a.txt", "");
+            print fs.listDir("d");
+            print fs.exists("d/a.txt");
+            fs.remove("d/a.txt");
+            print fs.exists("d/a.txt");`,
+			"[\"a.txt\", \"b.txt\", \"sub\"]\ntrue\nfalse\n"},
+		{"stat",
+			`fs.writeFile("s.txt", "12345");
+            var s = fs.stat("s.txt");
+            print s["name"]; print s["size"]; print s["isDir"]; print fs.stat(".")["isDir"];`,
+			"s.txt\n5\nfalse\ntrue\n"},
+		{"paths can't leave the root",
+			`fs.writeFile("../../escape.txt", "x"); print fs.listDir("/");`,
+			"[\"escape.txt\"]\n"},
+		{"missing files", `fs.readFile("nope.txt");`,
+			"RuntimeError: readFile() failed: open nope.txt: no such file or directory\n"},
+		{"type errors", `fs.readFile(1);`, "RuntimeError: readFile() argument 1 must be a string, got 1\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+			s.FS = DirFS(t.TempDir())
+			s.WorkDir = ""
+
+			s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestFSCapabilities(t *testing.T) {
+	readOnly := fstest.MapFS{"data/in.txt": {Data: []byte("input"), ModTime: time.UnixMilli(1700000000123)}}
+
+	cases := []struct {
+		name   string
+		fsys   fs.FS
+		input  string
+		output string
+	}{
+		{"relative to the working directory", readOnly, `print fs.readFile("in.txt");`, "input\n"},
+		{"absolute paths", readOnly, `print fs.readFile("/data/in.txt");`, "input\n"},
+		{"modification time in milliseconds", readOnly, `print fs.stat("in.txt")["modTime"];`, "1700000000123\n"},
+		{"read-only", readOnly, `fs.writeFile("out.txt", "x");`, "RuntimeError: File system is read-only\n"},
+		{"disabled", nil, `fs.exists("in.txt");`, "RuntimeError: File system access is disabled\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+			s.FS = tc.fsys
+			s.WorkDir = "data"
+
+			s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestIO(t *testing.T) {
+	is := is.New(t)
+
+	var out, errOut bytes.Buffer
+	s := NewRuntimeState()
+	s.OutWriter = &out
+	s.ErrWriter = &errOut
+	s.InReader = strings.NewReader("first\nsecond\n")
+
+	s.Run(`
+        var line = io.stdin.readLine();
+        while (line != nil) {
+            io.stderr.write(strings.upper(line) + "
+");
+            line = io.stdin.readLine();
+        }
+        print "done";
+    `)
+	is.Equal(out.String(), "done\n")
+	is.Equal(errOut.String(), "FIRST\nSECOND\n")
+
+	s.InReader = nil
+	s.stdin = nil
+	s.Run(`io.stdin.readLine();`)
+	is.Equal(out.String(), "done\n")
+	is.Equal(errOut.String(), "FIRST\nSECOND\nRuntimeError: Standard input is not available\n")
+}
+
+func TestJSON(t *testing.T) {
+	// Lox strings can't contain quotes, so JSON text comes from files
+	files := fstest.MapFS{
+		"doc.json":       {Data: []byte(`{"b": [1, 2.5, 1e2, 12345678901234567890], "a": {"t": true, "n": null}, "s": "h\u00e9"}`)},
+		"number.json":    {Data: []byte("  42 ")},
+		"string.json":    {Data: []byte(`"x"`)},
+		"nested.json":    {Data: []byte(`{"x":[{"y":"z"}]}`)},
+		"bad.json":       {Data: []byte("{\n  \"a\": 1,\n  \"b\" 2\n}")},
+		"truncated.json": {Data: []byte("[1, 2")},
+		"trailing.json":  {Data: []byte("1 2")},
+	}
+
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"parse",
+			`var v = json.parse(fs.readFile("doc.json"));
+            print v;
+            print v["b"][0] + 1;`,
+			"{\"b\": [1, 2.5, 100, 12345678901234567890], \"a\": {\"t\": true, \"n\": nil}, \"s\": \"hé\"}\n2\n"},
+		{"parse scalars", `print json.parse(fs.readFile("number.json")); print json.parse(fs.readFile("string.json"));`, "42\nx\n"},
+		{"parse errors report the position", `json.parse(fs.readFile("bad.json"));`,
+			"RuntimeError: parse() failed at line 3, column 8: invalid character '2' after object key\n"},
+		{"unexpected end", `json.parse(fs.readFile("truncated.json"));`,
+			"RuntimeError: parse() failed at line 1, column 6: unexpected end of JSON input\n"},
+		{"trailing data", `json.parse(fs.readFile("trailing.json"));`,
+			"RuntimeError: parse() failed at line 1, column 4: unexpected data after the value\n"},
+		{"stringify", `print json.stringify({"a": [1, 2.5, nil, true], 1: "<é>", "big": 1.10d});`,
+			"{\"a\":[1,2.5,null,true],\"1\":\"<é>\",\"big\":1.1}\n"},
+		{"stringify with indent", `print json.stringify({"a": [1]}, 2);`, "{\n  \"a\": [\n    1\n  ]\n}\n"},
+		{"round trip", `var s = fs.readFile("nested.json"); print json.stringify(json.parse(s)) == s;`, "true\n"},
+		{"instances use their fields",
+			`class Point { init(x, y) { this.y = y; this.x = x; } }
+            print json.stringify(Point(1, 2));`,
+			"{\"x\":1,\"y\":2}\n"},
+		{"instances with toJSON",
+			`class Money { init(cents) { this.cents = cents; } toJSON() { return strings.format("$%d.%02d", this.cents ~/ 100, this.cents % 100); } }
+            print json.stringify([Money(1234)]);`,
+			"[\"$12.34\"]\n"},
+		{"cycles", `var l = [1]; l[0] = l; json.stringify(l);`, "RuntimeError: stringify() found a cycle\n"},
+		{"shared values aren't cycles", `var l = [1]; print json.stringify([l, l]);`, "[[1],[1]]\n"},
+		{"toJSON returning itself",
+			`class Loop { toJSON() { return this; } }
+            json.stringify(Loop());`,
+			"RuntimeError: stringify() found a cycle\n"},
+		{"unsupported values", `json.stringify([math.sqrt]);`, "RuntimeError: stringify() can't convert <native fn sqrt> to JSON\n"},
+		{"non-finite floats", `json.stringify(math.nan);`, "RuntimeError: stringify() can't represent NaN in JSON\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+			s.FS = files
+			s.WorkDir = ""
+
+			s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestOS(t *testing.T) {
+	t.Setenv("GLOX_TEST_VAR", "set")
+
+	cases := []struct {
+		name     string
+		input    string
+		output   string
+		allowRun bool
+	}{
+		{"env", `print os.env("GLOX_TEST_VAR"); print os.env("GLOX_TEST_MISSING");`, "set\nnil\n", false},
+		{"setEnv", `os.setEnv("GLOX_TEST_VAR", "changed"); print os.env("GLOX_TEST_VAR");`, "changed\n", false},
+		{"cwd", `print os.cwd();`, "/data/in\n", false},
+		{"args", `print args;`, "[\"a\", \"b c\"]\n", false},
+		{"time.now", `var now = time.now(); print now > 1600000000000 and now == math.trunc(now);`, "true\n", false},
+		{"run", `var r = os.run("sh", ["-c", "echo out; echo err >&2; exit 3"]); print r["stdout"]; print r["stderr"]; print r["code"];`,
+			"out\n\nerr\n\n3\n", true},
+		{"run missing command", `os.run("glox-test-no-such-command");`,
+			"RuntimeError: run() failed: exec: \"glox-test-no-such-command\": executable file not found in $PATH\n", true},
+		{"run needs permission", `os.run("true");`, "PermissionError: os.run() needs the 'process' capability\n", false},
+		{"exit code range", `os.exit(256);`, "RuntimeError: exit() code must be between 0 and 255, got 256\n", false},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			if tc.allowRun {
+				s = NewRuntimeState(WithCapabilities(AllCapabilities...))
+			}
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+			s.WorkDir = "data/in"
+			s.SetArgs([]string{"a", "b c"})
+
+			err := s.Run(tc.input)
+
+			is.NoErr(err)
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestExit(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	s := NewRuntimeState()
+	s.OutWriter = &buf
+	s.ErrWriter = &buf
+
+	err := s.Run(`
+        fun stop() {
+            { os.exit(3); }
+            print "unreachable";
+        }
+        print 1;
+        stop();
+        print 2;
+    `)
+	is.Equal(err, ExitError{Code: 3})
+	is.Equal(buf.String(), "1\n")
+
+	// The runtime can keep going after an exit
+	is.NoErr(s.Run(`print 3;`))
+	is.Equal(buf.String(), "1\n3\n")
+}
+
+func TestTime(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"clock is float seconds",
+			`var start = clock();
+            time.sleep(5);
+            var elapsed = clock() - start;
+            print elapsed >= 0.005 and elapsed < 5;
+            match (start) { case Integer => print "integer"; case Number => print "float"; }`,
+			"true\nfloat\n"},
+		{"Date fields",
+			`var d = time.Date(1700000000123, "UTC");
+            print d;
+            print [d.year, d.month, d.day, d.hour, d.minute, d.second, d.millisecond];
+            print d.weekday; print d.yearDay; print d.zone; print d.timestamp;`,
+			"2023-11-14T22:13:20.123Z\n[2023, 11, 14, 22, 13, 20, 123]\n2\n318\nUTC\n1700000000123\n"},
+		{"timezone conversion",
+			`var d = time.Date(1700000000000, "UTC").inZone("Asia/Tokyo");
+            print d; print d.day; print d.offset; print d.zone;`,
+			"2023-11-15T07:13:20.000+09:00\n15\n32400\nAsia/Tokyo\n"},
+		{"format",
+			`print time.format(0, time.RFC3339, "UTC");
+            print time.format(time.Date(0, "America/New_York"), "2006-01-02 15:04 MST");
+            print time.Date(0, "UTC").format(time.Kitchen);`,
+			"1970-01-01T00:00:00Z\n1969-12-31 19:00 EST\n12:00AM\n"},
+		{"parse",
+			`var t = time.parse("2024-02-29 12:30:00", time.DateTime, "Europe/Paris");
+            print t; print t + time.hour;
+            print time.Date(t, "Europe/Paris");`,
+			"1709206200000\n1709209800000\n2024-02-29T12:30:00.000+01:00\n"},
+		{"parse errors", `time.parse("nope", time.DateOnly, "UTC");`,
+			"RuntimeError: parse() failed: parsing time \"nope\" as \"2006-01-02\": cannot parse \"nope\" as \"2006\"\n"},
+		{"durations",
+			`var d = time.duration("1h30m");
+            print d == time.hour + 30 * time.minute;
+            print time.formatDuration(d + 1500);
+            print time.Date(0, "UTC").add(2 * time.day);`,
+			"true\n1h30m1.5s\n1970-01-03T00:00:00.000Z\n"},
+		{"calendar arithmetic", `print time.Date(1706659200000, "UTC").addDate(0, 1, 0);`, "2024-03-02T00:00:00.000Z\n"},
+		{"timestamps are numbers", `var t = time.now(); print (t + time.second) - t;`, "1000\n"},
+		{"unknown timezone", `time.Date(0, "Mars/Olympus");`, "RuntimeError: Date() unknown timezone \"Mars/Olympus\"\n"},
+		{"type pattern", `match (time.Date()) { case Date d => print d.year > 2000; }`, "true\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+
+			s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
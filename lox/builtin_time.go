@@ -0,0 +1,251 @@
+package lox
+
+import (
+	"fmt"
+	"math"
+	"time"
+	// Timezones work the same on every host, even without a system
+	// zoneinfo database
+	_ "time/tzdata"
+)
+
+// Times are passed around as integer milliseconds since the Unix
+// epoch, and durations as integer milliseconds, so they work with the
+// ordinary arithmetic operators. Date values break a time down into
+// calendar fields in a particular timezone.
+func newTimeModule() *LoxModule {
+	functions := []*NativeFunction{
+		{Name: "now", MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if err := rs.require(CapTime, "time.now"); err != nil {
+				return nil, err
+			}
+			return rs.clock().Now().UnixMilli(), nil
+		}},
+		{Name: "sleep", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if err := rs.require(CapTime, "time.sleep"); err != nil {
+				return nil, err
+			}
+			d, err := durationArg("sleep", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			rs.blocking(func() { err = rs.sleep(d) })
+			return Null(nil), err
+		}},
+		{Name: "Date", MinArity: 0, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			var t time.Time
+			if len(args) > 0 {
+				var err error
+				t, err = timeArg("Date", args, 0)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				// Only reading the current time needs the capability
+				if err := rs.require(CapTime, "time.Date"); err != nil {
+					return nil, err
+				}
+				t = rs.clock().Now()
+			}
+			loc, err := zoneArg("Date", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			return &LoxDate{t.In(loc)}, nil
+		}},
+		{Name: "format", MinArity: 2, MaxArity: 3, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			t, err := timeArg("format", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			layout, err := stringArg("format", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			// Dates keep their own zone unless one is given
+			if _, isDate := args[0].(*LoxDate); !isDate || len(args) > 2 {
+				loc, err := zoneArg("format", args, 2)
+				if err != nil {
+					return nil, err
+				}
+				t = t.In(loc)
+			}
+			return t.Format(layout), nil
+		}},
+		{Name: "parse", MinArity: 2, MaxArity: 3, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			text, err := stringArg("parse", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			layout, err := stringArg("parse", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			loc, err := zoneArg("parse", args, 2)
+			if err != nil {
+				return nil, err
+			}
+
+			t, err := time.ParseInLocation(layout, text, loc)
+			if err != nil {
+				return nil, RuntimeError{message: fmt.Sprintf("parse() failed: %v", err)}
+			}
+			return t.UnixMilli(), nil
+		}},
+		{Name: "duration", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			text, err := stringArg("duration", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			d, err := time.ParseDuration(text)
+			if err != nil {
+				return nil, RuntimeError{message: fmt.Sprintf("duration() failed: %v", err)}
+			}
+			return d.Milliseconds(), nil
+		}},
+		{Name: "formatDuration", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			d, err := durationArg("formatDuration", args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return d.String(), nil
+		}},
+	}
+
+	return newNativeModule("time", functions, map[string]Value{
+		"millisecond": int64(1),
+		"second":      int64(1000),
+		"minute":      int64(60 * 1000),
+		"hour":        int64(60 * 60 * 1000),
+		"day":         int64(24 * 60 * 60 * 1000),
+
+		"RFC3339":  time.RFC3339,
+		"RFC1123":  time.RFC1123,
+		"DateTime": time.DateTime,
+		"DateOnly": time.DateOnly,
+		"TimeOnly": time.TimeOnly,
+		"Kitchen":  time.Kitchen,
+	})
+}
+
+// LoxDate is a point in time viewed in a timezone, created by
+// time.Date() or time.parse()
+type LoxDate struct {
+	t time.Time
+}
+
+func (d *LoxDate) String() string {
+	return d.t.Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func (d *LoxDate) get(name string) (Value, error) {
+	switch name {
+	case "year":
+		return int64(d.t.Year()), nil
+	case "month":
+		return int64(d.t.Month()), nil
+	case "day":
+		return int64(d.t.Day()), nil
+	case "hour":
+		return int64(d.t.Hour()), nil
+	case "minute":
+		return int64(d.t.Minute()), nil
+	case "second":
+		return int64(d.t.Second()), nil
+	case "millisecond":
+		return int64(d.t.Nanosecond() / int(time.Millisecond)), nil
+	case "weekday":
+		// 0 is Sunday
+		return int64(d.t.Weekday()), nil
+	case "yearDay":
+		return int64(d.t.YearDay()), nil
+	case "zone":
+		return d.t.Location().String(), nil
+	case "offset":
+		// Seconds east of UTC
+		_, offset := d.t.Zone()
+		return int64(offset), nil
+	case "timestamp":
+		return d.t.UnixMilli(), nil
+	case "format":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			layout, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return d.t.Format(layout), nil
+		}}, nil
+	case "inZone":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			loc, err := zoneArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return &LoxDate{d.t.In(loc)}, nil
+		}}, nil
+	case "add":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			duration, err := durationArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return &LoxDate{d.t.Add(duration)}, nil
+		}}, nil
+	case "addDate":
+		// Calendar arithmetic, which respects month lengths and DST
+		return &NativeFunction{Name: name, MinArity: 3, MaxArity: 3, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			var parts [3]int64
+			for i := range parts {
+				n, err := intArg(name, args, i)
+				if err != nil {
+					return nil, err
+				}
+				parts[i] = n
+			}
+			return &LoxDate{d.t.AddDate(int(parts[0]), int(parts[1]), int(parts[2]))}, nil
+		}}, nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined Date property '%s'", name)}
+}
+
+// Accepts either a Date or a millisecond timestamp
+func timeArg(fn string, args []Value, i int) (time.Time, error) {
+	switch t := args[i].(type) {
+	case *LoxDate:
+		return t.t, nil
+	case int64:
+		return time.UnixMilli(t), nil
+	}
+	return time.Time{}, argError(fn, i, "a Date or timestamp", args[i])
+}
+
+// Loads the optional timezone argument at args[i], which defaults to the
+// local zone. Zone names come from the IANA database, e.g. "Europe/Paris".
+func zoneArg(fn string, args []Value, i int) (*time.Location, error) {
+	if i >= len(args) {
+		return time.Local, nil
+	}
+	name, err := stringArg(fn, args, i)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, RuntimeError{message: fmt.Sprintf("%s() unknown timezone %q", fn, name)}
+	}
+	return loc, nil
+}
+
+// Converts a millisecond duration argument, which must fit in a
+// time.Duration (about 292 years)
+func durationArg(fn string, args []Value, i int) (time.Duration, error) {
+	ms, err := intArg(fn, args, i)
+	if err != nil {
+		return 0, err
+	}
+	if ms > math.MaxInt64/int64(time.Millisecond) || ms < math.MinInt64/int64(time.Millisecond) {
+		return 0, RuntimeError{message: fmt.Sprintf("%s() duration %dms is out of range", fn, ms)}
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
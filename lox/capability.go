@@ -0,0 +1,86 @@
+package lox
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// Capability names a kind of access to the host that builtins need.
+// Everything else, like math, strings, json and regexes, is pure and
+// always available.
+type Capability string
+
+const (
+	// fs.readFile, readLines, listDir, exists and stat, and os.cwd
+	CapFSRead Capability = "fs-read"
+	// fs.writeFile, appendFile, mkdir and remove
+	CapFSWrite Capability = "fs-write"
+	// os.env and os.setEnv
+	CapEnv Capability = "env"
+	// os.run
+	CapProcess Capability = "process"
+	// Reserved for network access. No builtin uses the network yet.
+	CapNet Capability = "net"
+	// clock(), time.now, time.sleep and time.Date() for the current time
+	CapTime Capability = "time"
+)
+
+// AllCapabilities lists every capability, for hosts that trust their
+// scripts completely
+var AllCapabilities = []Capability{CapFSRead, CapFSWrite, CapEnv, CapProcess, CapNet, CapTime}
+
+// DefaultCapabilities are what NewRuntimeState grants without options:
+// everything but running subprocesses
+var DefaultCapabilities = []Capability{CapFSRead, CapFSWrite, CapEnv, CapNet, CapTime}
+
+// Option configures a RuntimeState made by NewRuntimeState
+type Option func(*RuntimeState)
+
+// WithCapabilities grants exactly the given capabilities. With none, the
+// runtime is pure: scripts can compute and print but can't touch files,
+// the environment, processes or the clock.
+func WithCapabilities(caps ...Capability) Option {
+	return func(rs *RuntimeState) {
+		rs.capabilities = make(map[Capability]bool, len(caps))
+		for _, c := range caps {
+			rs.capabilities[c] = true
+		}
+	}
+}
+
+// WithModuleFS serves every import from fsys, like setting ModuleFS.
+// Imports then don't need CapFSRead, so a sandbox can still import
+// the modules it's given.
+func WithModuleFS(fsys fs.FS) Option {
+	return func(rs *RuntimeState) {
+		rs.ModuleFS = fsys
+	}
+}
+
+// PermissionError is raised by a builtin the runtime wasn't granted the
+// capability for
+type PermissionError struct {
+	// The builtin that was called, e.g. "fs.readFile", or "import"
+	// for an import read from the host's files
+	Operation  string
+	Capability Capability
+}
+
+func (e PermissionError) Error() string {
+	if e.Operation == "import" {
+		return fmt.Sprintf("PermissionError: import needs the '%s' capability", e.Capability)
+	}
+	return fmt.Sprintf("PermissionError: %s() needs the '%s' capability", e.Operation, e.Capability)
+}
+
+// HasCapability reports whether scripts run by rs were granted c
+func (rs *RuntimeState) HasCapability(c Capability) bool {
+	return rs.capabilities[c]
+}
+
+func (rs *RuntimeState) require(c Capability, operation string) error {
+	if !rs.HasCapability(c) {
+		return PermissionError{Operation: operation, Capability: c}
+	}
+	return nil
+}
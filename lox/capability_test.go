@@ -0,0 +1,70 @@
+package lox
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/matryer/is"
+)
+
+func TestCapabilities(t *testing.T) {
+	files := fstest.MapFS{
+		"in.txt":  {Data: []byte("input")},
+		"env.lox": {Data: []byte(`export var home = os.env("HOME");`)},
+	}
+
+	cases := []struct {
+		name   string
+		caps   []Capability
+		input  string
+		output string
+	}{
+		{"pure builtins work", nil,
+			`print math.sqrt(16); print strings.upper("a"); print json.stringify([1]); print time.Date(0, "UTC").year;`,
+			"4\nA\n[1]\n1970\n"},
+		{"read denied", nil, `fs.readFile("in.txt");`,
+			"PermissionError: fs.readFile() needs the 'fs-read' capability\n"},
+		{"read allowed", []Capability{CapFSRead}, `print fs.readFile("in.txt");`,
+			"input\n"},
+		{"write denied", []Capability{CapFSRead}, `fs.writeFile("out.txt", "x");`,
+			"PermissionError: fs.writeFile() needs the 'fs-write' capability\n"},
+		{"cwd", nil, `os.cwd();`,
+			"PermissionError: os.cwd() needs the 'fs-read' capability\n"},
+		{"env", nil, `os.env("HOME");`,
+			"PermissionError: os.env() needs the 'env' capability\n"},
+		{"run", DefaultCapabilities, `os.run("true");`,
+			"PermissionError: os.run() needs the 'process' capability\n"},
+		{"clock", nil, `clock();`,
+			"PermissionError: clock() needs the 'time' capability\n"},
+		{"now", nil, `time.now();`,
+			"PermissionError: time.now() needs the 'time' capability\n"},
+		{"sleep", nil, `time.sleep(1);`,
+			"PermissionError: time.sleep() needs the 'time' capability\n"},
+		{"current date", nil, `time.Date();`,
+			"PermissionError: time.Date() needs the 'time' capability\n"},
+		{"script keeps running", nil, `os.env("HOME"); print "after";`,
+			"PermissionError: os.env() needs the 'env' capability\nafter\n"},
+		{"modules share capabilities", nil, `import "env.lox" as env;`,
+			"in module env.lox: PermissionError: os.env() needs the 'env' capability\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState(WithCapabilities(tc.caps...))
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+			s.FS = files
+			s.WorkDir = ""
+			s.ModuleFS = files
+
+			err := s.Run(tc.input)
+
+			is.NoErr(err)
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
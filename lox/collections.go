@@ -0,0 +1,256 @@
+package lox
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// LoxList is a mutable, ordered collection of values. It's always
+// handled by pointer so that every reference sees the same elements.
+type LoxList struct {
+	Elements []Value
+}
+
+func NewLoxList(elements []Value) *LoxList {
+	if elements == nil {
+		elements = make([]Value, 0)
+	}
+	return &LoxList{Elements: elements}
+}
+
+func (l *LoxList) String() string {
+	return l.repr(make(map[any]bool))
+}
+
+// visiting holds the collections being printed further up, so a list
+// that contains itself prints the back-reference as [...]
+func (l *LoxList) repr(visiting map[any]bool) string {
+	if visiting[l] {
+		return "[...]"
+	}
+	visiting[l] = true
+	defer delete(visiting, l)
+
+	parts := make([]string, len(l.Elements))
+	for i, el := range l.Elements {
+		parts[i] = reprValueSeen(el, visiting)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// Resolves a Lox index value into a position in the list
+func (l *LoxList) index(idx Value) (int, error) {
+	i, ok := toInt(idx)
+	if !ok {
+		return 0, RuntimeError{message: fmt.Sprintf("List index must be an integer, got %s", stringify(idx))}
+	}
+
+	if i < 0 || i >= len(l.Elements) {
+		return 0, RuntimeError{message: fmt.Sprintf("List index %d out of range", i)}
+	}
+
+	return i, nil
+}
+
+// LoxMap is a mutable map that remembers insertion order. Keys must be
+// hashable: nil, booleans, numbers, strings or reference types like
+// lists and instances (which hash by identity).
+type LoxMap struct {
+	keys   []Value
+	values []Value
+	// Maps a key's hash to its position in keys/values
+	index map[any]int
+}
+
+func NewLoxMap() *LoxMap {
+	return &LoxMap{index: make(map[any]int)}
+}
+
+// Keys used for numbers that don't have a canonical Go comparable form
+type bigIntKey struct{ text string }
+type decimalKey struct{ text string }
+type nilKey struct{}
+
+// Computes the Go map key for a Lox value. Numbers that are equal
+// under isEqual hash the same, so 1, 1.0 and 1d are one key.
+func hashKey(v Value) (any, error) {
+	switch k := v.(type) {
+	case nil, Null:
+		return nilKey{}, nil
+	case bool, string, int64, *LoxList, *LoxMap, *LoxInstance, *LoxClass:
+		return k, nil
+	case float64:
+		if k == float64(int64(k)) {
+			return int64(k), nil
+		}
+		return k, nil
+	case *big.Int:
+		return bigIntKey{k.String()}, nil
+	case *big.Rat:
+		if k.IsInt() {
+			return hashKey(normalizeInt(k.Num()))
+		}
+		return decimalKey{k.RatString()}, nil
+	}
+	return nil, RuntimeError{message: fmt.Sprintf("Unhashable map key %s", stringify(v))}
+}
+
+func (m *LoxMap) Len() int {
+	return len(m.keys)
+}
+
+func (m *LoxMap) Get(key Value) (Value, bool, error) {
+	h, err := hashKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	i, ok := m.index[h]
+	if !ok {
+		return nil, false, nil
+	}
+	return m.values[i], true, nil
+}
+
+func (m *LoxMap) Set(key Value, value Value) error {
+	h, err := hashKey(key)
+	if err != nil {
+		return err
+	}
+
+	if i, ok := m.index[h]; ok {
+		m.values[i] = value
+		return nil
+	}
+	m.index[h] = len(m.keys)
+	m.keys = append(m.keys, key)
+	m.values = append(m.values, value)
+	return nil
+}
+
+func (m *LoxMap) Delete(key Value) error {
+	h, err := hashKey(key)
+	if err != nil {
+		return err
+	}
+
+	i, ok := m.index[h]
+	if !ok {
+		return nil
+	}
+	delete(m.index, h)
+	m.keys = append(m.keys[:i], m.keys[i+1:]...)
+	m.values = append(m.values[:i], m.values[i+1:]...)
+	for j := i; j < len(m.keys); j++ {
+		h, _ := hashKey(m.keys[j])
+		m.index[h] = j
+	}
+	return nil
+}
+
+// Keys returns the keys in insertion order
+func (m *LoxMap) Keys() []Value {
+	return m.keys
+}
+
+func (m *LoxMap) String() string {
+	return m.repr(make(map[any]bool))
+}
+
+// Like LoxList.repr, a back-reference prints as {...}
+func (m *LoxMap) repr(visiting map[any]bool) string {
+	if visiting[m] {
+		return "{...}"
+	}
+	visiting[m] = true
+	defer delete(visiting, m)
+
+	parts := make([]string, len(m.keys))
+	for i, k := range m.keys {
+		parts[i] = fmt.Sprintf("%s: %s", reprValueSeen(k, visiting), reprValueSeen(m.values[i], visiting))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func getIndex(object Value, index Value) (Value, error) {
+	switch obj := object.(type) {
+	case *LoxList:
+		i, err := obj.index(index)
+		if err != nil {
+			return nil, err
+		}
+		return obj.Elements[i], nil
+	case *LoxMap:
+		// Missing keys read as nil
+		value, ok, err := obj.Get(index)
+		if err != nil || !ok {
+			return Null(nil), err
+		}
+		return value, nil
+	case string:
+		// Strings index by rune, not byte
+		runes := stringToRunes(obj)
+		i, ok := toInt(index)
+		if !ok {
+			return nil, RuntimeError{message: fmt.Sprintf("String index must be an integer, got %s", stringify(index))}
+		}
+		if i < 0 || i >= len(runes) {
+			return nil, RuntimeError{message: fmt.Sprintf("String index %d out of range", i)}
+		}
+		return string(runes[i]), nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Can't index into %s", stringify(object))}
+}
+
+func setIndex(object Value, index Value, value Value) (Value, error) {
+	switch obj := object.(type) {
+	case *LoxList:
+		i, err := obj.index(index)
+		if err != nil {
+			return nil, err
+		}
+		obj.Elements[i] = value
+		return value, nil
+	case *LoxMap:
+		err := obj.Set(index, value)
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Can't assign to an index of %s", stringify(object))}
+}
+
+// Converts a value to the text shown by print
+func stringify(v Value) string {
+	switch vt := v.(type) {
+	case nil, Null:
+		return "nil"
+	case *big.Rat:
+		return formatDecimal(vt)
+	case fmt.Stringer:
+		return vt.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// Like stringify, but quotes strings so they're distinguishable
+// when nested inside collections
+func reprValue(v Value) string {
+	return reprValueSeen(v, make(map[any]bool))
+}
+
+func reprValueSeen(v Value, visiting map[any]bool) string {
+	switch vt := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", vt)
+	case *LoxList:
+		return vt.repr(visiting)
+	case *LoxMap:
+		return vt.repr(visiting)
+	}
+	return stringify(v)
+}
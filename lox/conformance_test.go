@@ -0,0 +1,311 @@
+package lox
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// The conformance tests are .lox files annotated the way the Crafting
+// Interpreters test suite is, one directory per chapter. The book's own
+// corpus can be copied in from its test/ directory.
+const conformanceDir = "testdata/conformance"
+
+// Chapters glox doesn't implement, ones that only test the book's own
+// tools, and single tests where glox behaves differently. They still
+// run and count towards the pass rates, but failing them doesn't fail
+// the build. Take entries out as the features land.
+var conformanceSkips = map[string]string{
+	"benchmark":   "too slow to run with the tests",
+	"limit":       "tests clox's implementation limits",
+	"scanning":    "for the book's standalone scanner",
+	"expressions": "for the book's standalone expression printer",
+	"inheritance": "classes can't have superclasses",
+	"super":       "classes can't have superclasses",
+
+	"class/init_fields.lox":              "instances print as <Point instance>",
+	"logical_operator/short_circuit.lox": "and and or return booleans rather than an operand",
+	"variable/undefined_global.lox":      "undefined variables have glox's own message, without a line",
+}
+
+var (
+	expectOutputPattern       = regexp.MustCompile(`// expect: ?(.*)`)
+	expectErrorPattern        = regexp.MustCompile(`// (Error.*)`)
+	expectErrorLinePattern    = regexp.MustCompile(`// \[((java|c) )?line (\d+)\] (Error.*)`)
+	expectRuntimeErrorPattern = regexp.MustCompile(`// expect runtime error: (.+)`)
+	syntaxErrorPattern        = regexp.MustCompile(`\[.*line (\d+)\] (Error.+)`)
+	stackTracePattern         = regexp.MustCompile(`\[line (\d+)\]`)
+)
+
+// Exit codes the book's interpreters use
+const (
+	exitCompileError = 65
+	exitRuntimeError = 70
+)
+
+type conformanceExpectations struct {
+	output []string
+	// Compile errors, as "[line N] Error..."
+	errors []string
+	// The runtime error message and the line it's raised on
+	runtimeError     string
+	runtimeErrorLine int
+	exitCode         int
+}
+
+func parseExpectations(source string) conformanceExpectations {
+	var e conformanceExpectations
+	for i, line := range strings.Split(source, "\n") {
+		lineNum := i + 1
+		if m := expectOutputPattern.FindStringSubmatch(line); m != nil {
+			e.output = append(e.output, m[1])
+		} else if m := expectErrorPattern.FindStringSubmatch(line); m != nil {
+			e.errors = append(e.errors, fmt.Sprintf("[line %d] %s", lineNum, m[1]))
+			e.exitCode = exitCompileError
+		} else if m := expectErrorLinePattern.FindStringSubmatch(line); m != nil {
+			// Errors for clox only
+			if m[2] == "c" {
+				continue
+			}
+			e.errors = append(e.errors, fmt.Sprintf("[line %s] %s", m[3], m[4]))
+			e.exitCode = exitCompileError
+		} else if m := expectRuntimeErrorPattern.FindStringSubmatch(line); m != nil {
+			e.runtimeError = m[1]
+			e.runtimeErrorLine = lineNum
+			e.exitCode = exitRuntimeError
+		}
+	}
+	return e
+}
+
+// Runs a script the way `glox script.lox` would
+func runConformance(name string, source string) (stdout string, stderr string, exitCode int) {
+	var out, errOut bytes.Buffer
+	rs := NewRuntimeState()
+	rs.OutWriter = &out
+	rs.ErrWriter = &errOut
+	rs.ScriptPath = name
+	rs.ErrorLines = true
+
+	err := rs.Run(source)
+	switch exit, ok := err.(ExitError); {
+	case ok:
+		exitCode = exit.Code
+	case rs.HadError:
+		exitCode = exitCompileError
+	case rs.HadRuntimeError:
+		exitCode = exitRuntimeError
+	}
+	// glox names the kind of error where the book's interpreters
+	// print just the message
+	stderr = strings.ReplaceAll(errOut.String(), "RuntimeError: ", "")
+	return out.String(), stderr, exitCode
+}
+
+func lines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Lists how the run differs from what the test expects
+func (e conformanceExpectations) check(stdout, stderr string, exitCode int) []string {
+	var failures []string
+	errLines := lines(stderr)
+
+	switch {
+	case e.runtimeError != "":
+		if len(errLines) < 2 {
+			failures = append(failures, fmt.Sprintf("expected runtime error %q and a stack trace, got %q", e.runtimeError, errLines))
+			break
+		}
+		if errLines[0] != e.runtimeError {
+			failures = append(failures, fmt.Sprintf("expected runtime error %q, got %q", e.runtimeError, errLines[0]))
+		}
+		m := stackTracePattern.FindStringSubmatch(errLines[1])
+		if m == nil || m[1] != strconv.Itoa(e.runtimeErrorLine) {
+			failures = append(failures, fmt.Sprintf("expected a stack trace ending on line %d, got %q", e.runtimeErrorLine, errLines[1]))
+		}
+	case len(e.errors) > 0:
+		var found []string
+		for _, line := range errLines {
+			if m := syntaxErrorPattern.FindStringSubmatch(line); m != nil {
+				found = append(found, fmt.Sprintf("[line %s] %s", m[1], m[2]))
+			} else if line != "" {
+				failures = append(failures, fmt.Sprintf("unexpected output on stderr: %q", line))
+			}
+		}
+		expected := append([]string(nil), e.errors...)
+		sort.Strings(expected)
+		sort.Strings(found)
+		if strings.Join(expected, "\n") != strings.Join(found, "\n") {
+			failures = append(failures, fmt.Sprintf("expected errors %q, got %q", expected, found))
+		}
+	default:
+		for _, line := range errLines {
+			failures = append(failures, fmt.Sprintf("unexpected output on stderr: %q", line))
+		}
+	}
+
+	if exitCode != e.exitCode {
+		failures = append(failures, fmt.Sprintf("expected exit code %d, got %d", e.exitCode, exitCode))
+	}
+
+	outLines := lines(stdout)
+	for i, line := range outLines {
+		if i >= len(e.output) {
+			failures = append(failures, fmt.Sprintf("unexpected output %q", line))
+		} else if line != e.output[i] {
+			failures = append(failures, fmt.Sprintf("expected output %q, got %q", e.output[i], line))
+		}
+	}
+	for _, line := range e.output[min(len(outLines), len(e.output)):] {
+		failures = append(failures, fmt.Sprintf("missing output %q", line))
+	}
+	return failures
+}
+
+// Finds the skip entry covering a test, by its path or its chapter
+func conformanceSkip(name string) (string, bool) {
+	if reason, ok := conformanceSkips[name]; ok {
+		return reason, true
+	}
+	chapter, _, _ := strings.Cut(name, "/")
+	reason, ok := conformanceSkips[chapter]
+	return reason, ok
+}
+
+type chapterResult struct {
+	passed, total int
+}
+
+func TestConformance(t *testing.T) {
+	fsys := os.DirFS(conformanceDir)
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && path.Ext(name) == ".lox" {
+			names = append(names, name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Skip("no conformance tests:", err)
+	}
+
+	chapters := make(map[string]*chapterResult)
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := string(data)
+		// Helper files that other tests import
+		if strings.Contains(source, "// nontest") {
+			continue
+		}
+
+		chapter, _, _ := strings.Cut(name, "/")
+		if chapters[chapter] == nil {
+			chapters[chapter] = &chapterResult{}
+		}
+		result := chapters[chapter]
+		result.total++
+
+		failures := parseExpectations(source).check(runConformance(name, source))
+		if len(failures) == 0 {
+			result.passed++
+		}
+
+		t.Run(name, func(t *testing.T) {
+			if len(failures) == 0 {
+				return
+			}
+			if reason, ok := conformanceSkip(name); ok {
+				t.Skipf("%s\n%s", reason, strings.Join(failures, "\n"))
+			}
+			t.Error(strings.Join(failures, "\n"))
+		})
+	}
+
+	// Pass rates show with -v
+	sorted := make([]string, 0, len(chapters))
+	for chapter := range chapters {
+		sorted = append(sorted, chapter)
+	}
+	sort.Strings(sorted)
+	for _, chapter := range sorted {
+		result := chapters[chapter]
+		t.Logf("%-20s %3d/%-3d %5.1f%%", chapter, result.passed, result.total,
+			100*float64(result.passed)/float64(result.total))
+	}
+}
+
+func TestRunConformance(t *testing.T) {
+	is := is.New(t)
+
+	stdout, stderr, code := runConformance("runtime.lox", `print 1;
+fun f() {
+  return nil + 1;
+}
+f();
+print 2;`)
+	is.Equal(stdout, "1\n2\n")
+	is.Equal(stderr, "Operands of '+' must be two numbers or two strings, got nil and 1\n[line 3]\n")
+	is.Equal(code, exitRuntimeError)
+
+	_, stderr, code = runConformance("compile.lox", `var a = ;`)
+	is.Equal(stderr, "[line 1] Error at ';': Couldn't parse expression\n")
+	is.Equal(code, exitCompileError)
+
+	// Scan errors are reported to ErrWriter too, every one of them
+	_, stderr, code = runConformance("scan.lox", "var a = @;\nvar b = #;")
+	is.Equal(stderr, "[line 1] Error: Unexpected character: @\n[line 2] Error: Unexpected character: #\n")
+	is.Equal(code, exitCompileError)
+
+	_, _, code = runConformance("exit.lox", `os.exit(3);`)
+	is.Equal(code, 3)
+}
+
+func TestConformanceExpectations(t *testing.T) {
+	is := is.New(t)
+
+	e := parseExpectations(`print 1; // expect: 1
+print "a"; // expect: a
+var a = ; // Error at ';': Expect expression.
+// [line 5] Error at end: Expect '}' after block.
+// [c line 6] Error: only in clox
+nil + 1; // expect runtime error: Operands must be two numbers or two strings.`)
+	is.Equal(e.output, []string{"1", "a"})
+	is.Equal(e.errors, []string{"[line 3] Error at ';': Expect expression.", "[line 5] Error at end: Expect '}' after block."})
+	is.Equal(e.runtimeError, "Operands must be two numbers or two strings.")
+	is.Equal(e.runtimeErrorLine, 6)
+
+	runtime := conformanceExpectations{output: []string{"1"}, runtimeError: "Boom.", runtimeErrorLine: 2, exitCode: exitRuntimeError}
+	is.Equal(runtime.check("1\n", "Boom.\n[line 2] in script\n", 70), nil)
+	is.Equal(runtime.check("1\n2\n", "Boom.\n[line 3]\n", 0), []string{
+		`expected a stack trace ending on line 2, got "[line 3]"`,
+		"expected exit code 70, got 0",
+		`unexpected output "2"`,
+	})
+
+	compile := conformanceExpectations{errors: []string{"[line 1] Error at 'x': Bad."}, exitCode: exitCompileError}
+	is.Equal(compile.check("", "[line 1] Error at 'x': Bad.\n", 65), nil)
+	is.Equal(compile.check("", "[line 2] Error at 'x': Bad.\nBoom.\n", 70), []string{
+		`unexpected output on stderr: "Boom."`,
+		`expected errors ["[line 1] Error at 'x': Bad."], got ["[line 2] Error at 'x': Bad."]`,
+		"expected exit code 65, got 70",
+	})
+
+	output := conformanceExpectations{output: []string{"a", "b"}}
+	is.Equal(output.check("a\n", "oops\n", 0), []string{`unexpected output on stderr: "oops"`, `missing output "b"`})
+}
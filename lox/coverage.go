@@ -0,0 +1,590 @@
+package lox
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Coverage records which lines of a script run and which way each
+// branch goes: both arms of an if, whether a while loop's condition was
+// true or false, and whether an and, or or ?? short-circuited. Set it as
+// the Coverage of a RuntimeState, which shares it with every module the
+// script imports.
+type Coverage struct {
+	mu    sync.Mutex
+	files map[string]*fileCoverage
+}
+
+type fileCoverage struct {
+	// Empty for coverage read from LCOV
+	source string
+	// Times each line with a statement on it has run
+	lines    map[int]int64
+	branches map[branchPoint]*branchCounts
+}
+
+// Branches are told apart by where they start. LCOV calls the column
+// the branch's block.
+type branchPoint struct {
+	line   int
+	column int
+}
+
+type branchCounts struct {
+	// "if", "while", "and", "or" or "??". Empty when read from LCOV.
+	kind string
+	// Times each way was taken: the then branch, staying in the loop
+	// or short-circuiting first
+	taken [2]int64
+	// Whether the branch was reached at all
+	reached bool
+}
+
+func NewCoverage() *Coverage {
+	return &Coverage{files: make(map[string]*fileCoverage)}
+}
+
+func (c *Coverage) file(path string) *fileCoverage {
+	f, ok := c.files[path]
+	if !ok {
+		f = &fileCoverage{lines: make(map[int]int64), branches: make(map[branchPoint]*branchCounts)}
+		c.files[path] = f
+	}
+	return f
+}
+
+// Adds every statement and branch in the program with a count of zero,
+// so code that never runs shows up as uncovered
+func (c *Coverage) register(path string, source string, program ProgramNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := coverageWalker{c.file(path)}
+	w.file.source = source
+	w.stmts(program.Statements)
+}
+
+type coverageWalker struct {
+	file *fileCoverage
+}
+
+func (w coverageWalker) branch(line, column int, kind string) {
+	p := branchPoint{line: line, column: column}
+	if _, ok := w.file.branches[p]; !ok {
+		w.file.branches[p] = &branchCounts{kind: kind}
+	}
+}
+
+func (w coverageWalker) stmts(stmts []Stmt) {
+	for _, stmt := range stmts {
+		w.stmt(stmt)
+	}
+}
+
+func (w coverageWalker) stmt(stmt Stmt) {
+	if stmt == nil {
+		return
+	}
+	if _, ok := w.file.lines[stmt.line()]; !ok {
+		w.file.lines[stmt.line()] = 0
+	}
+
+	switch s := stmt.(type) {
+	case ExprStmt:
+		w.expr(s.Expr)
+	case PrintStmt:
+		w.expr(s.Expr)
+	case BlockStmt:
+		w.stmts(s.Statements)
+	case DeclarationStmt:
+		if s.Expr != nil {
+			w.expr(*s.Expr)
+		}
+	case FunctionDeclarationStmt:
+		w.function(s.Parameters, s.Body)
+	case ClassDeclarationStmt:
+		for _, f := range s.Functions {
+			w.function(f.Parameters, f.Body)
+		}
+	case ReturnStmt:
+		w.expr(s.Value)
+	case IfStmt:
+		w.branch(s.Line, s.Column, "if")
+		w.expr(s.Condition)
+		w.stmt(s.ThenBranch)
+		w.stmt(s.ElseBranch)
+	case WhileStmt:
+		w.branch(s.Line, s.Column, "while")
+		w.expr(s.Condition)
+		w.stmt(s.Body)
+	case ForInStmt:
+		w.expr(s.Iterable)
+		w.stmt(s.Body)
+	case MatchStmt:
+		w.expr(s.Subject)
+		for _, c := range s.Cases {
+			w.expr(c.Guard)
+			w.stmt(c.Body)
+		}
+	case ExportStmt:
+		w.stmt(s.Declaration)
+	}
+}
+
+// A function's body block isn't a statement of its own, only what's in it
+func (w coverageWalker) function(params []Parameter, body BlockStmt) {
+	for _, param := range params {
+		w.expr(param.Default)
+	}
+	w.stmts(body.Statements)
+}
+
+func (w coverageWalker) exprs(exprs []Expr) {
+	for _, expr := range exprs {
+		w.expr(expr)
+	}
+}
+
+func (w coverageWalker) expr(expr Expr) {
+	switch e := expr.(type) {
+	case FunctionExpr:
+		w.function(e.Parameters, e.Body)
+	case LogicalExpr:
+		kind := map[TokenType]string{AND: "and", OR: "or", QUESTION_QUESTION: "??"}[e.Operation]
+		w.branch(e.Line, e.Column, kind)
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case YieldExpr:
+		w.expr(e.Value)
+	case CallExpr:
+		w.expr(e.Callee)
+		w.exprs(e.Args)
+	case UnaryExpr:
+		w.expr(e.Operand)
+	case GroupingExpr:
+		w.expr(e.Operand)
+	case BinaryExpr:
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case ConditionalExpr:
+		w.expr(e.Condition)
+		w.expr(e.ThenExpr)
+		w.expr(e.ElseExpr)
+	case AssignExpr:
+		w.expr(e.Value)
+	case SpreadExpr:
+		w.expr(e.Operand)
+	case ListExpr:
+		w.exprs(e.Elements)
+	case MapExpr:
+		for _, entry := range e.Entries {
+			w.expr(entry.Key)
+			w.expr(entry.Value)
+		}
+	case IndexExpr:
+		w.expr(e.Object)
+		w.expr(e.Index)
+	case IndexSetExpr:
+		w.expr(e.Object)
+		w.expr(e.Index)
+		w.expr(e.Value)
+	case GetExpr:
+		w.expr(e.Object)
+	case SetExpr:
+		w.expr(e.Object)
+		w.expr(e.Value)
+	case OptionalChainExpr:
+		w.expr(e.Expr)
+	case CompoundAssignExpr:
+		w.expr(e.Target)
+		w.expr(e.Value)
+	case IncrementExpr:
+		w.expr(e.Target)
+	case SpawnExpr:
+		w.expr(e.Call)
+	case AwaitExpr:
+		w.expr(e.Operand)
+	}
+}
+
+// Where the last statement covered on a task started
+type coveredLine struct {
+	script string
+	line   int
+}
+
+// Counts line as a statement starting on it runs. Statements that
+// follow each other on one line count once, so a line's count is how
+// many times it ran rather than how many statements it has.
+func (rs *RuntimeState) coverStatement(line int) {
+	at := coveredLine{script: rs.script, line: line}
+	if rs.lastCovered == at {
+		return
+	}
+	rs.lastCovered = at
+
+	c := rs.Coverage
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file(rs.script).lines[line]++
+}
+
+// Counts the next statement even if it's on the line that was just
+// counted, for each pass through a loop and each call, so a one-line
+// loop body or a recursive call counts every time it runs
+func (rs *RuntimeState) coverAgain() {
+	rs.lastCovered = coveredLine{}
+}
+
+// Counts which way a branch went. first is the then branch of an if,
+// staying in a while loop or a logical operator short-circuiting.
+func (rs *RuntimeState) coverBranch(line, column int, first bool) {
+	c := rs.Coverage
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.file(rs.script)
+	p := branchPoint{line: line, column: column}
+	b, ok := f.branches[p]
+	if !ok {
+		b = &branchCounts{}
+		f.branches[p] = b
+	}
+	b.reached = true
+	if first {
+		b.taken[0]++
+	} else {
+		b.taken[1]++
+	}
+}
+
+// Merge adds the counts from other, e.g. from another run or one read
+// with ReadLCOV
+func (c *Coverage) Merge(other *Coverage) {
+	if c == other {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	for path, of := range other.files {
+		f := c.file(path)
+		if f.source == "" {
+			f.source = of.source
+		}
+		for line, n := range of.lines {
+			f.lines[line] += n
+		}
+		for p, ob := range of.branches {
+			b, ok := f.branches[p]
+			if !ok {
+				b = &branchCounts{kind: ob.kind}
+				f.branches[p] = b
+			}
+			if b.kind == "" {
+				b.kind = ob.kind
+			}
+			b.reached = b.reached || ob.reached
+			b.taken[0] += ob.taken[0]
+			b.taken[1] += ob.taken[1]
+		}
+	}
+}
+
+// Filter drops the files that keep returns false for, like tests that
+// would otherwise count towards their own coverage
+func (c *Coverage) Filter(keep func(path string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.files {
+		if !keep(path) {
+			delete(c.files, path)
+		}
+	}
+}
+
+func (c *Coverage) sortedFiles() []string {
+	paths := make([]string, 0, len(c.files))
+	for path := range c.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (f *fileCoverage) sortedLines() []int {
+	lines := make([]int, 0, len(f.lines))
+	for line := range f.lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+func (f *fileCoverage) sortedBranches() []branchPoint {
+	points := make([]branchPoint, 0, len(f.branches))
+	for p := range f.branches {
+		points = append(points, p)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].line != points[j].line {
+			return points[i].line < points[j].line
+		}
+		return points[i].column < points[j].column
+	})
+	return points
+}
+
+// Lines found and hit, and branches found and hit. Each branch point has
+// two branches.
+func (f *fileCoverage) counts() (lines, linesHit, branches, branchesHit int) {
+	for _, n := range f.lines {
+		lines++
+		if n > 0 {
+			linesHit++
+		}
+	}
+	for _, b := range f.branches {
+		branches += 2
+		for _, n := range b.taken {
+			if n > 0 {
+				branchesHit++
+			}
+		}
+	}
+	return
+}
+
+// WriteSummary writes the percentage of lines and branches covered in
+// each file and overall
+func (c *Coverage) WriteSummary(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	percent := func(hit, found int) string {
+		if found == 0 {
+			return "     -"
+		}
+		return fmt.Sprintf("%5.1f%%", 100*float64(hit)/float64(found))
+	}
+
+	var lines, linesHit, branches, branchesHit int
+	for _, path := range c.sortedFiles() {
+		l, lh, b, bh := c.files[path].counts()
+		lines, linesHit, branches, branchesHit = lines+l, linesHit+lh, branches+b, branchesHit+bh
+		_, err := fmt.Fprintf(w, "%s\tlines %s (%d/%d)\tbranches %s (%d/%d)\n", path, percent(lh, l), lh, l, percent(bh, b), bh, b)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "total\tlines %s (%d/%d)\tbranches %s (%d/%d)\n",
+		percent(linesHit, lines), linesHit, lines, percent(branchesHit, branches), branchesHit, branches)
+	return err
+}
+
+// WriteLCOV writes the coverage in the LCOV tracefile format read by
+// genhtml and most CI coverage services
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, path := range c.sortedFiles() {
+		f := c.files[path]
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", path)
+
+		for _, p := range f.sortedBranches() {
+			b := f.branches[p]
+			for i, n := range b.taken {
+				// A branch that was never reached is written as "-"
+				taken := "-"
+				if b.reached {
+					taken = strconv.FormatInt(n, 10)
+				}
+				fmt.Fprintf(bw, "BRDA:%d,%d,%d,%s\n", p.line, p.column, i, taken)
+			}
+		}
+		lines, linesHit, branches, branchesHit := f.counts()
+		fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", branches, branchesHit)
+
+		for _, line := range f.sortedLines() {
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, f.lines[line])
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", lines, linesHit)
+	}
+	return bw.Flush()
+}
+
+// ReadLCOV reads coverage written by WriteLCOV, so runs can be merged
+func ReadLCOV(r io.Reader) (*Coverage, error) {
+	c := NewCoverage()
+	var f *fileCoverage
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		key, value, _ := strings.Cut(line, ":")
+		fields := strings.Split(value, ",")
+
+		var err error
+		switch key {
+		case "SF":
+			f = c.file(value)
+		case "DA":
+			var line, count int64
+			if len(fields) < 2 || f == nil {
+				return nil, fmt.Errorf("line %d: malformed DA record", n)
+			}
+			if line, err = strconv.ParseInt(fields[0], 10, 0); err == nil {
+				count, err = strconv.ParseInt(fields[1], 10, 64)
+			}
+			if err == nil {
+				f.lines[int(line)] += count
+			}
+		case "BRDA":
+			if len(fields) != 4 || f == nil {
+				return nil, fmt.Errorf("line %d: malformed BRDA record", n)
+			}
+			var nums [3]int64
+			for i := range nums {
+				if err == nil {
+					nums[i], err = strconv.ParseInt(fields[i], 10, 0)
+				}
+			}
+			if err != nil {
+				break
+			}
+			p := branchPoint{line: int(nums[0]), column: int(nums[1])}
+			b, ok := f.branches[p]
+			if !ok {
+				b = &branchCounts{}
+				f.branches[p] = b
+			}
+			if fields[3] != "-" && nums[2] >= 0 && nums[2] < 2 {
+				var taken int64
+				taken, err = strconv.ParseInt(fields[3], 10, 64)
+				b.reached = true
+				b.taken[nums[2]] += taken
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return c, scanner.Err()
+}
+
+var coverageHTML = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { line-height: 1.3; }
+.line { display: block; white-space: pre; }
+.count { display: inline-block; width: 4em; text-align: right; padding-right: 1em; color: #888; }
+.number { display: inline-block; width: 3em; text-align: right; padding-right: 1em; color: #888; }
+.hit { background: #dfd; }
+.miss { background: #fdd; }
+.partial { background: #ffc; }
+</style>
+</head>
+<body>
+<h1>Coverage</h1>
+<pre>{{.Summary}}</pre>
+{{range .Files}}
+<h2 id="{{.Path}}">{{.Path}}</h2>
+<pre>{{range .Lines}}<span class="line {{.Class}}" title="{{.Title}}"><span class="number">{{.Number}}</span><span class="count">{{.Count}}</span>{{.Text}}</span>{{end}}</pre>
+{{end}}
+</body>
+</html>
+`))
+
+type htmlFile struct {
+	Path  string
+	Lines []htmlLine
+}
+
+type htmlLine struct {
+	Number int
+	Count  string
+	Text   string
+	// hit, miss, partial when some branch on the line wasn't taken, or
+	// empty for lines without statements
+	Class string
+	// Describes the line's branches
+	Title string
+}
+
+// WriteHTML writes each file's source annotated with how often its lines
+// ran. Lines with a branch that never went one of its ways are marked
+// as partially covered. Files read from LCOV are read from disk.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	var summary strings.Builder
+	if err := c.WriteSummary(&summary); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var files []htmlFile
+	for _, path := range c.sortedFiles() {
+		f := c.files[path]
+		source := f.source
+		if source == "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("reading source for coverage: %w", err)
+			}
+			source = string(data)
+		}
+
+		branches := make(map[int][]string)
+		partial := make(map[int]bool)
+		for _, p := range f.sortedBranches() {
+			b := f.branches[p]
+			kind := b.kind
+			if kind == "" {
+				kind = "branch"
+			}
+			branches[p.line] = append(branches[p.line], fmt.Sprintf("%s at column %d: %d/%d", kind, p.column, b.taken[0], b.taken[1]))
+			if b.taken[0] == 0 || b.taken[1] == 0 {
+				partial[p.line] = true
+			}
+		}
+
+		file := htmlFile{Path: path}
+		for i, text := range strings.Split(strings.TrimSuffix(source, "\n"), "\n") {
+			line := htmlLine{Number: i + 1, Text: text, Title: strings.Join(branches[i+1], "; ")}
+			if n, ok := f.lines[i+1]; ok {
+				line.Count = strconv.FormatInt(n, 10)
+				switch {
+				case n == 0:
+					line.Class = "miss"
+				case partial[i+1]:
+					line.Class = "partial"
+				default:
+					line.Class = "hit"
+				}
+			}
+			file.Lines = append(file.Lines, line)
+		}
+		files = append(files, file)
+	}
+
+	return coverageHTML.Execute(w, struct {
+		Summary string
+		Files   []htmlFile
+	}{summary.String(), files})
+}
@@ -0,0 +1,169 @@
+package lox
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/matryer/is"
+)
+
+const coverageScript = `fun classify(n) {
+  if (n < 0) return "negative";
+  if (n == 0 or n == 1) return "small";
+  return "big";
+}
+var i = 0;
+while (i < 2) i++;
+print classify(0);
+print classify(5);
+print nil ?? "default";`
+
+func runCoverage(t *testing.T, c *Coverage, source string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	s := NewRuntimeState()
+	s.OutWriter = &buf
+	s.ErrWriter = &buf
+	s.ScriptPath = "classify.lox"
+	s.Coverage = c
+	if err := s.Run(source); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestCoverageLCOV(t *testing.T) {
+	is := is.New(t)
+
+	c := NewCoverage()
+	is.Equal(runCoverage(t, c, coverageScript), "small\nbig\ndefault\n")
+
+	var lcov bytes.Buffer
+	is.NoErr(c.WriteLCOV(&lcov))
+	is.Equal(lcov.String(), `TN:
+SF:classify.lox
+BRDA:2,3,0,0
+BRDA:2,3,1,2
+BRDA:3,3,0,1
+BRDA:3,3,1,1
+BRDA:3,14,0,1
+BRDA:3,14,1,1
+BRDA:7,1,0,2
+BRDA:7,1,1,1
+BRDA:10,11,0,0
+BRDA:10,11,1,1
+BRF:10
+BRH:8
+DA:1,1
+DA:2,2
+DA:3,2
+DA:4,1
+DA:6,1
+DA:7,3
+DA:8,1
+DA:9,1
+DA:10,1
+LF:9
+LH:9
+end_of_record
+`)
+}
+
+func TestCoverageSummary(t *testing.T) {
+	is := is.New(t)
+
+	c := NewCoverage()
+	runCoverage(t, c, `fun f(x) {
+  if (x) {
+    return 1;
+  }
+  return 2;
+}
+f(true);`)
+
+	var summary bytes.Buffer
+	is.NoErr(c.WriteSummary(&summary))
+	is.Equal(summary.String(), "classify.lox\tlines  80.0% (4/5)\tbranches  50.0% (1/2)\ntotal\tlines  80.0% (4/5)\tbranches  50.0% (1/2)\n")
+}
+
+func TestCoverageModules(t *testing.T) {
+	is := is.New(t)
+
+	c := NewCoverage()
+	var buf bytes.Buffer
+	s := NewRuntimeState()
+	s.OutWriter = &buf
+	s.ErrWriter = &buf
+	s.ScriptPath = "main.lox"
+	s.ModuleFS = fstest.MapFS{"lib.lox": {Data: []byte(`export fun twice(x) {
+  return x * 2;
+}
+export fun unused() {
+  return 0;
+}`)}}
+	s.Coverage = c
+
+	is.NoErr(s.Run(`import "lib.lox";
+print lib.twice(2);`))
+	is.Equal(buf.String(), "4\n")
+
+	// Lines run by calls into a module count towards the module
+	is.Equal(c.files["lib.lox"].lines, map[int]int64{1: 1, 2: 1, 4: 1, 5: 0})
+	is.Equal(c.files["main.lox"].lines, map[int]int64{1: 1, 2: 1})
+}
+
+func TestCoverageMerge(t *testing.T) {
+	is := is.New(t)
+
+	first, second := NewCoverage(), NewCoverage()
+	runCoverage(t, first, `fun f(x) { if (x) return 1; return 2; }
+f(true);`)
+	runCoverage(t, second, `fun f(x) { if (x) return 1; return 2; }
+f(false);`)
+
+	// Merging a run read back from LCOV gives the same as merging it
+	// directly
+	var lcov bytes.Buffer
+	is.NoErr(second.WriteLCOV(&lcov))
+	read, err := ReadLCOV(&lcov)
+	is.NoErr(err)
+	first.Merge(read)
+
+	var summary bytes.Buffer
+	is.NoErr(first.WriteSummary(&summary))
+	is.Equal(summary.String(), "classify.lox\tlines 100.0% (2/2)\tbranches 100.0% (2/2)\ntotal\tlines 100.0% (2/2)\tbranches 100.0% (2/2)\n")
+	is.Equal(first.files["classify.lox"].lines, map[int]int64{1: 4, 2: 2})
+}
+
+func TestReadLCOVErrors(t *testing.T) {
+	is := is.New(t)
+
+	_, err := ReadLCOV(strings.NewReader("SF:a.lox\nDA:x,1\n"))
+	is.Equal(err.Error(), `line 2: strconv.ParseInt: parsing "x": invalid syntax`)
+
+	_, err = ReadLCOV(strings.NewReader("DA:1,1\n"))
+	is.Equal(err.Error(), "line 1: malformed DA record")
+}
+
+func TestCoverageHTML(t *testing.T) {
+	is := is.New(t)
+
+	c := NewCoverage()
+	runCoverage(t, c, `var x = 1;
+if (x > 0 and x < 5) print "<in range>";
+if (false) print "never";`)
+
+	var html bytes.Buffer
+	is.NoErr(c.WriteHTML(&html))
+	out := html.String()
+
+	is.True(strings.Contains(out, `<h2 id="classify.lox">classify.lox</h2>`))
+	is.True(strings.Contains(out, `<span class="line hit" title=""><span class="number">1</span><span class="count">1</span>var x = 1;</span>`))
+	// Source is escaped, and lines with a branch only taken one way are
+	// partially covered
+	is.True(strings.Contains(out, `&#34;&lt;in range&gt;&#34;`))
+	is.True(strings.Contains(out, `class="line partial" title="if at column 1: 1/0; and at column 11: 0/1"`))
+	is.True(strings.Contains(out, `class="line partial" title="if at column 1: 0/1"><span class="number">3</span><span class="count">1</span>`))
+}
@@ -0,0 +1,470 @@
+package lox
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is the time source for timers and the time module. Hosts can
+// swap in a VirtualClock to make scripts that wait deterministic.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// VirtualClock only moves when it's told to. Sleeping advances it
+// instantly, so the event loop runs each timer as soon as it's next
+// without waiting for real time to pass.
+type VirtualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// Advance moves the clock forward by d
+func (c *VirtualClock) Advance(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (rs *RuntimeState) clock() Clock {
+	if rs.Clock == nil {
+		return systemClock{}
+	}
+	return rs.Clock
+}
+
+// eventLoop holds the callbacks waiting to run: promise reactions,
+// which run as soon as possible in the order they were queued, and
+// timers, which run once their time comes.
+type eventLoop struct {
+	queue  []func(rs *RuntimeState)
+	timers timerHeap
+	// Pending timers by id, for clearTimeout
+	byID   map[int64]*timer
+	nextID int64
+}
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{byID: make(map[int64]*timer)}
+}
+
+func (rs *RuntimeState) eventLoop() *eventLoop {
+	if rs.loop == nil {
+		rs.loop = newEventLoop()
+	}
+	return rs.loop
+}
+
+func (l *eventLoop) enqueue(f func(rs *RuntimeState)) {
+	l.queue = append(l.queue, f)
+}
+
+type timer struct {
+	id   int64
+	due  time.Time
+	fn   LoxCallable
+	args []Value
+	// Zero for setTimeout
+	interval time.Duration
+	index    int
+}
+
+// Orders timers by when they're due, then by id so timers due at the
+// same time run in the order they were set
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].id < h[j].id
+	}
+	return h[i].due.Before(h[j].due)
+}
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *timerHeap) Push(x any) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+func (rs *RuntimeState) setTimer(fn LoxCallable, delay time.Duration, interval time.Duration, args []Value) int64 {
+	l := rs.eventLoop()
+	l.nextID++
+	t := &timer{id: l.nextID, due: rs.clock().Now().Add(delay), fn: fn, args: args, interval: interval}
+	heap.Push(&l.timers, t)
+	l.byID[t.id] = t
+	return t.id
+}
+
+func (l *eventLoop) clearTimer(id int64) {
+	t, ok := l.byID[id]
+	if !ok {
+		return
+	}
+	delete(l.byID, id)
+	heap.Remove(&l.timers, t.index)
+}
+
+// Runs queued callbacks and timers, sleeping until each timer is due,
+// until done returns true or there's nothing left to run. A nil done
+// drains the loop. Errors from callbacks are reported like errors from
+// statements, except for os.exit, which stops the loop.
+func (rs *RuntimeState) runLoop(done func() bool) error {
+	l := rs.eventLoop()
+	for {
+		if err := rs.checkLimits(); err != nil {
+			return err
+		}
+		for len(l.queue) > 0 {
+			if done != nil && done() {
+				return nil
+			}
+			f := l.queue[0]
+			l.queue = l.queue[1:]
+			f(rs)
+		}
+		if done != nil && done() {
+			return nil
+		}
+		if len(l.timers) == 0 {
+			return nil
+		}
+
+		t := l.timers[0]
+		if wait := t.due.Sub(rs.clock().Now()); wait > 0 {
+			var err error
+			rs.blocking(func() { err = rs.sleep(wait) })
+			if err != nil {
+				return err
+			}
+			// A callback may have been cleared or set by another task
+			// in the meantime
+			continue
+		}
+
+		heap.Pop(&l.timers)
+		if t.interval > 0 {
+			t.due = t.due.Add(t.interval)
+			heap.Push(&l.timers, t)
+		} else {
+			delete(l.byID, t.id)
+		}
+
+		_, err := rs.call(t.fn, t.args)
+		if isStopError(err) {
+			return err
+		}
+		if err != nil {
+			rs.reportError(err)
+		}
+	}
+}
+
+// Builds setTimeout or setInterval, which take a callback, a delay in
+// milliseconds and any arguments to pass the callback
+func timerFunction(name string, repeat bool) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 1, MaxArity: VARIADIC, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		fn, ok := args[0].(LoxCallable)
+		if !ok {
+			return nil, argError(name, 0, "a function", args[0])
+		}
+		delay := time.Duration(0)
+		if len(args) > 1 {
+			var err error
+			delay, err = durationArg(name, args, 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var callArgs []Value
+		if len(args) > 2 {
+			callArgs = args[2:]
+		}
+
+		interval := time.Duration(0)
+		if repeat {
+			// A zero interval would never let the clock move on
+			interval = max(delay, time.Millisecond)
+		}
+		return rs.setTimer(fn, max(delay, 0), interval, callArgs), nil
+	}}
+}
+
+// Builds clearTimeout or clearInterval, which both cancel any timer
+func clearTimerFunction(name string) *NativeFunction {
+	return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		id, err := intArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		rs.eventLoop().clearTimer(id)
+		return Null(nil), nil
+	}}
+}
+
+type promiseState int
+
+const (
+	promisePending promiseState = iota
+	promiseFulfilled
+	promiseRejected
+)
+
+// LoxPromise is the eventual result of an async function or of
+// Promise(executor). Reactions to it run on the event loop.
+type LoxPromise struct {
+	state promiseState
+	// The result, or the reason passed to reject()
+	value Value
+	// What awaiting a rejected promise fails with
+	err       error
+	reactions []func(rs *RuntimeState)
+	handled   bool
+	loop      *eventLoop
+}
+
+func (rs *RuntimeState) newPromise() *LoxPromise {
+	return &LoxPromise{loop: rs.eventLoop()}
+}
+
+func (p *LoxPromise) String() string {
+	switch p.state {
+	case promiseFulfilled:
+		return fmt.Sprintf("<promise fulfilled %s>", reprValue(p.value))
+	case promiseRejected:
+		return fmt.Sprintf("<promise rejected %s>", reprValue(p.value))
+	}
+	return "<promise pending>"
+}
+
+func (p *LoxPromise) settle(state promiseState, value Value, err error) {
+	if p.state != promisePending {
+		return
+	}
+	p.state, p.value, p.err = state, value, err
+	for _, reaction := range p.reactions {
+		p.loop.enqueue(reaction)
+	}
+	p.reactions = nil
+
+	if state == promiseRejected && !p.handled {
+		// Checked once the callbacks queued so far have had a chance
+		// to handle it
+		p.loop.enqueue(func(rs *RuntimeState) {
+			if !p.handled {
+				rs.HadRuntimeError = true
+				fmt.Fprintln(rs.errWriter(), "Unhandled promise rejection:", p.err)
+			}
+		})
+	}
+}
+
+// Fulfills the promise, or follows value if it's another promise
+func (p *LoxPromise) resolve(value Value) {
+	other, ok := value.(*LoxPromise)
+	if !ok {
+		p.settle(promiseFulfilled, value, nil)
+		return
+	}
+	if other == p {
+		p.rejectError(RuntimeError{message: "A promise can't be resolved with itself"})
+		return
+	}
+	other.subscribe(func(rs *RuntimeState) {
+		p.settle(other.state, other.value, other.err)
+	})
+}
+
+// Rejects with a Lox value, as reject() does
+func (p *LoxPromise) reject(reason Value) {
+	p.settle(promiseRejected, reason, RuntimeError{message: fmt.Sprintf("Promise rejected with %s", reprValue(reason))})
+}
+
+// Rejects with an error, like one raised by an async function. Handlers
+// get its message as the reason.
+func (p *LoxPromise) rejectError(err error) {
+	p.settle(promiseRejected, err.Error(), err)
+}
+
+// Queues reaction to run once the promise settles
+func (p *LoxPromise) subscribe(reaction func(rs *RuntimeState)) {
+	p.handled = true
+	if p.state == promisePending {
+		p.reactions = append(p.reactions, reaction)
+		return
+	}
+	p.loop.enqueue(reaction)
+}
+
+// Implements then(onFulfilled, onRejected). Either handler may be nil,
+// in which case the result passes through to the returned promise.
+func (p *LoxPromise) then(rs *RuntimeState, onFulfilled, onRejected Value) *LoxPromise {
+	next := rs.newPromise()
+	p.subscribe(func(rs *RuntimeState) {
+		handler := onFulfilled
+		if p.state == promiseRejected {
+			handler = onRejected
+		}
+		callable, ok := handler.(LoxCallable)
+		if !ok {
+			next.settle(p.state, p.value, p.err)
+			return
+		}
+
+		result, err := rs.call(callable, trimArgs(callable, []Value{p.value}))
+		if err != nil {
+			next.rejectError(err)
+			return
+		}
+		next.resolve(result)
+	})
+	return next
+}
+
+// Callbacks don't have to take every argument they're given, like an
+// executor that never rejects
+func trimArgs(callable LoxCallable, args []Value) []Value {
+	if _, maxArity := callable.Arity(); maxArity != VARIADIC && len(args) > maxArity {
+		return args[:maxArity]
+	}
+	return args
+}
+
+func (p *LoxPromise) get(name string) (Value, error) {
+	switch name {
+	case "state":
+		return [...]string{"pending", "fulfilled", "rejected"}[p.state], nil
+	case "then":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			var onRejected Value
+			if len(args) > 1 {
+				onRejected = args[1]
+			}
+			return p.then(rs, args[0], onRejected), nil
+		}}, nil
+	case "catch":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return p.then(rs, nil, args[0]), nil
+		}}, nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined promise property '%s'", name)}
+}
+
+// Promise(executor) calls executor(resolve, reject) straight away. The
+// promise is rejected if the executor fails.
+var promiseConstructor = &NativeFunction{Name: "Promise", MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+	executor, ok := args[0].(LoxCallable)
+	if !ok {
+		return nil, argError("Promise", 0, "a function", args[0])
+	}
+
+	p := rs.newPromise()
+	resolve := &NativeFunction{Name: "resolve", MinArity: 0, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		p.resolve(firstArg(args))
+		return Null(nil), nil
+	}}
+	reject := &NativeFunction{Name: "reject", MinArity: 0, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+		p.reject(firstArg(args))
+		return Null(nil), nil
+	}}
+
+	_, err := rs.call(executor, trimArgs(executor, []Value{resolve, reject}))
+	if err != nil {
+		p.rejectError(err)
+	}
+	return p, nil
+}}
+
+func firstArg(args []Value) Value {
+	if len(args) == 0 {
+		return Null(nil)
+	}
+	return args[0]
+}
+
+// Calls an async function. Its body runs as a coroutine until the first
+// await of an unsettled promise, then carries on from the event loop
+// each time the promise it's waiting on settles.
+func (rs *RuntimeState) startAsync(f LoxFunction) *LoxPromise {
+	result := rs.newPromise()
+	body := newCoroutineFunction(rs, f, true)
+
+	var step func(rs *RuntimeState, sent coroutineResume)
+	step = func(rs *RuntimeState, sent coroutineResume) {
+		value, suspended, err := body.resume(sent)
+		if err != nil {
+			result.rejectError(err)
+			return
+		}
+		if !suspended {
+			result.resolve(value)
+			return
+		}
+
+		// The body only suspends on promises
+		awaited := value.(*LoxPromise)
+		awaited.subscribe(func(rs *RuntimeState) {
+			if awaited.state == promiseRejected {
+				step(rs, coroutineResume{err: awaited.err})
+			} else {
+				step(rs, coroutineResume{value: awaited.value})
+			}
+		})
+	}
+	step(rs, coroutineResume{value: Null(nil)})
+	return result
+}
+
+// Waits for a promise outside of an async function by running the event
+// loop until it settles
+func (rs *RuntimeState) awaitPromise(p *LoxPromise) (Value, error) {
+	p.handled = true
+	err := rs.runLoop(func() bool { return p.state != promisePending })
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.state {
+	case promiseFulfilled:
+		return p.value, nil
+	case promiseRejected:
+		return nil, p.err
+	}
+	return nil, RuntimeError{message: "Awaited a promise that can never settle"}
+}
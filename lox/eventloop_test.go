@@ -0,0 +1,162 @@
+package lox
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestEventLoop(t *testing.T) {
+	// Promise that resolves with v after ms milliseconds
+	const delay = `
+        var start = time.now();
+        fun delay(ms, v) { return Promise(fun (resolve) { setTimeout(resolve, ms, v); }); }
+        fun elapsed() { return time.now() - start; }
+    `
+
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"timers run in order",
+			`setTimeout(fun () { print "b"; print elapsed(); }, 20);
+            setTimeout(fun () { print "a"; print elapsed(); }, 10);
+            setTimeout(fun () { print "c"; }, 20);
+            print "sync";`,
+			"sync\na\n10\nb\n20\nc\n"},
+		{"timer arguments",
+			`setTimeout(fun (a, b) { print a + b; }, 0, 1, 2);`,
+			"3\n"},
+		{"clearTimeout",
+			`var id = setTimeout(fun () { print "never"; }, 10);
+            setTimeout(fun () { print "kept"; }, 20);
+            clearTimeout(id);
+            clearTimeout(12345);`,
+			"kept\n"},
+		{"setInterval",
+			`var n = 0;
+            var id = setInterval(fun () {
+                n++;
+                print elapsed();
+                if (n == 3) clearInterval(id);
+            }, 100);`,
+			"100\n200\n300\n"},
+		{"timer errors are reported",
+			`setTimeout(fun () { print nope; }, 0);
+            setTimeout(fun () { print "still runs"; }, 1);`,
+			"Var nope has never been declared\nstill runs\n"},
+		{"promise then",
+			`var p = delay(50, "done");
+            print p;
+            p.then(fun (v) { print v; print elapsed(); print p.state; });`,
+			"<promise pending>\ndone\n50\nfulfilled\n"},
+		{"promise chaining",
+			`Promise(fun (resolve, reject) { reject("bad"); })
+                .then(fun (v) { print "skipped"; })
+                .catch(fun (reason) { print reason; return delay(5, 1); })
+                .then(fun (v) { print v + 1; });`,
+			"bad\n2\n"},
+		{"promise callbacks run before timers",
+			`setTimeout(fun () { print "timer"; }, 0);
+            Promise(fun (resolve) { resolve(1); }).then(fun () { print "promise"; });
+            print "sync";`,
+			"sync\npromise\ntimer\n"},
+		{"executor errors reject",
+			`Promise(fun () { print nope; }).catch(fun (e) { print e; });`,
+			"Var nope has never been declared\n"},
+		{"unhandled rejection",
+			`Promise(fun (resolve, reject) { reject(1); });`,
+			"Unhandled promise rejection: RuntimeError: Promise rejected with 1\n"},
+		{"async function",
+			`async fun work() {
+                var a = await delay(10, 1);
+                var b = await delay(20, 2);
+                return a + b;
+            }
+            work().then(fun (v) { print v; print elapsed(); });
+            print "started";`,
+			"started\n3\n30\n"},
+		{"async runs until its first await",
+			`async fun f() { print "in"; await delay(0, 0); print "after"; }
+            var p = f();
+            print "out";
+            match (p) { case Promise => print "promise"; }`,
+			"in\nout\npromise\nafter\n"},
+		{"top-level await",
+			`async fun twice(x) { return 2 * await delay(5, x); }
+            print await twice(4);
+            print elapsed();
+            print await delay(1, "plain");`,
+			"8\n5\nplain\n"},
+		{"async errors reject",
+			`async fun bad() { await delay(1, 0); return 1 + nil; }
+            bad().catch(fun (e) { print e; });
+            await bad();
+            print "after";`,
+			"RuntimeError: Operands of '+' must be two numbers or two strings, got 1 and nil\n" +
+				"RuntimeError: Operands of '+' must be two numbers or two strings, got 1 and nil\n" +
+				"after\n"},
+		{"await of a rejected promise fails",
+			`async fun f() {
+                await Promise(fun (resolve, reject) { reject("no"); });
+                print "unreached";
+            }
+            await f();`,
+			"RuntimeError: Promise rejected with \"no\"\n"},
+		{"await of a promise that never settles",
+			`await Promise(fun (resolve, reject) {});`,
+			"RuntimeError: Awaited a promise that can never settle\n"},
+		{"async methods and expressions",
+			`class Counter {
+                init() { this.n = 5; }
+                async get() { await delay(1, nil); return this.n; }
+            }
+            print await Counter().get();
+            var f = async fun () { return "anon"; };
+            print await f();`,
+			"5\nanon\n"},
+		{"async generators",
+			`async fun* f() {}`,
+			"Parse Error: Async functions can't be generators\n"},
+		{"time.sleep uses the clock",
+			`time.sleep(1500);
+            print elapsed();`,
+			"1500\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+			s.Clock = NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+			err := s.Run(delay + tc.input)
+
+			is.NoErr(err)
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestEventLoopSystemClock(t *testing.T) {
+	is := is.New(t)
+	var buf bytes.Buffer
+
+	s := NewRuntimeState()
+	s.OutWriter = &buf
+	s.ErrWriter = &buf
+
+	started := time.Now()
+	err := s.Run(`setTimeout(fun () { print "done"; }, 20);`)
+
+	is.NoErr(err)
+	is.Equal(buf.String(), "done\n")
+	is.True(time.Since(started) >= 20*time.Millisecond)
+}
@@ -0,0 +1,176 @@
+package lox
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WriteFS is a file system scripts can modify as well as read. Names
+// follow the same rules as fs.FS: slash separated and unrooted.
+type WriteFS interface {
+	fs.FS
+	WriteFile(name string, data []byte) error
+	AppendFile(name string, data []byte) error
+	// MkdirAll creates a directory along with any missing parents
+	MkdirAll(name string) error
+	// Remove deletes a file or an empty directory
+	Remove(name string) error
+}
+
+// DirFS is a WriteFS rooted at a directory of the OS file system.
+// Scripts can't reach files outside of it, either by name or through
+// symlinks. Links are checked before each operation, so a process that
+// changes them in the meantime could still get around that.
+type DirFS string
+
+// Returned for names that lead out of a DirFS through a symlink
+var errOutsideRoot = errors.New("path leads outside the root directory")
+
+func (dir DirFS) Open(name string) (fs.File, error) {
+	var file fs.File
+	err := dir.withPath("open", name, func(p string) error {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		file = f
+		return nil
+	})
+	return file, err
+}
+
+func (dir DirFS) Stat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := dir.withPath("stat", name, func(p string) error {
+		var err error
+		info, err = os.Stat(p)
+		return err
+	})
+	return info, err
+}
+
+func (dir DirFS) WriteFile(name string, data []byte) error {
+	return dir.withPath("write", name, func(p string) error {
+		return os.WriteFile(p, data, 0o666)
+	})
+}
+
+func (dir DirFS) AppendFile(name string, data []byte) error {
+	return dir.withPath("append", name, func(p string) error {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return errors.Join(err, f.Close())
+	})
+}
+
+func (dir DirFS) MkdirAll(name string) error {
+	return dir.withPath("mkdir", name, func(p string) error {
+		return os.MkdirAll(p, 0o777)
+	})
+}
+
+func (dir DirFS) Remove(name string) error {
+	return dir.withPath("remove", name, func(p string) error {
+		return os.Remove(p)
+	})
+}
+
+// Runs an operation on the OS path of a name, reporting errors against
+// the name so the root directory doesn't leak into messages
+func (dir DirFS) withPath(op string, name string, fn func(string) error) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	p, err := dir.resolve(name)
+	if err == nil {
+		err = fn(p)
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// Finds the OS path of a name with every symlink followed, failing if
+// that's outside the root. A name that doesn't exist yet, like a file
+// about to be written, is checked by the parent directories that do.
+func (dir DirFS) resolve(name string) (string, error) {
+	root, err := filepath.EvalSymlinks(string(dir))
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(root, filepath.FromSlash(name))
+	missing := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			p = filepath.Join(resolved, missing)
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		// A link to something that doesn't exist would be followed
+		// when the file is created
+		if _, err := os.Lstat(p); err == nil {
+			return "", errOutsideRoot
+		}
+		missing = filepath.Join(filepath.Base(p), missing)
+		p = filepath.Dir(p)
+	}
+
+	rel, err := filepath.Rel(root, p)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", errOutsideRoot
+	}
+	return p, nil
+}
+
+// Converts a path from a script into a name in rs.FS. Relative paths
+// are relative to rs.WorkDir, and ".." can't climb above the root.
+func (rs *RuntimeState) fsName(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join("/", rs.WorkDir, p)
+	}
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (rs *RuntimeState) readFS() (fs.FS, error) {
+	if rs.FS == nil {
+		return nil, RuntimeError{message: "File system access is disabled"}
+	}
+	return rs.FS, nil
+}
+
+func (rs *RuntimeState) writeFS() (WriteFS, error) {
+	fsys, err := rs.readFS()
+	if err != nil {
+		return nil, err
+	}
+	writable, ok := fsys.(WriteFS)
+	if !ok {
+		return nil, RuntimeError{message: "File system is read-only"}
+	}
+	return writable, nil
+}
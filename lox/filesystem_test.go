@@ -0,0 +1,58 @@
+package lox
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestDirFSSymlinks(t *testing.T) {
+	is := is.New(t)
+
+	outside := t.TempDir()
+	is.NoErr(os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o666))
+	root := t.TempDir()
+	is.NoErr(os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0o666))
+	is.NoErr(os.Mkdir(filepath.Join(root, "sub"), 0o777))
+	is.NoErr(os.Symlink(filepath.Join(root, "a.txt"), filepath.Join(root, "sub", "inside.txt")))
+	is.NoErr(os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt")))
+	is.NoErr(os.Symlink(outside, filepath.Join(root, "out")))
+	is.NoErr(os.Symlink(filepath.Join(outside, "new.txt"), filepath.Join(root, "dangling.txt")))
+	fsys := DirFS(root)
+
+	// Links that stay inside the root work as usual
+	data, err := fs.ReadFile(fsys, "sub/inside.txt")
+	is.NoErr(err)
+	is.Equal(string(data), "a")
+	entries, err := fs.ReadDir(fsys, ".")
+	is.NoErr(err)
+	is.Equal(len(entries), 5)
+
+	escapes := map[string]error{}
+	_, escapes["open"] = fsys.Open("secret.txt")
+	_, escapes["stat"] = fsys.Stat("out/secret.txt")
+	escapes["write"] = fsys.WriteFile("out/new.txt", []byte("x"))
+	escapes["dangling"] = fsys.WriteFile("dangling.txt", []byte("x"))
+	escapes["mkdir"] = fsys.MkdirAll("out/dir/sub")
+	for op, err := range escapes {
+		if !errors.Is(err, errOutsideRoot) {
+			t.Fatalf("%s: got %v", op, err)
+		}
+		// Errors name the file the way the script did
+		var pathErr *fs.PathError
+		is.True(errors.As(err, &pathErr))
+		is.True(!filepath.IsAbs(pathErr.Path))
+	}
+	_, err = os.Stat(filepath.Join(outside, "new.txt"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = os.Stat(filepath.Join(outside, "dir"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// New files in directories that don't exist yet are still checked
+	is.NoErr(fsys.MkdirAll("made/here"))
+	is.NoErr(fsys.WriteFile("made/here/b.txt", []byte("b")))
+}
@@ -0,0 +1,480 @@
+package lox
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Format parses source and prints it back in a standard layout, with
+// two space indents and one statement per line. For loops and arrow
+// functions come out in the form they're desugared to. Comments are
+// kept: one after a statement stays at the end of its line, and the
+// rest go on lines of their own before the statement that follows
+// them.
+func Format(source string) (string, error) {
+	tokens, err := ScanTokens(source)
+	if err != nil {
+		return "", err
+	}
+	root, err := Parse(tokens)
+	if err != nil {
+		return "", err
+	}
+
+	f := formatter{comments: &commentQueue{pending: scanComments(source)}}
+	for _, stmt := range root.(ProgramNode).Statements {
+		f.stmt(stmt)
+	}
+	f.trailingComments()
+	for _, c := range f.comments.pending {
+		f.line(c.text)
+	}
+	return f.String(), nil
+}
+
+type comment struct {
+	text string
+	line int
+}
+
+// The source's comments in order. The source has already scanned
+// cleanly, so there are no errors to handle.
+func scanComments(source string) []comment {
+	scanner := NewScanner(source)
+	scanner.KeepTrivia = true
+	var comments []comment
+	add := func(trivia []Trivia) {
+		for _, t := range trivia {
+			if t.IsComment() {
+				comments = append(comments, comment{strings.TrimRightFunc(t.Text, unicode.IsSpace), t.Start.Line})
+			}
+		}
+	}
+	for {
+		tok, err := scanner.Next()
+		if err != nil {
+			continue
+		}
+		add(tok.LeadingTrivia)
+		add(tok.TrailingTrivia)
+		if tok.Type == EOF {
+			return comments
+		}
+	}
+}
+
+// commentQueue holds the comments that haven't been printed yet. It's
+// shared with the formatters for function bodies.
+type commentQueue struct {
+	pending []comment
+	// The formatter that printed the last simple statement or closing
+	// brace, its line in the source and how long the output was after
+	// it. A comment on that line goes at the end of it, as long as
+	// nothing else has been printed since.
+	last     *formatter
+	lastLine int
+	lastEnd  int
+}
+
+// Source text for binary operators and the operators compound
+// assignments apply
+var operatorText = map[TokenType]string{
+	PLUS: "+", MINUS: "-", STAR: "*", SLASH: "/", PERCENT: "%", TILDE_SLASH: "~/", STAR_STAR: "**",
+	EQUAL_EQUAL: "==", BANG_EQUAL: "!=", LESS: "<", LESS_EQUAL: "<=", GREATER: ">", GREATER_EQUAL: ">=",
+	AMPERSAND: "&", PIPE: "|", CARET: "^", LESS_LESS: "<<", GREATER_GREATER: ">>",
+	AND: "and", OR: "or", QUESTION_QUESTION: "??", BANG: "!", TILDE: "~",
+}
+
+type formatter struct {
+	strings.Builder
+	depth    int
+	comments *commentQueue
+}
+
+func (f *formatter) line(text string) {
+	f.WriteString(strings.Repeat("  ", f.depth))
+	f.WriteString(text)
+	f.WriteByte('\n')
+}
+
+// A formatter for text that's printed as part of this one's, like a
+// function's body
+func (f *formatter) nested() *formatter {
+	return &formatter{depth: f.depth, comments: f.comments}
+}
+
+// Called once a nested formatter's text has been taken, so comments
+// can't be added to it any more
+func (f *formatter) done() {
+	f.trailingComments()
+	if f.comments.last == f {
+		f.comments.last = nil
+	}
+}
+
+// Prints the comments before a statement starting on line
+func (f *formatter) commentsBefore(line int) {
+	q := f.comments
+	if line != q.lastLine {
+		f.trailingComments()
+	}
+	for len(q.pending) > 0 && q.pending[0].line < line {
+		f.line(q.pending[0].text)
+		q.pending = q.pending[1:]
+	}
+}
+
+// Adds the comments on the line printed last to the end of it
+func (f *formatter) trailingComments() {
+	q := f.comments
+	last := q.last
+	if last == nil || last.Len() != q.lastEnd {
+		return
+	}
+	for len(q.pending) > 0 && q.pending[0].line == q.lastLine {
+		text := strings.TrimSuffix(last.String(), "\n")
+		last.Reset()
+		last.WriteString(text + " " + q.pending[0].text + "\n")
+		q.pending = q.pending[1:]
+	}
+	q.lastEnd = last.Len()
+}
+
+// Notes that the line just printed was on line in the source
+func (f *formatter) printed(line int) {
+	q := f.comments
+	q.last, q.lastLine, q.lastEnd = f, line, f.Len()
+}
+
+func (f *formatter) stmt(stmt Stmt) {
+	if stmt != nil {
+		f.commentsBefore(stmt.line())
+	}
+
+	switch s := stmt.(type) {
+	case ExprStmt:
+		f.line(f.expr(s.Expr) + ";")
+		f.printed(s.Line)
+	case PrintStmt:
+		f.line("print " + f.expr(s.Expr) + ";")
+		f.printed(s.Line)
+	case BlockStmt:
+		f.line("{")
+		f.block(s)
+		f.closeBrace(s.EndLine)
+	case DeclarationStmt:
+		if s.Expr == nil {
+			f.line("var " + s.Name + ";")
+		} else {
+			f.line("var " + s.Name + " = " + f.expr(*s.Expr) + ";")
+		}
+		f.printed(s.Line)
+	case FunctionDeclarationStmt:
+		f.line(f.functionDeclaration(s, "fun "))
+		f.printed(s.Body.EndLine)
+	case ClassDeclarationStmt:
+		f.line("class " + s.Name + " {")
+		f.depth++
+		for _, method := range s.Functions {
+			f.commentsBefore(method.Line)
+			f.line(f.functionDeclaration(method, ""))
+			f.printed(method.Body.EndLine)
+		}
+		f.commentsBefore(s.EndLine)
+		f.depth--
+		f.closeBrace(s.EndLine)
+	case ImportStmt:
+		// The lexer doesn't interpret escapes, so the path is printed
+		// as it was written, like string literals
+		if s.Alias == "" {
+			f.line(`import "` + s.Path + `";`)
+		} else {
+			f.line(`import "` + s.Path + `" as ` + s.Alias + ";")
+		}
+		f.printed(s.Line)
+	case ExportStmt:
+		inner := f.nested()
+		inner.stmt(s.Declaration)
+		inner.done()
+		f.WriteString(strings.Repeat("  ", f.depth) + "export " + strings.TrimLeft(inner.String(), " "))
+	case ReturnStmt:
+		if s.Value == nil {
+			f.line("return;")
+		} else {
+			f.line("return " + f.expr(s.Value) + ";")
+		}
+		f.printed(s.Line)
+	case IfStmt:
+		head := "if (" + f.expr(s.Condition) + ")"
+		for {
+			braced := f.body(head, s.ThenBranch)
+			head = "else"
+			if braced {
+				head = "} else"
+			}
+			switch e := s.ElseBranch.(type) {
+			case nil:
+				f.end(s.ThenBranch)
+				return
+			case IfStmt:
+				// else if chains stay at the same depth
+				s = e
+				head += " if (" + f.expr(s.Condition) + ")"
+			default:
+				f.body(head, e)
+				f.end(e)
+				return
+			}
+		}
+	case WhileStmt:
+		f.body("while ("+f.expr(s.Condition)+")", s.Body)
+		f.end(s.Body)
+	case ForInStmt:
+		f.body("for (var "+s.Name+" in "+f.expr(s.Iterable)+")", s.Body)
+		f.end(s.Body)
+	case MatchStmt:
+		f.line("match (" + f.expr(s.Subject) + ") {")
+		f.depth++
+		for _, c := range s.Cases {
+			head := "case " + f.pattern(c.Pattern)
+			if c.Guard != nil {
+				head += " if " + f.expr(c.Guard)
+			}
+			f.body(head+" =>", c.Body)
+			f.end(c.Body)
+		}
+		f.commentsBefore(s.EndLine)
+		f.depth--
+		f.closeBrace(s.EndLine)
+	}
+}
+
+// Prints a block's statements one level deeper, along with the
+// comments before its closing brace
+func (f *formatter) block(block BlockStmt) {
+	f.depth++
+	for _, stmt := range block.Statements {
+		f.stmt(stmt)
+	}
+	if block.EndLine > 0 {
+		f.commentsBefore(block.EndLine)
+	} else {
+		f.trailingComments()
+	}
+	f.depth--
+}
+
+// Prints the closing brace of a block that ended on line, which is
+// zero if the block wasn't in the source
+func (f *formatter) closeBrace(line int) {
+	f.line("}")
+	if line > 0 {
+		f.printed(line)
+	}
+}
+
+// Prints the header of an if, while or match case and its body. A
+// block's brace goes on the header line, like a function's, and any
+// other body is indented on the next line. The closing brace is left
+// to end, so that else can go on the same line, and braced says
+// whether there is one.
+func (f *formatter) body(head string, stmt Stmt) (braced bool) {
+	block, ok := stmt.(BlockStmt)
+	if !ok {
+		f.line(head)
+		f.block(BlockStmt{Statements: []Stmt{stmt}})
+		return false
+	}
+	f.line(head + " {")
+	f.block(block)
+	return true
+}
+
+// Closes a body printed by body
+func (f *formatter) end(stmt Stmt) {
+	if block, ok := stmt.(BlockStmt); ok {
+		f.closeBrace(block.EndLine)
+	}
+}
+
+// Prints a function's signature and body. Bodies are indented one level
+// deeper than f and the closing brace lines up with it.
+func (f *formatter) function(keyword string, name string, params []Parameter, body BlockStmt) string {
+	parts := make([]string, len(params))
+	for i, param := range params {
+		switch {
+		case param.Rest:
+			parts[i] = "..." + param.Name
+		case param.Default != nil:
+			parts[i] = param.Name + " = " + f.expr(param.Default)
+		default:
+			parts[i] = param.Name
+		}
+	}
+
+	inner := f.nested()
+	inner.block(body)
+	inner.done()
+	text := keyword + name + "(" + strings.Join(parts, ", ") + ") {"
+	if inner.Len() == 0 {
+		return text + "}"
+	}
+	return text + "\n" + inner.String() + strings.Repeat("  ", f.depth) + "}"
+}
+
+func (f *formatter) functionDeclaration(s FunctionDeclarationStmt, keyword string) string {
+	if s.IsAsync {
+		keyword = "async " + keyword
+	}
+	if s.IsGenerator {
+		keyword += "*"
+	}
+	return f.function(keyword, s.Name, s.Parameters, s.Body)
+}
+
+func (f *formatter) exprs(exprs []Expr) string {
+	parts := make([]string, len(exprs))
+	for i, expr := range exprs {
+		parts[i] = f.expr(expr)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Prints an expression. The parser keeps parentheses as GroupingExprs,
+// so none need adding to keep the precedence the same.
+func (f *formatter) expr(expr Expr) string {
+	switch e := expr.(type) {
+	case LiteralExpr[bool]:
+		return strconv.FormatBool(e.value)
+	case LiteralExpr[*struct{}]:
+		return "nil"
+	case LiteralExpr[int64]:
+		return strconv.FormatInt(e.value, 10)
+	case LiteralExpr[*big.Int]:
+		return e.value.String()
+	case LiteralExpr[*big.Rat]:
+		return formatDecimal(e.value) + "d"
+	case LiteralExpr[float64]:
+		// Floats keep a decimal point so they don't read back as integers
+		text := strconv.FormatFloat(e.value, 'f', -1, 64)
+		if !strings.Contains(text, ".") {
+			text += ".0"
+		}
+		return text
+	case LiteralExpr[string]:
+		return `"` + e.value + `"`
+	case RegexExpr:
+		return e.Regex.String()
+	case VarExpr:
+		return e.Name
+	case ThisExpr:
+		return "this"
+	case GroupingExpr:
+		return "(" + f.expr(e.Operand) + ")"
+	case UnaryExpr:
+		operand := f.expr(e.Operand)
+		// `- -x` isn't `--x` and `~ /a/` isn't `~/a/`
+		if e.Operation == MINUS && strings.HasPrefix(operand, "-") || e.Operation == TILDE && strings.HasPrefix(operand, "/") {
+			return operatorText[e.Operation] + " " + operand
+		}
+		return operatorText[e.Operation] + operand
+	case BinaryExpr:
+		return f.expr(e.Lhs) + " " + operatorText[e.Operation] + " " + f.expr(e.Rhs)
+	case LogicalExpr:
+		return f.expr(e.Lhs) + " " + operatorText[e.Operation] + " " + f.expr(e.Rhs)
+	case ConditionalExpr:
+		return f.expr(e.Condition) + " ? " + f.expr(e.ThenExpr) + " : " + f.expr(e.ElseExpr)
+	case AssignExpr:
+		return e.Name + " = " + f.expr(e.Value)
+	case SetExpr:
+		return f.expr(e.Object) + "." + e.Name + " = " + f.expr(e.Value)
+	case IndexSetExpr:
+		return f.expr(e.Object) + "[" + f.expr(e.Index) + "] = " + f.expr(e.Value)
+	case CompoundAssignExpr:
+		return f.expr(e.Target) + " " + operatorText[e.Operation] + "= " + f.expr(e.Value)
+	case IncrementExpr:
+		op := "++"
+		if e.Operation == MINUS {
+			op = "--"
+		}
+		if e.Prefix {
+			return op + f.expr(e.Target)
+		}
+		return f.expr(e.Target) + op
+	case CallExpr:
+		return f.expr(e.Callee) + "(" + f.exprs(e.Args) + ")"
+	case IndexExpr:
+		return f.expr(e.Object) + "[" + f.expr(e.Index) + "]"
+	case GetExpr:
+		if e.Optional {
+			return f.expr(e.Object) + "?." + e.Name
+		}
+		return f.expr(e.Object) + "." + e.Name
+	case OptionalChainExpr:
+		return f.expr(e.Expr)
+	case SpreadExpr:
+		return "..." + f.expr(e.Operand)
+	case ListExpr:
+		return "[" + f.exprs(e.Elements) + "]"
+	case MapExpr:
+		parts := make([]string, len(e.Entries))
+		for i, entry := range e.Entries {
+			parts[i] = f.expr(entry.Key) + ": " + f.expr(entry.Value)
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case FunctionExpr:
+		keyword := "fun "
+		if e.IsAsync {
+			keyword = "async fun "
+		}
+		if e.IsGenerator {
+			keyword = "fun* "
+		}
+		return f.function(keyword, "", e.Parameters, e.Body)
+	case YieldExpr:
+		if e.Value == nil {
+			return "yield"
+		}
+		return "yield " + f.expr(e.Value)
+	case SpawnExpr:
+		return "spawn " + f.expr(e.Call)
+	case AwaitExpr:
+		return "await " + f.expr(e.Operand)
+	}
+	return fmt.Sprintf("<%T>", expr)
+}
+
+func (f *formatter) pattern(pattern Pattern) string {
+	switch p := pattern.(type) {
+	case LiteralPattern:
+		return f.expr(p.Value)
+	case WildcardPattern:
+		return "_"
+	case BindingPattern:
+		return p.Name
+	case TypePattern:
+		if p.Binding == "" {
+			return p.TypeName
+		}
+		return p.TypeName + " " + p.Binding
+	case ListPattern:
+		parts := make([]string, 0, len(p.Elements)+1)
+		for _, element := range p.Elements {
+			parts = append(parts, f.pattern(element))
+		}
+		if p.HasRest {
+			parts = append(parts, "..."+p.Rest)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case MapPattern:
+		parts := make([]string, len(p.Entries))
+		for i, entry := range p.Entries {
+			parts[i] = f.expr(entry.Key) + ": " + f.pattern(entry.Pattern)
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return fmt.Sprintf("<%T>", pattern)
+}
@@ -0,0 +1,60 @@
+package lox
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestFormat(t *testing.T) {
+	is := is.New(t)
+	cases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"statements", "var a=1;print a+2*(3-a);\n", "var a = 1;\nprint a + 2 * (3 - a);\n"},
+		{"blocks", "if(a){print 1;}else print 2;while(x){x--;}",
+			"if (a) {\n  print 1;\n} else\n  print 2;\nwhile (x) {\n  x--;\n}\n"},
+		{"else if", "if(a)print 1;else if(b){print 2;}else{print 3;}",
+			"if (a)\n  print 1;\nelse if (b) {\n  print 2;\n} else {\n  print 3;\n}\n"},
+		{"match", "match(x){case 1=>{print 1;}case _=>print 2;}",
+			"match (x) {\n  case 1 => {\n    print 1;\n  }\n  case _ =>\n    print 2;\n}\n"},
+		{"comments", "// head\nvar a=1; // one\nfun f(){\n// inside\nreturn a;}\nprint a;print 2; // two\n// tail",
+			"// head\nvar a = 1; // one\nfun f() {\n  // inside\n  return a;\n}\nprint a;\nprint 2; // two\n// tail\n"},
+		{"only comments", "// a\n\n// b\n", "// a\n// b\n"},
+		{"imports", `import "a\x00.lox";import"b.lox"as b;`, "import \"a\\x00.lox\";\nimport \"b.lox\" as b;\n"},
+		{"functions", "fun f(a,b=1,...c){return a;} class A{m(){}}",
+			"fun f(a, b = 1, ...c) {\n  return a;\n}\nclass A {\n  m() {}\n}\n"},
+		{"literals", `print [1.0, 2d, "s", nil, {"k": true}];`, "print [1.0, 2d, \"s\", nil, {\"k\": true}];\n"},
+		{"unary", "print -(-1); print - -1; print ~ /a/;", "print -(-1);\nprint - -1;\nprint ~ /a/;\n"},
+	}
+
+	for _, tc := range cases {
+		formatted, err := Format(tc.source)
+		is.NoErr(err)
+		is.Equal(formatted, tc.expected) // tc.name
+	}
+
+	_, err := Format("print ;")
+	is.True(err != nil)
+}
+
+func TestFormatIdempotent(t *testing.T) {
+	is := is.New(t)
+	sources := []string{
+		`import "a\x00.lox"; import "b\n.lox" as b; print b;`,
+		"var s = \"\\t\"; // tab\nprint s;",
+		"if (a) { print 1; } // after\nelse { print 2; }\nwhile (x) { x--; } // loop",
+		"var f = fun() { return 1; }; // f\nclass A { // A\n  m() {} // m\n}",
+		"export var a = 1; // a\nexport fun g() {\n  // body\n}\n// end",
+	}
+
+	for _, source := range sources {
+		once, err := Format(source)
+		is.NoErr(err)
+		twice, err := Format(once)
+		is.NoErr(err)
+		is.Equal(twice, once) // formatting again changes nothing
+	}
+}
@@ -0,0 +1,160 @@
+package lox
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// Seeds each fuzz test with the snapshot test sources and the examples.
+// Inputs the fuzzer found are kept in testdata/fuzz.
+func addFuzzSeeds(f *testing.F) {
+	for _, tc := range lexCases {
+		f.Add(tc.source)
+	}
+	for _, tc := range parseCases {
+		f.Add(tc.source)
+	}
+
+	examples, err := filepath.Glob("../examples/*.lox")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range examples {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(data))
+	}
+}
+
+// Reports whether text is only whitespace and line comments
+func isTrivia(text string) bool {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case ' ', '\t', '\r', '\n':
+		case '/':
+			if i+1 == len(text) || text[i+1] != '/' {
+				return false
+			}
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Works out the position of an offset by counting from the start
+func positionOf(source string, offset int) Position {
+	pos := Position{Line: 1, Column: 1, Offset: offset}
+	for _, r := range source[:offset] {
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	return pos
+}
+
+func FuzzScanTokens(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		scanner := NewScanner(source)
+		scanner.KeepTrivia = true
+
+		// The tokens and their trivia make up the source, and each one
+		// is at its offset
+		var text strings.Builder
+		add := func(piece string, offset int) {
+			if offset != text.Len() || !strings.HasPrefix(source[offset:], piece) {
+				t.Fatalf("%q isn't at offset %d of %q", piece, offset, source)
+			}
+			text.WriteString(piece)
+		}
+		for {
+			tok, err := scanner.Next()
+			if err != nil {
+				return
+			}
+
+			for _, trivia := range tok.LeadingTrivia {
+				add(trivia.Text, trivia.Start.Offset)
+			}
+			add(tok.Lexeme, tok.Start.Offset)
+			for _, trivia := range tok.TrailingTrivia {
+				add(trivia.Text, trivia.Start.Offset)
+			}
+
+			if start := positionOf(source, tok.Start.Offset); tok.Start != start {
+				t.Fatalf("%v starts at %v, not %v", tok, start, tok.Start)
+			}
+			if end := positionOf(source, tok.End.Offset); tok.End != end {
+				t.Fatalf("%v ends at %v, not %v", tok, end, tok.End)
+			}
+			for _, trivia := range append(tok.LeadingTrivia, tok.TrailingTrivia...) {
+				if !isTrivia(trivia.Text) || trivia.Start != positionOf(source, trivia.Start.Offset) {
+					t.Fatalf("bad trivia %+v in %q", trivia, source)
+				}
+			}
+			if tok.Type == EOF {
+				break
+			}
+		}
+		if text.String() != source {
+			t.Fatalf("tokens make up %q, not %q", text.String(), source)
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		if _, err := compile(source); err != nil {
+			return
+		}
+
+		// Formatting parses its own output the same way
+		formatted, err := Format(source)
+		if err != nil {
+			t.Fatalf("formatting %q: %v", source, err)
+		}
+		again, err := Format(formatted)
+		if err != nil {
+			t.Fatalf("parsing formatted %q: %v", formatted, err)
+		}
+		if again != formatted {
+			t.Fatalf("formatting %q again gave\n%s\ninstead of\n%s", source, again, formatted)
+		}
+	})
+}
+
+func FuzzInterpret(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		// Scripts get nothing from the host, and limits so they finish
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		rs := NewRuntimeState(WithCapabilities())
+		rs.OutWriter = io.Discard
+		rs.ErrWriter = io.Discard
+		rs.InReader = strings.NewReader("")
+		rs.ModuleFS = fstest.MapFS{}
+		rs.Clock = NewVirtualClock(time.Unix(0, 0))
+		rs.Context = ctx
+		rs.Limits = Limits{MaxSteps: 100_000, MaxCallDepth: 200, MaxAlloc: 1 << 20}
+
+		rs.Run(source)
+	})
+}
@@ -0,0 +1,213 @@
+package lox
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// Returned by yield when a suspended generator is closed, so its body
+// unwinds without running any further
+var errGeneratorClosed = errors.New("generator closed")
+
+// A step of a generator's body, handed from its goroutine to whoever
+// resumed it
+type coroutineEvent struct {
+	value Value
+	// The body finished, and value is what it returned
+	done bool
+	err  error
+}
+
+// What a suspended body is resumed with. A non-nil err makes the yield
+// fail, which is how an async function sees a rejected promise.
+type coroutineResume struct {
+	value Value
+	err   error
+}
+
+// coroutine runs a generator's body on its own goroutine. Control is
+// handed back and forth over unbuffered channels, so only one side runs
+// at a time and the body can use the runtime state without locking.
+type coroutine struct {
+	resume chan coroutineResume
+	events chan coroutineEvent
+	// Set for the body of an async function, which suspends at await
+	// instead of yield
+	async bool
+	// Closed to make a suspended body unwind
+	closed chan struct{}
+	// Closed once the goroutine has exited
+	exited chan struct{}
+}
+
+// Called from the body's goroutine. Hands value to the caller and waits
+// to be resumed with the value yield evaluates to.
+func (co *coroutine) yield(value Value) (Value, error) {
+	select {
+	case co.events <- coroutineEvent{value: value}:
+	case <-co.closed:
+		return nil, errGeneratorClosed
+	}
+
+	select {
+	case sent := <-co.resume:
+		return sent.value, sent.err
+	case <-co.closed:
+		return nil, errGeneratorClosed
+	}
+}
+
+// LoxGenerator is returned by calling a generator function. Each next()
+// runs the body up to its next yield.
+type LoxGenerator struct {
+	Name string
+	// Starts the body's goroutine on the first resume
+	start   func() *coroutine
+	co      *coroutine
+	running bool
+	done    bool
+}
+
+func newLoxGenerator(rs *RuntimeState, f LoxFunction) *LoxGenerator {
+	return newCoroutineFunction(rs, f, false)
+}
+
+// Prepares f's body to run as a coroutine, either a generator or the
+// body of an async function
+func newCoroutineFunction(rs *RuntimeState, f LoxFunction, async bool) *LoxGenerator {
+	// The body runs on its own copy of the runtime state, in the scope
+	// the arguments were bound in
+	gs := *rs
+	// The body can be resumed from anywhere, so its frame isn't kept
+	// under the caller's in profiles
+	if gs.frame != nil {
+		gs.frame = &profileFrame{function: gs.frame.function, line: gs.frame.line}
+	}
+	name := f.Name
+	if name == "" {
+		name = "anonymous"
+	}
+
+	g := &LoxGenerator{Name: name}
+	g.start = func() *coroutine {
+		co := &coroutine{
+			resume: make(chan coroutineResume),
+			events: make(chan coroutineEvent),
+			async:  async,
+			closed: make(chan struct{}),
+			exited: make(chan struct{}),
+		}
+		gs.coroutine = co
+
+		go func() {
+			defer close(co.exited)
+			// Wait for the first resume, whose value is discarded
+			select {
+			case <-co.resume:
+			case <-co.closed:
+				return
+			}
+
+			value, err := f.run(&gs)
+			if errors.Is(err, errGeneratorClosed) {
+				return
+			}
+			select {
+			case co.events <- coroutineEvent{value: value, done: true, err: err}:
+			case <-co.closed:
+			}
+		}()
+		return co
+	}
+
+	// Generators that are dropped while suspended would otherwise leave
+	// their goroutine blocked forever
+	runtime.SetFinalizer(g, func(g *LoxGenerator) {
+		if g.co != nil && !g.done {
+			close(g.co.closed)
+		}
+	})
+	return g
+}
+
+func (g *LoxGenerator) String() string {
+	return fmt.Sprintf("<generator %s>", g.Name)
+}
+
+// Runs the body until it yields or finishes, passing sent in as the
+// value of the yield it's suspended at. Returns false once the body
+// has finished, along with its return value.
+func (g *LoxGenerator) Resume(sent Value) (Value, bool, error) {
+	return g.resume(coroutineResume{value: sent})
+}
+
+func (g *LoxGenerator) resume(sent coroutineResume) (Value, bool, error) {
+	if g.done {
+		return Null(nil), false, nil
+	}
+	if g.running {
+		return nil, false, RuntimeError{message: fmt.Sprintf("Generator %s is already running", g.Name)}
+	}
+	if g.co == nil {
+		g.co = g.start()
+	}
+
+	g.running = true
+	g.co.resume <- sent
+	event := <-g.co.events
+	g.running = false
+
+	if event.done {
+		g.done = true
+		if event.err != nil {
+			return nil, false, event.err
+		}
+		return event.value, false, nil
+	}
+	return event.value, true, nil
+}
+
+// Close stops a suspended generator, ending its goroutine. Closing a
+// generator that has finished does nothing.
+func (g *LoxGenerator) Close() error {
+	if g.done {
+		return nil
+	}
+	if g.running {
+		return RuntimeError{message: fmt.Sprintf("Generator %s is already running", g.Name)}
+	}
+	g.done = true
+	if g.co != nil {
+		close(g.co.closed)
+		<-g.co.exited
+	}
+	return nil
+}
+
+func (g *LoxGenerator) get(name string) (Value, error) {
+	switch name {
+	case "done":
+		return g.done, nil
+	case "next":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			value, _, err := g.Resume(Null(nil))
+			return value, err
+		}}, nil
+	case "send":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			// There's no yield waiting for a value until the body starts
+			if _, isNil := args[0].(Null); g.co == nil && !g.done && !isNil {
+				return nil, RuntimeError{message: fmt.Sprintf("Can't send a value to generator %s before it has started", g.Name)}
+			}
+			value, _, err := g.Resume(args[0])
+			return value, err
+		}}, nil
+	case "close":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return Null(nil), g.Close()
+		}}, nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined generator property '%s'", name)}
+}
@@ -0,0 +1,148 @@
+package lox
+
+import "fmt"
+
+// LoxIterator lazily produces a sequence of values. Scripts drive it
+// with hasNext() and next(), and can close() it early to release
+// whatever it's reading from.
+type LoxIterator struct {
+	Name string
+	// Returns the next value, or false once the sequence is exhausted
+	produce func() (Value, bool, error)
+	// Optional, called once when the iterator is exhausted or closed
+	release func() error
+
+	peeked  Value
+	hasPeek bool
+	done    bool
+}
+
+func NewLoxIterator(name string, produce func() (Value, bool, error), release func() error) *LoxIterator {
+	return &LoxIterator{Name: name, produce: produce, release: release}
+}
+
+func (it *LoxIterator) String() string {
+	return fmt.Sprintf("<iterator %s>", it.Name)
+}
+
+// Reads ahead one value so hasNext() can answer without losing it
+func (it *LoxIterator) fill() error {
+	if it.hasPeek || it.done {
+		return nil
+	}
+
+	value, ok, err := it.produce()
+	if err != nil {
+		it.Close()
+		return err
+	}
+	if !ok {
+		return it.Close()
+	}
+	it.peeked, it.hasPeek = value, true
+	return nil
+}
+
+func (it *LoxIterator) HasNext() (bool, error) {
+	err := it.fill()
+	return it.hasPeek, err
+}
+
+func (it *LoxIterator) Next() (Value, error) {
+	err := it.fill()
+	if err != nil {
+		return nil, err
+	}
+	if !it.hasPeek {
+		return nil, RuntimeError{message: fmt.Sprintf("Iterator %s is exhausted", it.Name)}
+	}
+
+	value := it.peeked
+	it.peeked, it.hasPeek = nil, false
+	return value, nil
+}
+
+func (it *LoxIterator) Close() error {
+	if it.done {
+		return nil
+	}
+	it.done = true
+	it.peeked, it.hasPeek = nil, false
+	if it.release != nil {
+		return it.release()
+	}
+	return nil
+}
+
+func (it *LoxIterator) get(name string) (Value, error) {
+	switch name {
+	case "hasNext":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return it.HasNext()
+		}}, nil
+	case "next":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return it.Next()
+		}}, nil
+	case "close":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return Null(nil), it.Close()
+		}}, nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined iterator property '%s'", name)}
+}
+
+// Produces the values a for-in loop visits: list elements, map keys,
+// the characters of a string, whatever an iterator or generator yields,
+// or what's received from a channel until it's closed
+func (rs *RuntimeState) iterate(value Value) (*LoxIterator, error) {
+	switch v := value.(type) {
+	case *LoxChannel:
+		return NewLoxIterator("channel", func() (Value, bool, error) {
+			return v.recv(rs)
+		}, nil), nil
+	case *LoxIterator:
+		return v, nil
+	case *LoxGenerator:
+		return NewLoxIterator(v.Name, func() (Value, bool, error) {
+			// The generator's return value isn't one of its values
+			value, yielded, err := v.Resume(Null(nil))
+			return value, yielded, err
+		}, v.Close), nil
+	case *LoxList:
+		// Indexing each time means elements appended by the loop are
+		// visited too
+		i := 0
+		return NewLoxIterator("list", func() (Value, bool, error) {
+			if i >= len(v.Elements) {
+				return nil, false, nil
+			}
+			i++
+			return v.Elements[i-1], true, nil
+		}, nil), nil
+	case *LoxMap:
+		keys := append([]Value(nil), v.Keys()...)
+		return sliceIterator("map", keys), nil
+	case string:
+		runes := []rune(v)
+		chars := make([]Value, len(runes))
+		for i, r := range runes {
+			chars[i] = string(r)
+		}
+		return sliceIterator("string", chars), nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Can't iterate over %s", reprValue(value))}
+}
+
+func sliceIterator(name string, values []Value) *LoxIterator {
+	i := 0
+	return NewLoxIterator(name, func() (Value, bool, error) {
+		if i >= len(values) {
+			return nil, false, nil
+		}
+		i++
+		return values[i-1], true, nil
+	}, nil)
+}
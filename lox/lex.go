@@ -3,40 +3,66 @@ package lox
 import (
 	"errors"
 	"fmt"
-	"os"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type TokenType string
 
 const (
 	// Single char tokens
-	LEFT_PAREN  = "LEFT_PAREN"
-	RIGHT_PAREN = "RIGHT_PAREN"
-	LEFT_BRACE  = "LEFT_BRACE"
-	RIGHT_BRACE = "RIGHT_BRACE"
-	COMMA       = "COMMA"
-	DOT         = "DOT"
-	MINUS       = "MINUS"
-	PLUS        = "PLUS"
-	SEMICOLON   = "SEMICOLON"
-	SLASH       = "SLASH"
-	STAR        = "STAR"
+	LEFT_PAREN    = "LEFT_PAREN"
+	RIGHT_PAREN   = "RIGHT_PAREN"
+	LEFT_BRACE    = "LEFT_BRACE"
+	RIGHT_BRACE   = "RIGHT_BRACE"
+	LEFT_BRACKET  = "LEFT_BRACKET"
+	RIGHT_BRACKET = "RIGHT_BRACKET"
+	COMMA         = "COMMA"
+	DOT           = "DOT"
+	MINUS         = "MINUS"
+	PLUS          = "PLUS"
+	SEMICOLON     = "SEMICOLON"
+	COLON         = "COLON"
+	QUESTION      = "QUESTION"
+	SLASH         = "SLASH"
+	STAR          = "STAR"
+	PERCENT       = "PERCENT"
+	AMPERSAND     = "AMPERSAND"
+	PIPE          = "PIPE"
+	CARET         = "CARET"
+	TILDE         = "TILDE"
 
 	// One or two char tokens
-	BANG          = "BANG"
-	BANG_EQUAL    = "BANG_EQUAL"
-	EQUAL         = "EQUAL"
-	EQUAL_EQUAL   = "EQUAL_EQUAL"
-	GREATER       = "GREATER"
-	GREATER_EQUAL = "GREATER_EQUAL"
-	LESS          = "LESS"
-	LESS_EQUAL    = "LESS_EQUAL"
+	BANG              = "BANG"
+	BANG_EQUAL        = "BANG_EQUAL"
+	EQUAL             = "EQUAL"
+	EQUAL_EQUAL       = "EQUAL_EQUAL"
+	GREATER           = "GREATER"
+	GREATER_EQUAL     = "GREATER_EQUAL"
+	LESS              = "LESS"
+	LESS_EQUAL        = "LESS_EQUAL"
+	ARROW             = "ARROW"
+	ELLIPSIS          = "ELLIPSIS"
+	TILDE_SLASH       = "TILDE_SLASH"
+	LESS_LESS         = "LESS_LESS"
+	GREATER_GREATER   = "GREATER_GREATER"
+	STAR_STAR         = "STAR_STAR"
+	PLUS_PLUS         = "PLUS_PLUS"
+	MINUS_MINUS       = "MINUS_MINUS"
+	PLUS_EQUAL        = "PLUS_EQUAL"
+	MINUS_EQUAL       = "MINUS_EQUAL"
+	STAR_EQUAL        = "STAR_EQUAL"
+	SLASH_EQUAL       = "SLASH_EQUAL"
+	PERCENT_EQUAL     = "PERCENT_EQUAL"
+	QUESTION_QUESTION = "QUESTION_QUESTION"
+	QUESTION_DOT      = "QUESTION_DOT"
 
 	// Literals
 	IDENTIFIER = "IDENTIFIER"
 	STRING     = "STRING"
 	NUMBER     = "NUMBER"
+	REGEX      = "REGEX"
 
 	// Keywords
 	AND    = "AND"
@@ -55,27 +81,121 @@ const (
 	TRUE   = "TRUE"
 	VAR    = "VAR"
 	WHILE  = "WHILE"
+	MATCH  = "MATCH"
+	CASE   = "CASE"
+	IMPORT = "IMPORT"
+	EXPORT = "EXPORT"
+	AS     = "AS"
+	YIELD  = "YIELD"
+	IN     = "IN"
+	SPAWN  = "SPAWN"
+	AWAIT  = "AWAIT"
+	ASYNC  = "ASYNC"
 
 	EOF = "EOF"
 )
 
+// Position is a place in the source. Lines and columns count from 1,
+// with columns counted in runes, and Offset counts bytes from 0.
+type Position struct {
+	Line   int
+	Column int
+	Offset int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Trivia is a run of whitespace or a comment between tokens
+type Trivia struct {
+	Text       string
+	Start, End Position
+}
+
+func (t Trivia) IsComment() bool {
+	return strings.HasPrefix(t.Text, "//")
+}
+
 type Token struct {
-	type_   TokenType
-	lexeme  string
-	literal string
-	line    int
+	Type TokenType
+	// The token's source text. Strings keep their quotes.
+	Lexeme string
+	// The value of a STRING or NUMBER token: a string, or an int64,
+	// *big.Int, float64 or *big.Rat. Other tokens don't have one.
+	Literal Value
+	// Where the token starts, and where the source after it starts
+	Start, End Position
+	// Whitespace and comments around the token, if the scanner keeps
+	// them. Trailing trivia stops at the end of the token's line and
+	// the newline starts the next token's leading trivia.
+	LeadingTrivia  []Trivia
+	TrailingTrivia []Trivia
 }
 
 func (t Token) String() string {
-	return fmt.Sprintf("Token{%v '%s' %s}", t.type_, t.lexeme, t.literal)
+	if t.Literal != nil {
+		return fmt.Sprintf("Token{%v '%s' %v}", t.Type, t.Lexeme, t.Literal)
+	}
+	return fmt.Sprintf("Token{%v '%s'}", t.Type, t.Lexeme)
+}
+
+// ScanError is a mistake in the source that the scanner skipped over
+type ScanError struct {
+	Message    string
+	Start, End Position
+}
+
+func (e ScanError) Error() string {
+	return fmt.Sprintf("Scan Error: %s at %s", e.Message, e.Start)
+}
+
+// Reports whether a token can end an expression. A '/' after one of
+// these is division, anywhere else it starts a regex literal.
+func endsExpression(t TokenType) bool {
+	switch t {
+	case IDENTIFIER, STRING, NUMBER, REGEX, TRUE, FALSE, NIL, THIS, SUPER,
+		RIGHT_PAREN, RIGHT_BRACKET, PLUS_PLUS, MINUS_MINUS:
+		return true
+	}
+	return false
+}
+
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
 }
 
-func report(line int, where string, msg string) {
-	fmt.Fprintf(os.Stderr, "[line %d] Error %s: %s\n", line, where, msg)
+func isWhitespace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\r' || r == '\n'
 }
 
-func reportError(line int, msg string) {
-	report(line, "", msg)
+var keywords = map[string]TokenType{
+	"and":    AND,
+	"class":  CLASS,
+	"else":   ELSE,
+	"false":  FALSE,
+	"fun":    FUN,
+	"for":    FOR,
+	"if":     IF,
+	"nil":    NIL,
+	"or":     OR,
+	"print":  PRINT,
+	"return": RETURN,
+	"super":  SUPER,
+	"this":   THIS,
+	"true":   TRUE,
+	"var":    VAR,
+	"while":  WHILE,
+	"match":  MATCH,
+	"case":   CASE,
+	"import": IMPORT,
+	"export": EXPORT,
+	"as":     AS,
+	"yield":  YIELD,
+	"in":     IN,
+	"spawn":  SPAWN,
+	"await":  AWAIT,
+	"async":  ASYNC,
 }
 
 // I want to index the source by logical character like any sane person
@@ -88,206 +208,392 @@ func stringToRunes(source string) []rune {
 	return sourceRunes
 }
 
-func ScanTokens(source string) ([]Token, error) {
-	tokens := []Token{}
+// Scanner reads tokens from source one at a time, so an editor can
+// stop once it has the ones it needs
+type Scanner struct {
+	// Whether to fill in each token's LeadingTrivia and TrailingTrivia
+	KeepTrivia bool
+
+	text   string
+	source []rune
+	// The token being scanned is source[start:current]
+	start   int
+	current int
+	// The position of source[at]. Positions are only asked for in
+	// order, so it moves forward as they are.
+	at  int
+	pos Position
+	// The last token's type, which decides whether a '/' is division
+	last TokenType
+}
 
-	sourceRunes := stringToRunes(source)
+func NewScanner(source string) *Scanner {
+	return &Scanner{
+		text:   source,
+		source: stringToRunes(source),
+		pos:    Position{Line: 1, Column: 1},
+	}
+}
 
-	hasError := false
-	start := 0
-	current := 0
-	line := 1
+// Next scans the next token. At the end of the source it returns an
+// EOF token every time it's called. Errors are ScanErrors, and the
+// scanner carries on after the bad text on the next call.
+func (s *Scanner) Next() (Token, error) {
+	leading := s.trivia(true)
+	s.start = s.current
+	if s.current == len(s.source) {
+		return s.token(EOF, nil, leading), nil
+	}
 
-	addToken := func(t TokenType) {
-		tokens = append(tokens, Token{
-			type_:  t,
-			lexeme: string(sourceRunes[start : current+1]),
-			line:   line,
-		})
+	t, literal, err := s.scanToken()
+	if err != nil {
+		return Token{}, err
 	}
+	tok := s.token(t, literal, leading)
+	tok.TrailingTrivia = s.trivia(false)
+	s.last = t
+	return tok, nil
+}
 
-	// Conditionally step forward if the next char matches
-	match := func(c rune) bool {
-		if current+1 < len(sourceRunes) && sourceRunes[current+1] == c {
-			current += 1
-			return true
+func (s *Scanner) positionAt(i int) Position {
+	for ; s.at < i; s.at++ {
+		// Decoding the text rather than using the rune's length keeps
+		// invalid UTF-8 bytes one byte long
+		_, size := utf8.DecodeRuneInString(s.text[s.pos.Offset:])
+		s.pos.Offset += size
+		if s.source[s.at] == '\n' {
+			s.pos.Line++
+			s.pos.Column = 1
+		} else {
+			s.pos.Column++
 		}
-		return false
 	}
-	// Consume a string
-	stringLiteral := func() {
-		for current+1 < len(sourceRunes) && sourceRunes[current+1] != '"' {
-			if sourceRunes[current+1] == '\n' {
-				line++
+	return s.pos
+}
+
+func (s *Scanner) token(t TokenType, literal Value, leading []Trivia) Token {
+	start, end := s.positionAt(s.start), s.positionAt(s.current)
+	return Token{
+		Type:          t,
+		Lexeme:        s.text[start.Offset:end.Offset],
+		Literal:       literal,
+		Start:         start,
+		End:           end,
+		LeadingTrivia: leading,
+	}
+}
+
+func (s *Scanner) errorf(format string, args ...any) error {
+	return ScanError{
+		Message: fmt.Sprintf(format, args...),
+		Start:   s.positionAt(s.start),
+		End:     s.positionAt(s.current),
+	}
+}
+
+// Returns the rune n after the next one, or 0 past the end
+func (s *Scanner) peek(n int) rune {
+	if s.current+n >= len(s.source) {
+		return 0
+	}
+	return s.source[s.current+n]
+}
+
+// Conditionally step forward if the next char matches
+func (s *Scanner) match(c rune) bool {
+	if s.current < len(s.source) && s.source[s.current] == c {
+		s.current++
+		return true
+	}
+	return false
+}
+
+// Skips whitespace and comments, returning them if the scanner keeps
+// trivia. Trailing trivia stops before a newline.
+func (s *Scanner) trivia(leading bool) []Trivia {
+	var trivia []Trivia
+	for s.current < len(s.source) {
+		start := s.current
+		switch c := s.source[s.current]; {
+		case c == '\n' && !leading:
+			return trivia
+		case isWhitespace(c):
+			for s.current < len(s.source) && isWhitespace(s.source[s.current]) && (leading || s.source[s.current] != '\n') {
+				s.current++
 			}
-			current++
-		}
-		if current+1 == len(sourceRunes) {
-			hasError = true
-			reportError(line, "Unterminated String")
-			return
+		case c == '/' && s.peek(1) == '/':
+			// Go until ya can't go no more
+			for s.current < len(s.source) && s.source[s.current] != '\n' {
+				s.current++
+			}
+		default:
+			return trivia
 		}
 
-		// sort of a hack to manipulate the start/current around the
-		// addToken to get the right lexeme (without "")
-		start++
-		addToken(STRING)
-		current++
+		if s.KeepTrivia {
+			startPos, endPos := s.positionAt(start), s.positionAt(s.current)
+			trivia = append(trivia, Trivia{Text: s.text[startPos.Offset:endPos.Offset], Start: startPos, End: endPos})
+		}
 	}
-	// Consume a number literal
-	numberLiteral := func() {
-		for current+1 < len(sourceRunes) && unicode.IsDigit(rune(sourceRunes[current+1])) {
-			current++
+	return trivia
+}
+
+func (s *Scanner) scanToken() (TokenType, Value, error) {
+	c := s.source[s.current]
+	s.current++
+
+	switch c {
+	case '(':
+		return LEFT_PAREN, nil, nil
+	case ')':
+		return RIGHT_PAREN, nil, nil
+	case '{':
+		return LEFT_BRACE, nil, nil
+	case '}':
+		return RIGHT_BRACE, nil, nil
+	case '[':
+		return LEFT_BRACKET, nil, nil
+	case ']':
+		return RIGHT_BRACKET, nil, nil
+	case ',':
+		return COMMA, nil, nil
+	case '.':
+		if s.peek(0) == '.' && s.peek(1) == '.' {
+			s.current += 2
+			return ELLIPSIS, nil, nil
+		}
+		return DOT, nil, nil
+	case '-':
+		if s.match('-') {
+			return MINUS_MINUS, nil, nil
+		} else if s.match('=') {
+			return MINUS_EQUAL, nil, nil
+		}
+		return MINUS, nil, nil
+	case '+':
+		if s.match('+') {
+			return PLUS_PLUS, nil, nil
+		} else if s.match('=') {
+			return PLUS_EQUAL, nil, nil
 		}
+		return PLUS, nil, nil
+	case ';':
+		return SEMICOLON, nil, nil
+	case ':':
+		return COLON, nil, nil
+	case '?':
+		if s.match('?') {
+			return QUESTION_QUESTION, nil, nil
+		} else if s.current+1 < len(s.source) && s.peek(0) == '.' && !unicode.IsDigit(s.peek(1)) {
+			// `a ?.5 : 1` is a conditional, not optional chaining
+			s.current++
+			return QUESTION_DOT, nil, nil
+		}
+		return QUESTION, nil, nil
+	case '*':
+		if s.match('*') {
+			return STAR_STAR, nil, nil
+		} else if s.match('=') {
+			return STAR_EQUAL, nil, nil
+		}
+		return STAR, nil, nil
+	case '%':
+		if s.match('=') {
+			return PERCENT_EQUAL, nil, nil
+		}
+		return PERCENT, nil, nil
+	case '&':
+		return AMPERSAND, nil, nil
+	case '|':
+		return PIPE, nil, nil
+	case '^':
+		return CARET, nil, nil
+	case '~':
+		if s.match('/') {
+			return TILDE_SLASH, nil, nil
+		}
+		return TILDE, nil, nil
+	case '!':
+		if s.match('=') {
+			return BANG_EQUAL, nil, nil
+		}
+		return BANG, nil, nil
+	case '=':
+		if s.match('=') {
+			return EQUAL_EQUAL, nil, nil
+		} else if s.match('>') {
+			return ARROW, nil, nil
+		}
+		return EQUAL, nil, nil
+	case '>':
+		if s.match('=') {
+			return GREATER_EQUAL, nil, nil
+		} else if s.match('>') {
+			return GREATER_GREATER, nil, nil
+		}
+		return GREATER, nil, nil
+	case '<':
+		if s.match('=') {
+			return LESS_EQUAL, nil, nil
+		} else if s.match('<') {
+			return LESS_LESS, nil, nil
+		}
+		return LESS, nil, nil
+	case '/':
+		// Comments were skipped as trivia
+		if !endsExpression(s.last) && s.regexLiteral() {
+			return REGEX, nil, nil
+		} else if s.match('=') {
+			return SLASH_EQUAL, nil, nil
+		}
+		return SLASH, nil, nil
+	case '"':
+		return s.stringLiteral()
+	}
+
+	if unicode.IsDigit(c) {
+		return s.numberLiteral()
+	} else if unicode.IsLetter(c) || c == '_' {
+		return s.word(), nil, nil
+	}
+	return "", nil, s.errorf("Unexpected character: %c", c)
+}
+
+// Consume a string
+func (s *Scanner) stringLiteral() (TokenType, Value, error) {
+	for s.current < len(s.source) && s.source[s.current] != '"' {
+		s.current++
+	}
+	if s.current == len(s.source) {
+		return "", nil, s.errorf("Unterminated String")
+	}
+	s.current++
+
+	return STRING, string(s.source[s.start+1 : s.current-1]), nil
+}
 
-		if !match('.') {
-			addToken(NUMBER)
-			return
+// Consume digits in the given base, allowing single underscores
+// between them as separators
+func (s *Scanner) digits(isDigit func(rune) bool) {
+	for s.current < len(s.source) {
+		if isDigit(s.source[s.current]) {
+			s.current++
+		} else if s.source[s.current] == '_' && s.current+1 < len(s.source) && isDigit(s.source[s.current+1]) {
+			s.current += 2
+		} else {
+			break
 		}
+	}
+}
 
-		// Consume all digits after the dot
-		for current+1 < len(sourceRunes) && unicode.IsDigit(rune(sourceRunes[current+1])) {
-			current++
+// Consume a number literal
+func (s *Scanner) numberLiteral() (TokenType, Value, error) {
+	// Hex, binary and octal literals
+	if s.source[s.start] == '0' && s.current+1 < len(s.source) {
+		var isDigit func(rune) bool
+		switch s.peek(0) {
+		case 'x', 'X':
+			isDigit = func(r rune) bool { return unicode.Is(unicode.ASCII_Hex_Digit, r) }
+		case 'b', 'B':
+			isDigit = func(r rune) bool { return r == '0' || r == '1' }
+		case 'o', 'O':
+			isDigit = func(r rune) bool { return r >= '0' && r <= '7' }
 		}
 
-		// Backtrack if no numbers were after the decimal
-		if sourceRunes[current] == '.' {
-			current--
+		if isDigit != nil && isDigit(s.peek(1)) {
+			s.current += 2
+			s.digits(isDigit)
+			return s.number()
 		}
+	}
+
+	s.digits(unicode.IsDigit)
+
+	// Consume all digits after the dot, backtracking if there
+	// aren't any
+	if s.current+1 < len(s.source) && s.peek(0) == '.' && unicode.IsDigit(s.peek(1)) {
+		s.current++
+		s.digits(unicode.IsDigit)
+	}
 
-		addToken(NUMBER)
+	// Decimal suffix
+	if s.peek(0) == 'd' && (s.current+1 == len(s.source) || !unicode.IsLetter(s.peek(1))) {
+		s.current++
 	}
 
-	// Consume reserved words and identifiers
-	consumeWord := func() {
-		// Assume we are starting at a letter rune
-		for current+1 < len(sourceRunes) && (unicode.IsLetter(sourceRunes[current+1]) || sourceRunes[current+1] == '_') {
-			current++
+	return s.number()
+}
+
+func (s *Scanner) number() (TokenType, Value, error) {
+	value, err := parseNumberLiteral(string(s.source[s.start:s.current]))
+	if err != nil {
+		return "", nil, s.errorf("Invalid number literal: %v", err)
+	}
+	return NUMBER, value, nil
+}
+
+// Consume a regex literal and its flags. The closing '/' may be
+// escaped or appear unescaped inside a character class. Returns
+// false without consuming anything if the line has no closing '/'.
+func (s *Scanner) regexLiteral() bool {
+	inClass := false
+	for {
+		if s.current == len(s.source) || s.source[s.current] == '\n' {
+			s.current = s.start + 1
+			return false
 		}
 
-		switch word := string(sourceRunes[start : current+1]); word {
-		case "and":
-			addToken(AND)
-		case "class":
-			addToken(CLASS)
-		case "else":
-			addToken(ELSE)
-		case "false":
-			addToken(FALSE)
-		case "fun":
-			addToken(FUN)
-		case "for":
-			addToken(FOR)
-		case "if":
-			addToken(IF)
-		case "nil":
-			addToken(NIL)
-		case "or":
-			addToken(OR)
-		case "print":
-			addToken(PRINT)
-		case "return":
-			addToken(RETURN)
-		case "super":
-			addToken(SUPER)
-		case "this":
-			addToken(THIS)
-		case "true":
-			addToken(TRUE)
-		case "var":
-			addToken(VAR)
-		case "while":
-			addToken(WHILE)
-		default:
-			addToken(IDENTIFIER)
+		c := s.source[s.current]
+		s.current++
+		if c == '\\' && s.current < len(s.source) && s.source[s.current] != '\n' {
+			s.current++
+		} else if c == '[' {
+			inClass = true
+		} else if c == ']' {
+			inClass = false
+		} else if c == '/' && !inClass {
+			break
 		}
 	}
 
-	for ; current < len(sourceRunes); current++ {
-		start = current
-
-		switch c := (sourceRunes[current]); c {
-		case '(':
-			addToken(LEFT_PAREN)
-		case ')':
-			addToken(RIGHT_PAREN)
-		case '{':
-			addToken(LEFT_BRACE)
-		case '}':
-			addToken(RIGHT_BRACE)
-		case ',':
-			addToken(COMMA)
-		case '.':
-			addToken(DOT)
-		case '-':
-			addToken(MINUS)
-		case '+':
-			addToken(PLUS)
-		case ';':
-			addToken(SEMICOLON)
-		case '*':
-			addToken(STAR)
-		case '!':
-			if match('=') {
-				addToken(BANG_EQUAL)
-			} else {
-				addToken(BANG)
-			}
-		case '=':
-			if match('=') {
-				addToken(EQUAL_EQUAL)
-			} else {
-				addToken(EQUAL)
-			}
-		case '>':
-			if match('=') {
-				addToken(GREATER_EQUAL)
-			} else {
-				addToken(GREATER)
-			}
-		case '<':
-			if match('=') {
-				addToken(LESS_EQUAL)
-			} else {
-				addToken(LESS)
-			}
-		case '/':
-			if match('/') {
-				// Go until ya can't go no more
-				for current+1 < len(sourceRunes) && sourceRunes[current+1] != '\n' {
-					current++
-				}
-			} else {
-				addToken(SLASH)
-			}
-		// Ignore whitespace
-		case ' ':
-		case '\t':
-		case '\r':
+	for s.current < len(s.source) && unicode.IsLetter(s.source[s.current]) {
+		s.current++
+	}
+	return true
+}
 
-		case '\n':
-			line++
+// Consume reserved words and identifiers
+func (s *Scanner) word() TokenType {
+	// Assume we are starting at a letter or underscore
+	for s.current < len(s.source) && isIdentifierRune(s.source[s.current]) {
+		s.current++
+	}
 
-		case '"':
-			stringLiteral()
-		default:
-			if unicode.IsDigit(c) {
-				numberLiteral()
-			} else if unicode.IsLetter(c) {
-				// Handle identifiers and reserved words
-				consumeWord()
-			} else {
-				hasError = true
-				reportError(line, fmt.Sprintf("Unexpected character: %c", c))
-			}
+	if t, ok := keywords[string(s.source[s.start:s.current])]; ok {
+		return t
+	}
+	return IDENTIFIER
+}
 
+// ScanTokens scans the whole source, ending with an EOF token. Every
+// ScanError is returned, joined with errors.Join, along with the tokens
+// around them.
+func ScanTokens(source string) ([]Token, error) {
+	scanner := NewScanner(source)
+	tokens := []Token{}
+	var errs []error
+	for {
+		tok, err := scanner.Next()
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
 
+		tokens = append(tokens, tok)
+		if tok.Type == EOF {
+			break
+		}
 	}
 
-	if hasError {
-		return tokens, errors.New("Unexpected characters in source")
-	}
-
-	return tokens, nil
+	return tokens, errors.Join(errs...)
 }
@@ -3,59 +3,76 @@ package lox
 import (
 	"fmt"
 	"github.com/gkampitakis/go-snaps/snaps"
+	"github.com/matryer/is"
 	"testing"
 )
 
-func TestLexSnapshot(t *testing.T) {
-	testCases := []struct {
-		source string
-	}{
-		{"()"},
-		{"{}"},
-		{"/"},
-		{"."},
-		{","},
-		{"-"},
-		{"+"},
-		{";"},
-		{"/"},
-		{"*"},
-		{"!"},
-		{"!="},
-		{"="},
-		{"=="},
-		{">="},
-		{">"},
-		{"<"},
-		{"<="},
-		{"\"testing\""},
-		{"123"},
-		{"123."},
-		{"123.09"},
-		{"testing"},
-		{"for"},
-		{"and"},
-		{"class"},
-		{"else"},
-		{"false"},
-		{"fun"},
-		{"for"},
-		{"if"},
-		{"nil"},
-		{"or"},
-		{"print"},
-		{"return"},
-		{"super"},
-		{"this"},
-		{"true"},
-		{"var"},
-		{"while "},
-		{"var test = \"foobar\";"},
-		{"var\nvar"},
-		// Add more test cases as needed
-	}
+// Sources for the lexer snapshots, also used to seed the fuzz tests
+var lexCases = []struct {
+	source string
+}{
+	{"()"},
+	{"{}"},
+	{"/"},
+	{"."},
+	{"..."},
+	{"[]"},
+	{","},
+	{"-"},
+	{"+"},
+	{";"},
+	{"/"},
+	{"*"},
+	{"!"},
+	{"!="},
+	{"="},
+	{"=="},
+	{">="},
+	{">"},
+	{"<"},
+	{"<="},
+	{"=>"},
+	{"\"testing\""},
+	{"123"},
+	{"123."},
+	{"123.09"},
+	{"0x1F"},
+	{"0b1_01"},
+	{"1_000.5d"},
+	{"% ~/ ~ & | ^ << >>"},
+	{"** ++ -- += -= *= /= %="},
+	{"? : ?? ?. ?.5"},
+	{"x = /a[/]b\\/c/i"},
+	{"a / b / c"},
+	{"fun* g() { yield x; }"},
+	{"for (x in xs)"},
+	{"testing"},
+	{"for"},
+	{"and"},
+	{"class"},
+	{"else"},
+	{"false"},
+	{"fun"},
+	{"for"},
+	{"if"},
+	{"nil"},
+	{"or"},
+	{"print"},
+	{"return"},
+	{"super"},
+	{"this"},
+	{"true"},
+	{"var"},
+	{"while "},
+	{"match case"},
+	{"_ _a a1_b"},
+	{"var test = \"foobar\";"},
+	{"var\nvar"},
+	// Add more test cases as needed
+}
 
-	for _, tc := range testCases {
+func TestLexSnapshot(t *testing.T) {
+	for _, tc := range lexCases {
 		t.Run(fmt.Sprintf("ScanTokens(%q)", tc.source), func(t *testing.T) {
 			tokens, err := ScanTokens(tc.source)
 			if err != nil {
@@ -65,3 +82,90 @@ func TestLexSnapshot(t *testing.T) {
 		})
 	}
 }
+
+func TestScannerTrivia(t *testing.T) {
+	is := is.New(t)
+
+	scanner := NewScanner("// header\nvar a = 1; // one\n  a;\n")
+	scanner.KeepTrivia = true
+	var tokens []Token
+	for {
+		tok, err := scanner.Next()
+		is.NoErr(err)
+		tokens = append(tokens, tok)
+		if tok.Type == EOF {
+			break
+		}
+	}
+	is.Equal(len(tokens), 8)
+
+	texts := func(trivia []Trivia) []string {
+		var texts []string
+		for _, t := range trivia {
+			texts = append(texts, t.Text)
+		}
+		return texts
+	}
+	is.Equal(texts(tokens[0].LeadingTrivia), []string{"// header", "\n"})
+	is.True(tokens[0].LeadingTrivia[0].IsComment())
+	is.Equal(texts(tokens[4].TrailingTrivia), []string{" ", "// one"})
+	is.Equal(texts(tokens[5].LeadingTrivia), []string{"\n  "})
+	is.Equal(tokens[5].Start, Position{Line: 3, Column: 3, Offset: 30})
+	is.Equal(texts(tokens[7].LeadingTrivia), []string{"\n"})
+	is.Equal(tokens[7].Start, Position{Line: 4, Column: 1, Offset: 33})
+
+	// Without KeepTrivia it's skipped
+	tok, err := NewScanner(" // c\n x").Next()
+	is.NoErr(err)
+	is.Equal(tok.LeadingTrivia, nil)
+	is.Equal(tok.Start, Position{Line: 2, Column: 2, Offset: 7})
+}
+
+func TestScannerErrors(t *testing.T) {
+	is := is.New(t)
+
+	scanner := NewScanner("a @ é\nb \"open")
+	tok, err := scanner.Next()
+	is.NoErr(err)
+	is.Equal(tok.Lexeme, "a")
+
+	_, err = scanner.Next()
+	is.Equal(err, ScanError{
+		Message: "Unexpected character: @",
+		Start:   Position{Line: 1, Column: 3, Offset: 2},
+		End:     Position{Line: 1, Column: 4, Offset: 3},
+	})
+
+	// Scanning carries on after the error. Offsets count bytes.
+	tok, err = scanner.Next()
+	is.NoErr(err)
+	is.Equal(tok.Lexeme, "é")
+	is.Equal(tok.End, Position{Line: 1, Column: 6, Offset: 6})
+
+	tok, err = scanner.Next()
+	is.NoErr(err)
+	is.Equal(tok.Start, Position{Line: 2, Column: 1, Offset: 7})
+
+	_, err = scanner.Next()
+	is.Equal(err.Error(), "Scan Error: Unterminated String at 2:3")
+
+	tok, err = scanner.Next()
+	is.NoErr(err)
+	is.Equal(tok.Type, TokenType(EOF))
+	tok, err = scanner.Next()
+	is.NoErr(err)
+	is.Equal(tok.Type, TokenType(EOF))
+}
+
+func TestScanTokensErrors(t *testing.T) {
+	is := is.New(t)
+
+	tokens, err := ScanTokens("a @\nb #")
+	is.Equal(len(tokens), 3) // a, b and EOF
+	joined, ok := err.(interface{ Unwrap() []error })
+	is.True(ok)
+	errs := joined.Unwrap()
+	is.Equal(len(errs), 2)
+	is.Equal(errs[0].(ScanError).Start, Position{Line: 1, Column: 3, Offset: 2})
+	is.Equal(errs[1].(ScanError).Message, "Unexpected character: #")
+}
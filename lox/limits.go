@@ -0,0 +1,240 @@
+package lox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Limits caps the resources a script can use, for running code that
+// isn't trusted. Zero means no limit, except for MaxCallDepth.
+type Limits struct {
+	// Statements executed and functions called, counting every task
+	MaxSteps int64
+	// Nested function calls on one task. Zero means
+	// DefaultMaxCallDepth, which keeps runaway recursion from
+	// overflowing the Go stack.
+	MaxCallDepth int
+	// Approximate bytes allocated for strings, lists, maps and fields
+	// over the whole run. Memory that's been freed still counts.
+	MaxAlloc int64
+}
+
+const DefaultMaxCallDepth = 10000
+
+// LimitError is implemented by the errors for exceeding a limit or
+// having the runtime's Context canceled. They stop the whole run
+// rather than just the statement that hit them.
+type LimitError interface {
+	error
+	limitError()
+}
+
+type StepLimitError struct {
+	Limit int64
+}
+
+func (e StepLimitError) Error() string {
+	return fmt.Sprintf("Limit Error: exceeded the limit of %d steps", e.Limit)
+}
+
+type CallDepthError struct {
+	Limit int
+}
+
+func (e CallDepthError) Error() string {
+	return fmt.Sprintf("Limit Error: exceeded the maximum call depth of %d", e.Limit)
+}
+
+type AllocLimitError struct {
+	Limit int64
+}
+
+func (e AllocLimitError) Error() string {
+	return fmt.Sprintf("Limit Error: exceeded the allocation limit of %d bytes", e.Limit)
+}
+
+// CanceledError is returned once the runtime's Context is done. It
+// unwraps to the context's error, e.g. context.DeadlineExceeded.
+type CanceledError struct {
+	Err error
+}
+
+func (e CanceledError) Error() string {
+	return fmt.Sprintf("Canceled: %v", e.Err)
+}
+
+func (e CanceledError) Unwrap() error {
+	return e.Err
+}
+
+func (StepLimitError) limitError()  {}
+func (CallDepthError) limitError()  {}
+func (AllocLimitError) limitError() {}
+func (CanceledError) limitError()   {}
+
+// usage is shared by a runtime and its tasks, generators and modules so
+// they all count towards the same limits
+type usage struct {
+	steps int64
+	alloc int64
+}
+
+// Counts a statement and checks every limit that can be hit between
+// statements
+func (rs *RuntimeState) step() error {
+	if rs.usage == nil {
+		return nil
+	}
+	rs.usage.steps++
+	return rs.checkLimits()
+}
+
+func (rs *RuntimeState) checkLimits() error {
+	if rs.usage == nil {
+		return nil
+	}
+	if max := rs.Limits.MaxSteps; max > 0 && rs.usage.steps > max {
+		return StepLimitError{Limit: max}
+	}
+	if max := rs.Limits.MaxAlloc; max > 0 && rs.usage.alloc > max {
+		return AllocLimitError{Limit: max}
+	}
+	if ctx := rs.context(); ctx != nil {
+		select {
+		case <-ctx.Done():
+			return rs.canceledError()
+		default:
+		}
+	}
+	return nil
+}
+
+// The run's own context while one is going, which is also done once
+// the run is over or a task has stopped it. Otherwise the Context.
+func (rs *RuntimeState) context() context.Context {
+	if rs.sched != nil && rs.sched.ctx != nil {
+		return rs.sched.ctx
+	}
+	return rs.Context
+}
+
+func (rs *RuntimeState) maxCallDepth() int {
+	if rs.Limits.MaxCallDepth > 0 {
+		return rs.Limits.MaxCallDepth
+	}
+	return DefaultMaxCallDepth
+}
+
+// Closed once the runtime's Context is done or the run stops, so
+// blocking operations can give up. nil, which blocks forever, when
+// there's neither.
+func (rs *RuntimeState) canceled() <-chan struct{} {
+	ctx := rs.context()
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Done()
+}
+
+func (rs *RuntimeState) canceledError() error {
+	ctx := rs.context()
+	// Another task stopped the run with os.exit or a limit
+	if cause := context.Cause(ctx); isStopError(cause) {
+		return cause
+	}
+	return CanceledError{Err: ctx.Err()}
+}
+
+// Sleeps on the runtime's clock, waking early if the Context is done
+func (rs *RuntimeState) sleep(d time.Duration) error {
+	if rs.Clock != nil {
+		rs.Clock.Sleep(d)
+		return rs.checkLimits()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-rs.canceled():
+		return rs.canceledError()
+	}
+}
+
+// Charges n bytes against the allocation limit
+func (rs *RuntimeState) allocate(n int64) error {
+	if rs.usage == nil || rs.Limits.MaxAlloc <= 0 {
+		return nil
+	}
+	rs.usage.alloc += n
+	if rs.usage.alloc > rs.Limits.MaxAlloc {
+		return AllocLimitError{Limit: rs.Limits.MaxAlloc}
+	}
+	return nil
+}
+
+// Fails if n more bytes would go over the allocation limit, for natives
+// to check before building something big. What they return is charged
+// afterwards.
+func (rs *RuntimeState) canAllocate(n int64) error {
+	if rs.usage == nil || rs.Limits.MaxAlloc <= 0 {
+		return nil
+	}
+	if n > rs.Limits.MaxAlloc-rs.usage.alloc {
+		return AllocLimitError{Limit: rs.Limits.MaxAlloc}
+	}
+	return nil
+}
+
+// Rough sizes of a value's header and of each element
+const (
+	valueSize    = 16
+	mapEntrySize = 48
+)
+
+// Charges for a value that was just created. Only the value itself is
+// counted, since anything it contains was charged when it was made.
+func (rs *RuntimeState) account(v Value) (Value, error) {
+	if rs.usage == nil || (rs.Limits.MaxAlloc <= 0 && rs.Profiler == nil) {
+		return v, nil
+	}
+
+	var n int64
+	switch val := v.(type) {
+	case string:
+		n = valueSize + int64(len(val))
+	case *LoxList:
+		n = valueSize + valueSize*int64(len(val.Elements))
+	case *LoxMap:
+		n = valueSize + mapEntrySize*int64(val.Len())
+	case *big.Int:
+		n = valueSize + int64(len(val.Bits()))*8
+	default:
+		return v, nil
+	}
+	if rs.Profiler != nil {
+		rs.profileAlloc(n)
+	}
+	return v, rs.allocate(n)
+}
+
+// Whether err should stop the run instead of being reported and skipped
+// over: an os.exit or an exceeded limit
+func isStopError(err error) bool {
+	return errors.As(err, new(ExitError)) || errors.As(err, new(LimitError))
+}
+
+// Returns err if it stops the run, reporting it first if it's a limit
+func (rs *RuntimeState) stopError(err error) error {
+	if !isStopError(err) {
+		return nil
+	}
+	if errors.As(err, new(LimitError)) {
+		fmt.Fprintln(rs.errWriter(), err.Error())
+	}
+	return err
+}
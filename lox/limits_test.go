@@ -0,0 +1,142 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestLimits(t *testing.T) {
+	isStepLimit := func(err error) bool { return errors.As(err, new(StepLimitError)) }
+	isCallDepth := func(err error) bool { return errors.As(err, new(CallDepthError)) }
+	isAllocLimit := func(err error) bool { return errors.As(err, new(AllocLimitError)) }
+	isDeadline := func(err error) bool {
+		return errors.As(err, new(CanceledError)) && errors.Is(err, context.DeadlineExceeded)
+	}
+
+	cases := []struct {
+		name    string
+		input   string
+		limits  Limits
+		timeout time.Duration
+		output  string
+		check   func(error) bool
+	}{
+		{"steps",
+			`while (true) {}`,
+			Limits{MaxSteps: 1000}, 0,
+			"Limit Error: exceeded the limit of 1000 steps\n", isStepLimit},
+		{"steps stop the whole script",
+			`var i = 0;
+            while (i < 100) i++;
+            print "unreached";`,
+			Limits{MaxSteps: 50}, 0,
+			"Limit Error: exceeded the limit of 50 steps\n", isStepLimit},
+		{"steps within the limit",
+			`print 1;`,
+			Limits{MaxSteps: 10}, 0,
+			"1\n", nil},
+		{"steps are shared with tasks",
+			`fun spin() { while (true) {} }
+            await spawn spin();`,
+			Limits{MaxSteps: 1000}, 0,
+			"Limit Error: exceeded the limit of 1000 steps\n", isStepLimit},
+		{"steps in async functions",
+			`async fun spin() { await Promise(fun (resolve) { resolve(); }); while (true) {} }
+            await spin();`,
+			Limits{MaxSteps: 1000}, 0,
+			"Limit Error: exceeded the limit of 1000 steps\n", isStepLimit},
+		{"steps in timers",
+			`setInterval(fun () {}, 1);`,
+			Limits{MaxSteps: 100}, 0,
+			"Limit Error: exceeded the limit of 100 steps\n", isStepLimit},
+		{"call depth",
+			`fun f(n) { return f(n + 1); }
+            f(0);`,
+			Limits{MaxCallDepth: 100}, 0,
+			"Limit Error: exceeded the maximum call depth of 100\n", isCallDepth},
+		{"default call depth",
+			`fun f(n) { return f(n + 1); }
+            f(0);`,
+			Limits{}, 0,
+			"Limit Error: exceeded the maximum call depth of 10000\n", isCallDepth},
+		{"string allocation",
+			`var s = "x";
+            while (true) s = s + s;`,
+			Limits{MaxAlloc: 1 << 20}, 0,
+			"Limit Error: exceeded the allocation limit of 1048576 bytes\n", isAllocLimit},
+		{"allocation is checked before repeating",
+			`strings.repeat("ab", 100000000);`,
+			Limits{MaxAlloc: 1 << 20}, 0,
+			"Limit Error: exceeded the allocation limit of 1048576 bytes\n", isAllocLimit},
+		{"allocation is checked before raising to a power",
+			`var x = (2 ** 1048576) ** 1048576;`,
+			Limits{MaxAlloc: 1000000}, 0,
+			"Limit Error: exceeded the allocation limit of 1000000 bytes\n", isAllocLimit},
+		{"allocation is checked before raising a decimal to a power",
+			`var x = 1.1d ** 1048576;`,
+			Limits{MaxAlloc: 1000000}, 0,
+			"Limit Error: exceeded the allocation limit of 1000000 bytes\n", isAllocLimit},
+		{"list allocation",
+			`var l = [];
+            while (true) l = [...l, 1];`,
+			Limits{MaxAlloc: 1 << 16}, 0,
+			"Limit Error: exceeded the allocation limit of 65536 bytes\n", isAllocLimit},
+		{"map allocation",
+			`var m = {};
+            var i = 0;
+            while (true) { m[i] = i; i++; }`,
+			Limits{MaxAlloc: 1 << 16}, 0,
+			"Limit Error: exceeded the allocation limit of 65536 bytes\n", isAllocLimit},
+		{"deadline",
+			`while (true) {}`,
+			Limits{}, 20 * time.Millisecond,
+			"Canceled: context deadline exceeded\n", isDeadline},
+		{"deadline while sleeping",
+			`time.sleep(100000);`,
+			Limits{}, 20 * time.Millisecond,
+			"Canceled: context deadline exceeded\n", isDeadline},
+		{"deadline while receiving",
+			`var c = Channel();
+            // A task that could still send keeps this from being a deadlock
+            spawn time.sleep(100000);
+            c.recv();`,
+			Limits{}, 20 * time.Millisecond,
+			"Canceled: context deadline exceeded\n", isDeadline},
+		{"deadline while waiting for a timer",
+			`setTimeout(fun () { print "unreached"; }, 100000);`,
+			Limits{}, 20 * time.Millisecond,
+			"Canceled: context deadline exceeded\n", isDeadline},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+			s.Limits = tc.limits
+			if tc.timeout > 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+				defer cancel()
+				s.Context = ctx
+			}
+
+			err := s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+			if tc.check == nil {
+				is.NoErr(err)
+			} else {
+				is.True(tc.check(err))
+				is.True(errors.As(err, new(LimitError)))
+			}
+		})
+	}
+}
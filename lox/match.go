@@ -0,0 +1,178 @@
+package lox
+
+import (
+	"fmt"
+)
+
+// Runs the first case of a match statement whose pattern matches the
+// subject. Bindings live in a fresh scope that also covers the guard
+// and the case body.
+func (rs *RuntimeState) interpretMatch(stmt MatchStmt) (Value, error) {
+	subject, err := rs.Evaluate(stmt.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	prevEnv := rs.CurrEnv
+	defer func() { rs.CurrEnv = prevEnv }()
+
+	for _, c := range stmt.Cases {
+		rs.CurrEnv = NewScopeEnv(prevEnv)
+
+		matched, err := rs.matchPattern(c.Pattern, subject)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+
+		if c.Guard != nil {
+			guard, err := rs.Evaluate(c.Guard)
+			if err != nil {
+				return nil, err
+			}
+			if !isTruthy(guard) {
+				continue
+			}
+		}
+
+		return rs.Interpret(c.Body)
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("No case matched %s", reprValue(subject))}
+}
+
+// Checks a value against a pattern, declaring any bindings in the
+// current scope
+func (rs *RuntimeState) matchPattern(pattern Pattern, value Value) (bool, error) {
+	switch p := pattern.(type) {
+	case WildcardPattern:
+		return true, nil
+	case BindingPattern:
+		rs.CurrEnv.Declare(p.Name, value)
+		return true, nil
+	case LiteralPattern:
+		literal, err := rs.Evaluate(p.Value)
+		if err != nil {
+			return false, err
+		}
+		return isEqual(literal, value), nil
+	case TypePattern:
+		matched, err := rs.isInstanceOf(value, p.TypeName)
+		if err != nil || !matched {
+			return false, err
+		}
+		if p.Binding != "" {
+			rs.CurrEnv.Declare(p.Binding, value)
+		}
+		return true, nil
+	case ListPattern:
+		list, ok := value.(*LoxList)
+		if !ok {
+			return false, nil
+		}
+		if len(list.Elements) < len(p.Elements) || (!p.HasRest && len(list.Elements) != len(p.Elements)) {
+			return false, nil
+		}
+
+		for i, element := range p.Elements {
+			matched, err := rs.matchPattern(element, list.Elements[i])
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+		if p.HasRest {
+			rest := make([]Value, len(list.Elements)-len(p.Elements))
+			copy(rest, list.Elements[len(p.Elements):])
+			rs.CurrEnv.Declare(p.Rest, NewLoxList(rest))
+		}
+		return true, nil
+	case MapPattern:
+		m, ok := value.(*LoxMap)
+		if !ok {
+			return false, nil
+		}
+
+		for _, entry := range p.Entries {
+			key, err := rs.Evaluate(entry.Key)
+			if err != nil {
+				return false, err
+			}
+			v, present, err := m.Get(key)
+			if err != nil || !present {
+				return false, err
+			}
+
+			matched, err := rs.matchPattern(entry.Pattern, v)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	return false, RuntimeError{message: fmt.Sprintf("Unsupported pattern %+v", pattern)}
+}
+
+// Checks a value against a type name. Class names in scope take
+// precedence over the builtin type names.
+func (rs *RuntimeState) isInstanceOf(value Value, typeName string) (bool, error) {
+	if v, err := rs.CurrEnv.Lookup(typeName); err == nil {
+		if class, ok := v.(*LoxClass); ok {
+			instance, ok := value.(*LoxInstance)
+			return ok && instance.Class == class, nil
+		}
+	}
+
+	switch typeName {
+	case "Nil":
+		_, ok := value.(Null)
+		return ok, nil
+	case "Bool":
+		_, ok := value.(bool)
+		return ok, nil
+	case "Number":
+		return isNumber(value), nil
+	case "Integer":
+		return isInteger(value), nil
+	case "String":
+		_, ok := value.(string)
+		return ok, nil
+	case "List":
+		_, ok := value.(*LoxList)
+		return ok, nil
+	case "Map":
+		_, ok := value.(*LoxMap)
+		return ok, nil
+	case "Regex":
+		_, ok := value.(*LoxRegex)
+		return ok, nil
+	case "Date":
+		_, ok := value.(*LoxDate)
+		return ok, nil
+	case "Iterator":
+		_, ok := value.(*LoxIterator)
+		return ok, nil
+	case "Generator":
+		_, ok := value.(*LoxGenerator)
+		return ok, nil
+	case "Promise":
+		_, ok := value.(*LoxPromise)
+		return ok, nil
+	case "Task":
+		_, ok := value.(*LoxTask)
+		return ok, nil
+	case "Channel":
+		_, ok := value.(*LoxChannel)
+		return ok, nil
+	case "Mutex":
+		_, ok := value.(*LoxMutex)
+		return ok, nil
+	case "Function":
+		_, ok := value.(LoxCallable)
+		return ok, nil
+	}
+
+	return false, RuntimeError{message: fmt.Sprintf("Unknown type '%s' in pattern", typeName)}
+}
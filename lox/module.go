@@ -0,0 +1,265 @@
+package lox
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LoxModule is the value an import binds. Scripts reach its exports
+// through property access, e.g. `m.helper()`.
+type LoxModule struct {
+	Name    string
+	Path    string
+	Exports map[string]Value
+}
+
+func (m *LoxModule) String() string {
+	return fmt.Sprintf("<module %s>", m.Name)
+}
+
+func (m *LoxModule) get(name string) (Value, error) {
+	value, ok := m.Exports[name]
+	if !ok {
+		return nil, RuntimeError{message: fmt.Sprintf("Module '%s' has no export '%s'", m.Name, name)}
+	}
+	return value, nil
+}
+
+// moduleCache is shared by a script and every module it imports so
+// that each module runs once no matter how many times it's imported
+type moduleCache struct {
+	loaded map[string]*LoxModule
+	// Canonical paths of the modules currently being loaded, in import
+	// order, used to report circular imports
+	loading []string
+}
+
+func newModuleCache() *moduleCache {
+	return &moduleCache{loaded: make(map[string]*LoxModule)}
+}
+
+// Name of the environment variable holding the module search path
+const searchPathEnv = "GLOX_PATH"
+
+func defaultSearchPath() []string {
+	return filepath.SplitList(os.Getenv(searchPathEnv))
+}
+
+// Executes an import statement, binding the module in the current scope
+func (rs *RuntimeState) interpretImport(stmt ImportStmt) error {
+	module, err := rs.importModule(stmt.Path)
+	if err != nil {
+		return err
+	}
+
+	alias := stmt.Alias
+	if alias == "" {
+		alias = module.Name
+	}
+	rs.CurrEnv.Declare(alias, module)
+	return nil
+}
+
+// Executes an export statement, recording the declared name so it's
+// copied into the module's exports once the module finishes running
+func (rs *RuntimeState) interpretExport(stmt ExportStmt) error {
+	if rs.CurrEnv != rs.GlobalEnv {
+		return RuntimeError{message: "Exports are only allowed at the top level of a module"}
+	}
+
+	_, err := rs.Interpret(stmt.Declaration)
+	if err != nil {
+		return err
+	}
+
+	switch decl := stmt.Declaration.(type) {
+	case DeclarationStmt:
+		rs.exports = append(rs.exports, decl.Name)
+	case FunctionDeclarationStmt:
+		rs.exports = append(rs.exports, decl.Name)
+	case ClassDeclarationStmt:
+		rs.exports = append(rs.exports, decl.Name)
+	}
+	return nil
+}
+
+// Loads a module by its import path, running it in its own global scope
+// the first time it's imported
+func (rs *RuntimeState) importModule(importPath string) (*LoxModule, error) {
+	if rs.modules == nil {
+		rs.modules = newModuleCache()
+	}
+
+	canonical, err := rs.resolveModulePath(importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if module, ok := rs.modules.loaded[canonical]; ok {
+		return module, nil
+	}
+	for i, loading := range rs.modules.loading {
+		if loading == canonical {
+			cycle := append(append([]string{}, rs.modules.loading[i:]...), canonical)
+			return nil, RuntimeError{message: fmt.Sprintf("Circular import: %s", strings.Join(cycle, " -> "))}
+		}
+	}
+
+	source, err := rs.readModule(canonical)
+	if err != nil {
+		return nil, RuntimeError{message: fmt.Sprintf("Can't read module %s: %v", importPath, err)}
+	}
+
+	rs.modules.loading = append(rs.modules.loading, canonical)
+	defer func() { rs.modules.loading = rs.modules.loading[:len(rs.modules.loading)-1] }()
+
+	moduleState := rs.newModuleState(canonical)
+	program, err := compile(source)
+	if err != nil {
+		return nil, fmt.Errorf("in module %s: %w", importPath, err)
+	}
+	if rs.Coverage != nil {
+		rs.Coverage.register(canonical, source, program)
+	}
+	for _, stmt := range program.Statements {
+		_, err := moduleState.Interpret(stmt)
+		if err != nil {
+			return nil, fmt.Errorf("in module %s: %w", importPath, err)
+		}
+	}
+
+	module := &LoxModule{
+		Name:    strings.TrimSuffix(path.Base(filepath.ToSlash(canonical)), ".lox"),
+		Path:    canonical,
+		Exports: make(map[string]Value),
+	}
+	for _, name := range moduleState.exports {
+		value, err := moduleState.GlobalEnv.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		module.Exports[name] = value
+	}
+
+	rs.modules.loaded[canonical] = module
+	return module, nil
+}
+
+// Creates the runtime a module executes in. It has fresh globals but
+// shares output, loading configuration and the module cache.
+func (rs *RuntimeState) newModuleState(canonical string) *RuntimeState {
+	state := NewRuntimeState()
+	state.OutWriter = rs.OutWriter
+	state.InReader = rs.InReader
+	state.ErrWriter = rs.ErrWriter
+	state.FS = rs.FS
+	state.WorkDir = rs.WorkDir
+	state.SetArgs(rs.Args)
+	state.capabilities = rs.capabilities
+	if rs.InReader != nil && rs.stdin == nil {
+		rs.stdin = bufio.NewReader(rs.InReader)
+	}
+	state.stdin = rs.stdin
+	state.ModuleFS = rs.ModuleFS
+	state.SearchPath = rs.SearchPath
+	state.ScriptPath = canonical
+	state.script = canonical
+	state.modules = rs.modules
+	// The module runs on the importer's task
+	state.sched = rs.sched
+	state.holdsLock = rs.holdsLock
+	state.Clock = rs.Clock
+	state.Context = rs.Context
+	state.Limits = rs.Limits
+	state.Profiler = rs.Profiler
+	state.Coverage = rs.Coverage
+	state.usage = rs.usage
+	state.depth = rs.depth
+	state.loop = rs.eventLoop()
+	return &state
+}
+
+// Finds the canonical path of a module. Relative paths are tried
+// against the importing script's directory, then each search path entry.
+func (rs *RuntimeState) resolveModulePath(importPath string) (string, error) {
+	if rs.ModuleFS != nil {
+		return rs.resolveFSModulePath(importPath)
+	}
+	// Without a ModuleFS imports read the host's files, just like
+	// fs.readFile
+	if err := rs.require(CapFSRead, "import"); err != nil {
+		return "", err
+	}
+
+	candidates := []string{importPath}
+	if !filepath.IsAbs(importPath) {
+		dir := "."
+		if rs.ScriptPath != "" {
+			dir = filepath.Dir(rs.ScriptPath)
+		}
+		candidates = []string{filepath.Join(dir, importPath)}
+		for _, searchDir := range rs.SearchPath {
+			candidates = append(candidates, filepath.Join(searchDir, importPath))
+		}
+	}
+
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		abs, err := filepath.Abs(candidate)
+		if err != nil {
+			return "", err
+		}
+		return filepath.EvalSymlinks(abs)
+	}
+
+	return "", RuntimeError{message: fmt.Sprintf("Module %s not found", importPath)}
+}
+
+// Like resolveModulePath, but for modules served from ModuleFS. Paths
+// there are always slash separated and relative to the FS root.
+func (rs *RuntimeState) resolveFSModulePath(importPath string) (string, error) {
+	candidates := []string{strings.TrimPrefix(path.Clean(importPath), "/")}
+	if !path.IsAbs(importPath) {
+		dir := "."
+		if rs.ScriptPath != "" {
+			dir = path.Dir(rs.ScriptPath)
+		}
+		candidates = []string{path.Join(dir, importPath)}
+		for _, searchDir := range rs.SearchPath {
+			candidates = append(candidates, path.Join(strings.TrimPrefix(searchDir, "/"), importPath))
+		}
+	}
+
+	for _, candidate := range candidates {
+		if !fs.ValidPath(candidate) {
+			continue
+		}
+
+		info, err := fs.Stat(rs.ModuleFS, candidate)
+		if err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	return "", RuntimeError{message: fmt.Sprintf("Module %s not found", importPath)}
+}
+
+func (rs *RuntimeState) readModule(canonical string) (string, error) {
+	var data []byte
+	var err error
+	if rs.ModuleFS != nil {
+		data, err = fs.ReadFile(rs.ModuleFS, canonical)
+	} else {
+		data, err = os.ReadFile(canonical)
+	}
+	return string(data), err
+}
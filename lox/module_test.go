@@ -0,0 +1,120 @@
+package lox
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/matryer/is"
+)
+
+func TestImport(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/math.lox": {Data: []byte(`
+            print "loading math";
+            export fun square(x) { return x * x; }
+            export var answer = 42;
+            var secret = 1;
+        `)},
+		"lib/shapes.lox": {Data: []byte(`
+            import "math.lox";
+            export class Square {
+                init(side) { this.side = side; }
+                area() { return math.square(this.side); }
+            }
+        `)},
+		"vendor/util.lox": {Data: []byte(`export fun id(x) { return x; }`)},
+		"cycle/a.lox":     {Data: []byte(`import "b.lox";`)},
+		"cycle/b.lox":     {Data: []byte(`import "a.lox";`)},
+	}
+
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"import with alias",
+			`import "lib/math.lox" as m;
+            print m.square(3);
+            print m.answer;
+            print m;`,
+			"loading math\n9\n42\n<module math>\n",
+		},
+		{"modules run once",
+			`import "lib/math.lox" as a;
+            import "lib/shapes.lox" as shapes;
+            print shapes.Square(2).area();`,
+			"loading math\n4\n",
+		},
+		{"unexported names are hidden",
+			`import "lib/math.lox";
+            print math.secret;`,
+			"loading math\nRuntimeError: Module 'math' has no export 'secret'\n",
+		},
+		{"search path",
+			`import "util.lox";
+            print util.id(1);`,
+			"1\n",
+		},
+		{"circular import",
+			`import "cycle/a.lox";`,
+			"in module cycle/a.lox: in module b.lox: RuntimeError: Circular import: cycle/a.lox -> cycle/b.lox -> cycle/a.lox\n",
+		},
+		{"missing module",
+			`import "nope.lox";`,
+			"RuntimeError: Module nope.lox not found\n",
+		},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+			s.ModuleFS = fsys
+			s.SearchPath = []string{"vendor"}
+
+			s.Run(tc.input)
+
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestImportFromDisk(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "helper.lox"), []byte(`export fun greet() { return "hi"; }`), 0o644)
+	is.NoErr(err)
+
+	var buf bytes.Buffer
+	s := NewRuntimeState()
+	s.OutWriter = &buf
+	s.ErrWriter = &buf
+	s.ScriptPath = filepath.Join(dir, "main.lox")
+	s.Run(`import "helper.lox"; print helper.greet();`)
+
+	is.Equal(strings.TrimSpace(buf.String()), "hi")
+}
+
+func TestImportFromDiskNeedsFSRead(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret.lox")
+	err := os.WriteFile(secret, []byte(`print "leaked";`), 0o644)
+	is.NoErr(err)
+
+	var buf bytes.Buffer
+	s := NewRuntimeState(WithCapabilities())
+	s.OutWriter = &buf
+	s.ErrWriter = &buf
+	s.Run(`import "` + secret + `";`)
+
+	is.Equal(buf.String(), "PermissionError: import needs the 'fs-read' capability\n")
+}
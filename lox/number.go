@@ -0,0 +1,539 @@
+package lox
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Lox numbers form a small numeric tower. From lowest to highest rank:
+//
+//   - int64 for integers that fit in a machine word
+//   - *big.Int for integers that don't (results are demoted back to
+//     int64 whenever they fit, so there's a single integer type to scripts)
+//   - *big.Rat for exact decimals, written with a `d` suffix (1.10d)
+//   - float64 for everything written with a decimal point
+//
+// Mixed arithmetic promotes both operands to the higher rank. The one
+// exception is `/`, which always produces a float unless an operand is
+// a decimal. Integer results come from `~/` (floor division) and `%`.
+const (
+	rankInt = iota
+	rankBigInt
+	rankDecimal
+	rankFloat
+)
+
+// Returns the tower rank of a value or false if it isn't a number
+func numericRank(v Value) (int, bool) {
+	switch v.(type) {
+	case int64:
+		return rankInt, true
+	case *big.Int:
+		return rankBigInt, true
+	case *big.Rat:
+		return rankDecimal, true
+	case float64:
+		return rankFloat, true
+	}
+	return 0, false
+}
+
+func isNumber(v Value) bool {
+	_, ok := numericRank(v)
+	return ok
+}
+
+func isInteger(v Value) bool {
+	rank, ok := numericRank(v)
+	return ok && rank <= rankBigInt
+}
+
+// Parses the lexeme of a NUMBER token
+func parseNumberLiteral(lexeme string) (Value, error) {
+	text := strings.ReplaceAll(lexeme, "_", "")
+
+	if strings.HasSuffix(text, "d") {
+		r, ok := new(big.Rat).SetString(strings.TrimSuffix(text, "d"))
+		if !ok {
+			return nil, fmt.Errorf("invalid decimal literal %s", lexeme)
+		}
+		return r, nil
+	}
+
+	if strings.Contains(text, ".") {
+		return strconv.ParseFloat(text, 64)
+	}
+
+	// Only use Go's prefix detection for explicit prefixes so that a
+	// leading zero doesn't silently mean octal
+	base := 10
+	if len(text) > 1 && text[0] == '0' && strings.ContainsRune("xXbBoO", rune(text[1])) {
+		base = 0
+	}
+	i, ok := new(big.Int).SetString(text, base)
+	if !ok {
+		return nil, fmt.Errorf("invalid integer literal %s", lexeme)
+	}
+	return normalizeInt(i), nil
+}
+
+// Demotes a big integer to int64 when it fits
+func normalizeInt(i *big.Int) Value {
+	if i.IsInt64() {
+		return i.Int64()
+	}
+	return i
+}
+
+func toBigInt(v Value) *big.Int {
+	switch n := v.(type) {
+	case int64:
+		return big.NewInt(n)
+	case *big.Int:
+		return n
+	}
+	panic(fmt.Sprintf("toBigInt on non-integer %T", v))
+}
+
+func toRat(v Value) *big.Rat {
+	switch n := v.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(n)
+	case *big.Int:
+		return new(big.Rat).SetInt(n)
+	case *big.Rat:
+		return n
+	}
+	panic(fmt.Sprintf("toRat on non-decimal %T", v))
+}
+
+func toFloat(v Value) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f
+	case *big.Rat:
+		f, _ := n.Float64()
+		return f
+	case float64:
+		return n
+	}
+	panic(fmt.Sprintf("toFloat on non-number %T", v))
+}
+
+// Converts an integral value to an int, used for indexes and counts
+func toInt(v Value) (int, bool) {
+	n, ok := v.(int64)
+	if !ok || n != int64(int(n)) {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func formatDecimal(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+
+	// A fraction has a finite decimal expansion when its denominator
+	// only has factors of 2 and 5. The number of digits needed is
+	// the larger of the two exponents.
+	denom := new(big.Int).Set(r.Denom())
+	twos, fives := 0, 0
+	two, five, zero := big.NewInt(2), big.NewInt(5), big.NewInt(0)
+	mod := new(big.Int)
+	for mod.Mod(denom, two).Cmp(zero) == 0 {
+		denom.Quo(denom, two)
+		twos++
+	}
+	for mod.Mod(denom, five).Cmp(zero) == 0 {
+		denom.Quo(denom, five)
+		fives++
+	}
+	if denom.IsInt64() && denom.Int64() == 1 {
+		return r.FloatString(max(twos, fives))
+	}
+
+	return strings.TrimRight(r.FloatString(20), "0")
+}
+
+func numberOperandError(op TokenType, lhs Value, rhs Value) error {
+	return RuntimeError{
+		message: fmt.Sprintf("Operands of '%s' must be numbers, got %s and %s", op, stringify(lhs), stringify(rhs)),
+	}
+}
+
+// Applies an arithmetic operator, promoting the operands through the
+// numeric tower
+func arithmetic(op TokenType, lhs Value, rhs Value) (Value, error) {
+	lrank, lok := numericRank(lhs)
+	rrank, rok := numericRank(rhs)
+	if !lok || !rok {
+		return nil, numberOperandError(op, lhs, rhs)
+	}
+	rank := max(lrank, rrank)
+
+	// True division never stays in the integers
+	if op == SLASH && rank <= rankBigInt {
+		rank = rankFloat
+	}
+
+	switch rank {
+	case rankInt:
+		if result, ok := int64Arithmetic(op, lhs.(int64), rhs.(int64)); ok {
+			return result, nil
+		}
+		// Overflowed, redo it with arbitrary precision
+		fallthrough
+	case rankBigInt:
+		return bigIntArithmetic(op, toBigInt(lhs), toBigInt(rhs))
+	case rankDecimal:
+		return decimalArithmetic(op, toRat(lhs), toRat(rhs))
+	}
+	return floatArithmetic(op, toFloat(lhs), toFloat(rhs))
+}
+
+// Integer arithmetic that reports false on overflow or when the
+// operator needs special handling in the big integer path
+func int64Arithmetic(op TokenType, a int64, b int64) (Value, bool) {
+	switch op {
+	case PLUS:
+		r := a + b
+		if (a > 0 && b > 0 && r < 0) || (a < 0 && b < 0 && r >= 0) {
+			return nil, false
+		}
+		return r, true
+	case MINUS:
+		r := a - b
+		if (a >= 0 && b < 0 && r < 0) || (a < 0 && b > 0 && r >= 0) {
+			return nil, false
+		}
+		return r, true
+	case STAR:
+		if a == 0 || b == 0 {
+			return int64(0), true
+		}
+		r := a * b
+		if r/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+			return nil, false
+		}
+		return r, true
+	}
+	return nil, false
+}
+
+var errDivisionByZero = RuntimeError{message: "Division by zero"}
+
+func bigIntArithmetic(op TokenType, a *big.Int, b *big.Int) (Value, error) {
+	r := new(big.Int)
+	switch op {
+	case PLUS:
+		r.Add(a, b)
+	case MINUS:
+		r.Sub(a, b)
+	case STAR:
+		r.Mul(a, b)
+	case TILDE_SLASH, PERCENT:
+		if b.Sign() == 0 {
+			return nil, errDivisionByZero
+		}
+		// Go truncates towards zero, Lox floors
+		q, m := new(big.Int).QuoRem(a, b, new(big.Int))
+		if m.Sign() != 0 && m.Sign() != b.Sign() {
+			q.Sub(q, big.NewInt(1))
+			m.Add(m, b)
+		}
+		if op == PERCENT {
+			r = m
+		} else {
+			r = q
+		}
+	default:
+		return nil, RuntimeError{message: fmt.Sprintf("Unsupported numeric operator '%s'", op)}
+	}
+	return normalizeInt(r), nil
+}
+
+func decimalArithmetic(op TokenType, a *big.Rat, b *big.Rat) (Value, error) {
+	r := new(big.Rat)
+	switch op {
+	case PLUS:
+		r.Add(a, b)
+	case MINUS:
+		r.Sub(a, b)
+	case STAR:
+		r.Mul(a, b)
+	case SLASH, TILDE_SLASH, PERCENT:
+		if b.Sign() == 0 {
+			return nil, errDivisionByZero
+		}
+		r.Quo(a, b)
+		if op == SLASH {
+			break
+		}
+
+		floor := ratFloor(r)
+		if op == TILDE_SLASH {
+			r.SetInt(floor)
+		} else {
+			// a - b*floor(a/b)
+			r.Mul(b, new(big.Rat).SetInt(floor))
+			r.Sub(a, r)
+		}
+	default:
+		return nil, RuntimeError{message: fmt.Sprintf("Unsupported numeric operator '%s'", op)}
+	}
+	return r, nil
+}
+
+func ratFloor(r *big.Rat) *big.Int {
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if m.Sign() < 0 {
+		q.Sub(q, big.NewInt(1))
+	}
+	return q
+}
+
+func floatArithmetic(op TokenType, a float64, b float64) (Value, error) {
+	switch op {
+	case PLUS:
+		return a + b, nil
+	case MINUS:
+		return a - b, nil
+	case STAR:
+		return a * b, nil
+	case SLASH:
+		if b == 0 {
+			return nil, errDivisionByZero
+		}
+		return a / b, nil
+	case TILDE_SLASH:
+		if b == 0 {
+			return nil, errDivisionByZero
+		}
+		return math.Floor(a / b), nil
+	case PERCENT:
+		if b == 0 {
+			return nil, errDivisionByZero
+		}
+		m := math.Mod(a, b)
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return m, nil
+	}
+	return nil, RuntimeError{message: fmt.Sprintf("Unsupported numeric operator '%s'", op)}
+}
+
+// Largest integer exponent allowed for exact powers
+const maxExponent = 1 << 20
+
+// Raises lhs to the power of rhs. Integer bases with a non-negative
+// integer exponent and decimal bases with any integer exponent stay
+// exact, everything else is a float.
+// Exact results are checked against the allocation limit before
+// they're computed, since maxExponent alone doesn't bound their size.
+func power(rs *RuntimeState, lhs Value, rhs Value) (Value, error) {
+	lrank, lok := numericRank(lhs)
+	rrank, rok := numericRank(rhs)
+	if !lok || !rok {
+		return nil, numberOperandError(STAR_STAR, lhs, rhs)
+	}
+
+	if rrank <= rankBigInt && lrank <= rankDecimal {
+		exp := toBigInt(rhs)
+		if !exp.IsInt64() || exp.Int64() > maxExponent || exp.Int64() < -maxExponent {
+			return nil, RuntimeError{message: fmt.Sprintf("Exponent %s is too large", exp)}
+		}
+
+		n := exp.Int64()
+		if lrank <= rankBigInt && n >= 0 {
+			base := toBigInt(lhs)
+			if err := rs.canAllocate(powerSize(base.BitLen(), n)); err != nil {
+				return nil, err
+			}
+			return normalizeInt(new(big.Int).Exp(base, exp, nil)), nil
+		}
+		if lrank == rankDecimal {
+			base := toRat(lhs)
+			bits := base.Num().BitLen() + base.Denom().BitLen()
+			if err := rs.canAllocate(powerSize(bits, n)); err != nil {
+				return nil, err
+			}
+			if n < 0 {
+				if base.Sign() == 0 {
+					return nil, errDivisionByZero
+				}
+				return ratPow(new(big.Rat).Inv(base), -n), nil
+			}
+			return ratPow(base, n), nil
+		}
+	}
+
+	return math.Pow(toFloat(lhs), toFloat(rhs)), nil
+}
+
+// Roughly how many bytes a number of bits long raised to the power of
+// n takes, or to -n for a negative n
+func powerSize(bits int, n int64) int64 {
+	if n < 0 {
+		n = -n
+	}
+	if bits > 0 && n > math.MaxInt64/int64(bits) {
+		return math.MaxInt64
+	}
+	return int64(bits) * n / 8
+}
+
+// Exponentiation by squaring
+func ratPow(base *big.Rat, n int64) *big.Rat {
+	result := new(big.Rat).SetInt64(1)
+	b := new(big.Rat).Set(base)
+	for n > 0 {
+		if n&1 == 1 {
+			result.Mul(result, b)
+		}
+		b.Mul(b, b)
+		n >>= 1
+	}
+	return result
+}
+
+// Largest shift allowed, to keep a typo from allocating gigabytes
+const maxShift = 1 << 16
+
+// Applies a bitwise operator. Both operands must be integers.
+func bitwise(op TokenType, lhs Value, rhs Value) (Value, error) {
+	if !isInteger(lhs) || !isInteger(rhs) {
+		return nil, RuntimeError{
+			message: fmt.Sprintf("Operands of '%s' must be integers, got %s and %s", op, stringify(lhs), stringify(rhs)),
+		}
+	}
+
+	// Fast path, shifts can overflow so they always go through big.Int
+	if a, ok := lhs.(int64); ok {
+		if b, ok := rhs.(int64); ok {
+			switch op {
+			case AMPERSAND:
+				return a & b, nil
+			case PIPE:
+				return a | b, nil
+			case CARET:
+				return a ^ b, nil
+			}
+		}
+	}
+
+	a, b := toBigInt(lhs), toBigInt(rhs)
+	r := new(big.Int)
+	switch op {
+	case AMPERSAND:
+		r.And(a, b)
+	case PIPE:
+		r.Or(a, b)
+	case CARET:
+		r.Xor(a, b)
+	case LESS_LESS, GREATER_GREATER:
+		if b.Sign() < 0 || !b.IsInt64() || b.Int64() > maxShift {
+			return nil, RuntimeError{message: fmt.Sprintf("Invalid shift count %s", b)}
+		}
+		if op == LESS_LESS {
+			r.Lsh(a, uint(b.Int64()))
+		} else {
+			r.Rsh(a, uint(b.Int64()))
+		}
+	default:
+		return nil, RuntimeError{message: fmt.Sprintf("Unsupported bitwise operator '%s'", op)}
+	}
+	return normalizeInt(r), nil
+}
+
+func negate(v Value) (Value, error) {
+	switch n := v.(type) {
+	case int64:
+		if n == math.MinInt64 {
+			return new(big.Int).Neg(big.NewInt(n)), nil
+		}
+		return -n, nil
+	case *big.Int:
+		return normalizeInt(new(big.Int).Neg(n)), nil
+	case *big.Rat:
+		return new(big.Rat).Neg(n), nil
+	case float64:
+		return -n, nil
+	}
+	return nil, RuntimeError{message: fmt.Sprintf("Operand of '-' must be a number, got %s", stringify(v))}
+}
+
+func bitwiseNot(v Value) (Value, error) {
+	switch n := v.(type) {
+	case int64:
+		return ^n, nil
+	case *big.Int:
+		return normalizeInt(new(big.Int).Not(n)), nil
+	}
+	return nil, RuntimeError{message: fmt.Sprintf("Operand of '~' must be an integer, got %s", stringify(v))}
+}
+
+// Compares two numbers after promoting them to a common rank. The
+// second result is false when the values are unordered (NaN).
+func compareNumbers(lhs Value, rhs Value) (int, bool) {
+	lrank, _ := numericRank(lhs)
+	rrank, _ := numericRank(rhs)
+
+	switch max(lrank, rrank) {
+	case rankInt:
+		a, b := lhs.(int64), rhs.(int64)
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case rankBigInt:
+		return toBigInt(lhs).Cmp(toBigInt(rhs)), true
+	case rankDecimal:
+		return toRat(lhs).Cmp(toRat(rhs)), true
+	}
+
+	a, b := toFloat(lhs), toFloat(rhs)
+	switch {
+	case math.IsNaN(a) || math.IsNaN(b):
+		return 0, false
+	case a < b:
+		return -1, true
+	case a > b:
+		return 1, true
+	}
+	return 0, true
+}
+
+// Applies a comparison operator to two numbers
+func compare(op TokenType, lhs Value, rhs Value) (Value, error) {
+	if !isNumber(lhs) || !isNumber(rhs) {
+		return nil, numberOperandError(op, lhs, rhs)
+	}
+
+	c, ordered := compareNumbers(lhs, rhs)
+	if !ordered {
+		return false, nil
+	}
+
+	switch op {
+	case GREATER:
+		return c > 0, nil
+	case GREATER_EQUAL:
+		return c >= 0, nil
+	case LESS:
+		return c < 0, nil
+	case LESS_EQUAL:
+		return c <= 0, nil
+	}
+	return nil, RuntimeError{message: fmt.Sprintf("Unsupported comparison operator '%s'", op)}
+}
@@ -2,7 +2,9 @@ package lox
 
 import (
 	"fmt"
-	"strconv"
+	"math/big"
+	"strings"
+	"unicode"
 )
 
 type ParseError struct {
@@ -17,37 +19,93 @@ func (p ParseError) Error() string {
 	return fmt.Sprintf("Parse Error: %s", p.message)
 }
 
+// The token the error was found at, the way the book's interpreters
+// report it: "at 'x'", or "at end"
+func (p ParseError) where() string {
+	if p.token.Type == EOF {
+		return "at end"
+	}
+	return fmt.Sprintf("at '%s'", p.token.Lexeme)
+}
+
 // Parse parses the tokens returned by the lexer into an AST.
 func Parse(tokens []Token) (Node, error) {
-	state := parserState{tokens, 0}
+	state := parserState{tokens: tokens}
 
 	expr, err := state.parseProgram()
 	if err != nil {
-		return nil, err
+		return nil, state.locate(err)
 	}
 
 	if !state.Done() {
-		return nil, ParseError{message: "Leftover tokens after parsing"}
+		return nil, state.locate(ParseError{message: "Leftover tokens after parsing"})
 	}
 
 	return expr, nil
 }
 
+// Fills in where a ParseError happened. Parsing stops at the first
+// error, so unless the error names a token of its own it's the one the
+// parser was looking at.
+func (ps *parserState) locate(err error) error {
+	pe, ok := err.(ParseError)
+	if !ok {
+		return err
+	}
+	if pe.token.Start.Line == 0 {
+		pe.token = ps.peekToken()
+	}
+	pe.line = pe.token.Start.Line
+	return pe
+}
+
 type parserState struct {
 	tokens  []Token
 	current int
+	// The index of the ')' matching each '(' that has one. Found on
+	// the first arrow function check, so checking every '(' doesn't
+	// take quadratic time.
+	closingParen map[int]int
+	// How deeply nested the rule being parsed is
+	depth int
 }
 
-func (ps *parserState) Done() bool {
-	if ps.current < len(ps.tokens) {
-		return false
+// How deeply statements, expressions and patterns can be nested. The
+// parser is recursive, so without a limit deeply nested source would
+// overflow the Go stack, which can't be recovered from.
+const maxNesting = 1000
+
+// Called on the way into each rule that can contain itself, with
+// leave deferred
+func (ps *parserState) enter() error {
+	if ps.depth >= maxNesting {
+		return ParseError{message: fmt.Sprintf("Nested more than %d levels deep", maxNesting)}
 	}
-	return true
+	ps.depth++
+	return nil
+}
+
+func (ps *parserState) leave() {
+	ps.depth--
+}
+
+func (ps *parserState) Done() bool {
+	return ps.peekToken().Type == EOF
 }
 
-// Returns the current token
+// Returns the current token. Tokens that don't end with an EOF token
+// get one after the last token.
 func (ps *parserState) peekToken() Token {
-	return ps.tokens[ps.current]
+	if ps.current < len(ps.tokens) {
+		return ps.tokens[ps.current]
+	}
+
+	eof := Token{Type: EOF}
+	if len(ps.tokens) > 0 {
+		eof.Start = ps.tokens[len(ps.tokens)-1].End
+		eof.End = eof.Start
+	}
+	return eof
 }
 
 // Checks the current token for a specific token type
@@ -56,7 +114,16 @@ func (ps *parserState) checkTokenType(ttype TokenType) bool {
 		return false
 	}
 
-	return ps.peekToken().type_ == ttype
+	return ps.peekToken().Type == ttype
+}
+
+// Checks the token after the current one for a specific token type
+func (ps *parserState) checkNextTokenType(ttype TokenType) bool {
+	if ps.current+1 >= len(ps.tokens) {
+		return false
+	}
+
+	return ps.tokens[ps.current+1].Type == ttype
 }
 
 // Moves the state forward
@@ -77,6 +144,27 @@ func (ps *parserState) consumeToken(ttype TokenType, errorMsg string) error {
 	return nil
 }
 
+// Consumes the name after a '.'. Keywords are allowed there, so
+// `re.match(s)` is a property access and not a match statement.
+func (ps *parserState) consumePropertyName(errorMsg string) error {
+	if !ps.checkTokenType(IDENTIFIER) && !ps.checkKeyword() {
+		return ParseError{
+			message: errorMsg,
+		}
+	}
+
+	ps.advanceToken()
+	return nil
+}
+
+func (ps *parserState) checkKeyword() bool {
+	if ps.current >= len(ps.tokens) {
+		return false
+	}
+	tok := ps.peekToken()
+	return tok.Type != STRING && tok.Lexeme != "" && unicode.IsLetter([]rune(tok.Lexeme)[0])
+}
+
 // Matches any of the token types and consumes it
 func (ps *parserState) matchToken(types ...TokenType) bool {
 	for _, ttype := range types {
@@ -109,12 +197,31 @@ func (ps *parserState) parseProgram() (Node, error) {
 }
 
 func (ps *parserState) parseDeclaration() (Stmt, error) {
-	if ps.matchToken(VAR) {
+	if err := ps.enter(); err != nil {
+		return nil, err
+	}
+	defer ps.leave()
+
+	line := ps.peekToken().Start.Line
+	if ps.matchToken(EXPORT) {
+		decl, err := ps.parseDeclaration()
+		if err != nil {
+			return nil, err
+		}
+
+		switch decl.(type) {
+		case DeclarationStmt, FunctionDeclarationStmt, ClassDeclarationStmt:
+			return ExportStmt{Declaration: decl, Line: line}, nil
+		}
+		return nil, ParseError{message: "Expected var, fun or class declaration after 'export'"}
+	} else if ps.matchToken(IMPORT) {
+		return ps.parseImport()
+	} else if ps.matchToken(VAR) {
 		err := ps.consumeToken(IDENTIFIER, "Expected identifier.")
 		if err != nil {
 			return nil, err
 		}
-		d := DeclarationStmt{Name: ps.previous().lexeme}
+		d := DeclarationStmt{Name: ps.previous().Lexeme, Line: line}
 
 		// Optionally consume the value definition
 		if ps.matchToken(EQUAL) {
@@ -132,14 +239,19 @@ func (ps *parserState) parseDeclaration() (Stmt, error) {
 		}
 
 		return d, nil
-	} else if ps.matchToken(FUN) {
-		return ps.parseFunctionDefinition()
+	} else if ps.checkTokenType(FUN) && (ps.checkNextTokenType(IDENTIFIER) || ps.checkNextTokenType(STAR)) {
+		ps.advanceToken()
+		return ps.parseFunctionDefinition(false)
+	} else if ps.checkTokenType(ASYNC) && ps.checkNextTokenType(FUN) {
+		ps.advanceToken()
+		ps.advanceToken()
+		return ps.parseFunctionDefinition(true)
 	} else if ps.matchToken(CLASS) {
 		err := ps.consumeToken(IDENTIFIER, "Expected class identifier")
 		if err != nil {
 			return nil, err
 		}
-		identifier := ps.previous().lexeme
+		identifier := ps.previous().Lexeme
 
 		err = ps.consumeToken(LEFT_BRACE, "Expected '{' to open class")
 		if err != nil {
@@ -148,21 +260,19 @@ func (ps *parserState) parseDeclaration() (Stmt, error) {
 
 		functions := make([]FunctionDeclarationStmt, 0)
 		for !ps.matchToken(RIGHT_BRACE) {
-			fun, err := ps.parseFunctionDefinition()
+			// Methods are marked `async name()`
+			fun, err := ps.parseFunctionDefinition(ps.matchToken(ASYNC))
 			if err != nil {
 				return nil, err
 			}
-
-			if fun_stmt, ok := fun.(FunctionDeclarationStmt); !ok {
-				panic("Bad juju")
-			} else {
-				functions = append(functions, fun_stmt)
-			}
+			functions = append(functions, fun)
 		}
 
 		return ClassDeclarationStmt{
 			Name:      identifier,
 			Functions: functions,
+			Line:      line,
+			EndLine:   ps.previous().Start.Line,
 		}, nil
 
 	}
@@ -170,27 +280,122 @@ func (ps *parserState) parseDeclaration() (Stmt, error) {
 	return ps.parseStmt()
 }
 
-func (ps *parserState) parseFunctionDefinition() (Stmt, error) {
-	err := ps.consumeToken(IDENTIFIER, "Expected function identifier")
+func (ps *parserState) parseImport() (Stmt, error) {
+	err := ps.consumeToken(STRING, "Expected module path string after 'import'")
+	if err != nil {
+		return nil, err
+	}
+	stmt := ImportStmt{Path: ps.previous().Literal.(string), Line: ps.previous().Start.Line}
+
+	if ps.matchToken(AS) {
+		err = ps.consumeToken(IDENTIFIER, "Expected module alias after 'as'")
+		if err != nil {
+			return nil, err
+		}
+		stmt.Alias = ps.previous().Lexeme
+	}
+
+	err = ps.consumeToken(SEMICOLON, "Expected semicolon.")
+	if err != nil {
+		return nil, err
+	}
+
+	return stmt, nil
+}
+
+func (ps *parserState) parseFunctionDefinition(isAsync bool) (FunctionDeclarationStmt, error) {
+	generator, err := ps.parseGeneratorStar(isAsync)
+	if err != nil {
+		return FunctionDeclarationStmt{}, err
+	}
+
+	err = ps.consumeToken(IDENTIFIER, "Expected function identifier")
+	if err != nil {
+		return FunctionDeclarationStmt{}, err
+	}
+	name := ps.previous().Lexeme
+	line := ps.previous().Start.Line
+
+	params, body, err := ps.parseFunctionRest()
+	if err != nil {
+		return FunctionDeclarationStmt{}, err
+	}
+
+	return FunctionDeclarationStmt{
+		Name:        name,
+		Parameters:  params,
+		Body:        body,
+		IsGenerator: generator,
+		IsAsync:     isAsync,
+		Line:        line,
+	}, nil
+}
+
+// Matches the `*` that marks a generator
+func (ps *parserState) parseGeneratorStar(isAsync bool) (bool, error) {
+	if !ps.matchToken(STAR) {
+		return false, nil
+	}
+	if isAsync {
+		return false, ParseError{message: "Async functions can't be generators"}
+	}
+	return true, nil
+}
+
+// Parses a yield after the keyword. The value is optional, like in
+// `var received = yield;`.
+func (ps *parserState) parseYield() (Expr, error) {
+	for _, end := range []TokenType{SEMICOLON, RIGHT_PAREN, RIGHT_BRACKET, RIGHT_BRACE, COMMA, COLON} {
+		if ps.checkTokenType(end) {
+			return YieldExpr{}, nil
+		}
+	}
+
+	value, err := ps.parseAssignment()
 	if err != nil {
 		return nil, err
 	}
-	name := ps.previous().lexeme
+	return YieldExpr{Value: value}, nil
+}
+
+// Parses the parameter list and body shared by named and anonymous functions
+func (ps *parserState) parseFunctionRest() ([]Parameter, BlockStmt, error) {
+	params, err := ps.parseParameters()
+	if err != nil {
+		return nil, BlockStmt{}, err
+	}
 
-	err = ps.consumeToken(LEFT_PAREN, "Expected '('")
+	body, err := ps.parseBlock()
+	if err != nil {
+		return nil, BlockStmt{}, err
+	}
+
+	return params, body.(BlockStmt), nil
+}
+
+func (ps *parserState) parseParameters() ([]Parameter, error) {
+	err := ps.consumeToken(LEFT_PAREN, "Expected '('")
 	if err != nil {
 		return nil, err
 	}
 
-	params := make([]string, 0)
+	params := make([]Parameter, 0)
 	if !ps.matchToken(RIGHT_PAREN) {
 		for {
-			err := ps.consumeToken(IDENTIFIER, "Expected function identifier")
+			param, err := ps.parseParameter()
 			if err != nil {
 				return nil, err
 			}
-			param := ps.previous().lexeme
 
+			if len(params) > 0 {
+				last := params[len(params)-1]
+				if last.Rest {
+					return nil, ParseError{message: "Rest parameter must be the last parameter"}
+				}
+				if last.Default != nil && param.Default == nil && !param.Rest {
+					return nil, ParseError{message: "Parameter without a default can't follow one with a default"}
+				}
+			}
 			params = append(params, param)
 
 			if ps.matchToken(RIGHT_PAREN) {
@@ -203,20 +408,114 @@ func (ps *parserState) parseFunctionDefinition() (Stmt, error) {
 		}
 	}
 
-	body, err := ps.parseBlock()
+	return params, nil
+}
+
+// Parses a parameter with an optional default value or rest prefix
+func (ps *parserState) parseParameter() (Parameter, error) {
+	rest := ps.matchToken(ELLIPSIS)
+
+	err := ps.consumeToken(IDENTIFIER, "Expected parameter identifier")
+	if err != nil {
+		return Parameter{}, err
+	}
+	param := Parameter{Name: ps.previous().Lexeme, Rest: rest}
+
+	if ps.matchToken(EQUAL) {
+		if rest {
+			return Parameter{}, ParseError{message: "Rest parameter can't have a default value"}
+		}
+
+		param.Default, err = ps.parseExpr()
+		if err != nil {
+			return Parameter{}, err
+		}
+	}
+
+	return param, nil
+}
+
+// Checks whether the parenthesized list at the current token is
+// followed by '=>', i.e. it's the parameter list of an arrow function
+func (ps *parserState) isArrowFunction() bool {
+	if ps.checkTokenType(IDENTIFIER) {
+		return ps.checkNextTokenType(ARROW)
+	}
+	if !ps.checkTokenType(LEFT_PAREN) {
+		return false
+	}
+
+	if ps.closingParen == nil {
+		ps.matchParens()
+	}
+	i, ok := ps.closingParen[ps.current]
+	return ok && i+1 < len(ps.tokens) && ps.tokens[i+1].Type == ARROW
+}
+
+func (ps *parserState) matchParens() {
+	ps.closingParen = make(map[int]int)
+	var open []int
+	for i, tok := range ps.tokens {
+		switch tok.Type {
+		case LEFT_PAREN:
+			open = append(open, i)
+		case RIGHT_PAREN:
+			if len(open) > 0 {
+				ps.closingParen[open[len(open)-1]] = i
+				open = open[:len(open)-1]
+			}
+		}
+	}
+}
+
+// Parse an arrow function as a desugared function expression
+func (ps *parserState) parseArrowFunction() (Expr, error) {
+	line := ps.peekToken().Start.Line
+	var params []Parameter
+	if ps.matchToken(IDENTIFIER) {
+		params = []Parameter{{Name: ps.previous().Lexeme}}
+	} else {
+		var err error
+		params, err = ps.parseParameters()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := ps.consumeToken(ARROW, "Expected '=>' after arrow function parameters")
 	if err != nil {
 		return nil, err
 	}
 
-	return FunctionDeclarationStmt{
-		Name:       name,
+	// A block body is used as-is, an expression body is implicitly returned
+	if ps.checkTokenType(LEFT_BRACE) {
+		body, err := ps.parseBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		return FunctionExpr{Parameters: params, Body: body.(BlockStmt), Line: line}, nil
+	}
+
+	value, err := ps.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+
+	return FunctionExpr{
 		Parameters: params,
-		Body:       body.(BlockStmt),
+		Body:       BlockStmt{Statements: []Stmt{ReturnStmt{Value: value, Line: line}}, Line: line},
+		Line:       line,
 	}, nil
 }
 
 func (ps *parserState) parseStmt() (Stmt, error) {
-	switch ps.peekToken().type_ {
+	if err := ps.enter(); err != nil {
+		return nil, err
+	}
+	defer ps.leave()
+
+	switch ps.peekToken().Type {
 	case PRINT:
 		return ps.parsePrint()
 	case WHILE:
@@ -229,12 +528,15 @@ func (ps *parserState) parseStmt() (Stmt, error) {
 		return ps.parseBlock()
 	case IF:
 		return ps.parseIf()
+	case MATCH:
+		return ps.parseMatch()
 	default:
 		return ps.parseExprStmt()
 	}
 }
 
 func (ps *parserState) parseExprStmt() (Stmt, error) {
+	line := ps.peekToken().Start.Line
 	expr, err := ps.parseExpr()
 	if err != nil {
 		return nil, err
@@ -245,10 +547,11 @@ func (ps *parserState) parseExprStmt() (Stmt, error) {
 		return nil, err
 	}
 
-	return ExprStmt{expr}, nil
+	return ExprStmt{Expr: expr, Line: line}, nil
 }
 
 func (ps *parserState) parseIf() (Stmt, error) {
+	line, column := ps.peekToken().Start.Line, ps.peekToken().Start.Column
 	err := ps.consumeToken(IF, "Expected 'if' keyword to start if statement")
 	if err != nil {
 		return nil, err
@@ -282,10 +585,196 @@ func (ps *parserState) parseIf() (Stmt, error) {
 		}
 	}
 
-	return IfStmt{Condition: condition, ThenBranch: thenStmt, ElseBranch: elseStmt}, nil
+	return IfStmt{Condition: condition, ThenBranch: thenStmt, ElseBranch: elseStmt, Line: line, Column: column}, nil
+}
+
+func (ps *parserState) parseMatch() (Stmt, error) {
+	line := ps.peekToken().Start.Line
+	err := ps.consumeToken(MATCH, "Expected 'match'")
+	if err != nil {
+		return nil, err
+	}
+
+	err = ps.consumeToken(LEFT_PAREN, "Expected '(' after match")
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := ps.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ps.consumeToken(RIGHT_PAREN, "Expected ')' after match subject")
+	if err != nil {
+		return nil, err
+	}
+
+	err = ps.consumeToken(LEFT_BRACE, "Expected '{' to open match body")
+	if err != nil {
+		return nil, err
+	}
+
+	cases := make([]MatchCase, 0)
+	for !ps.matchToken(RIGHT_BRACE) {
+		err = ps.consumeToken(CASE, "Expected 'case' in match body")
+		if err != nil {
+			return nil, err
+		}
+
+		pattern, err := ps.parsePattern()
+		if err != nil {
+			return nil, err
+		}
+
+		// Guards stop short of assignments and conditionals so that an
+		// identifier before '=>' isn't mistaken for an arrow function
+		var guard Expr
+		if ps.matchToken(IF) {
+			guard, err = ps.parseCoalesce()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = ps.consumeToken(ARROW, "Expected '=>' after case pattern")
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := ps.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+
+		cases = append(cases, MatchCase{Pattern: pattern, Guard: guard, Body: body})
+	}
+
+	return MatchStmt{Subject: subject, Cases: cases, Line: line, EndLine: ps.previous().Start.Line}, nil
+}
+
+func (ps *parserState) parsePattern() (Pattern, error) {
+	if err := ps.enter(); err != nil {
+		return nil, err
+	}
+	defer ps.leave()
+
+	switch {
+	case ps.matchToken(IDENTIFIER):
+		name := ps.previous().Lexeme
+		if name == "_" {
+			return WildcardPattern{}, nil
+		}
+
+		// Capitalized names are types, anything else binds the value
+		if !unicode.IsUpper([]rune(name)[0]) {
+			return BindingPattern{Name: name}, nil
+		}
+		pattern := TypePattern{TypeName: name}
+		if ps.matchToken(IDENTIFIER) {
+			pattern.Binding = ps.previous().Lexeme
+		}
+		return pattern, nil
+	case ps.checkTokenType(NIL), ps.checkTokenType(TRUE), ps.checkTokenType(FALSE),
+		ps.checkTokenType(NUMBER), ps.checkTokenType(STRING):
+		value, err := ps.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return LiteralPattern{Value: value}, nil
+	case ps.checkTokenType(MINUS) && ps.checkNextTokenType(NUMBER):
+		value, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return LiteralPattern{Value: value}, nil
+	case ps.matchToken(LEFT_BRACKET):
+		return ps.parseListPattern()
+	case ps.matchToken(LEFT_BRACE):
+		return ps.parseMapPattern()
+	}
+
+	return nil, ParseError{message: "Expected pattern after 'case'"}
+}
+
+func (ps *parserState) parseListPattern() (Pattern, error) {
+	pattern := ListPattern{Elements: make([]Pattern, 0)}
+	for !ps.matchToken(RIGHT_BRACKET) {
+		if pattern.HasRest {
+			return nil, ParseError{message: "Rest pattern must be the last element"}
+		}
+
+		if ps.matchToken(ELLIPSIS) {
+			err := ps.consumeToken(IDENTIFIER, "Expected identifier after '...'")
+			if err != nil {
+				return nil, err
+			}
+			pattern.HasRest = true
+			pattern.Rest = ps.previous().Lexeme
+		} else {
+			element, err := ps.parsePattern()
+			if err != nil {
+				return nil, err
+			}
+			pattern.Elements = append(pattern.Elements, element)
+		}
+
+		if !ps.matchToken(COMMA) {
+			err := ps.consumeToken(RIGHT_BRACKET, "Expected ']' to close list pattern")
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	return pattern, nil
+}
+
+func (ps *parserState) parseMapPattern() (Pattern, error) {
+	pattern := MapPattern{Entries: make([]MapPatternEntry, 0)}
+	for !ps.matchToken(RIGHT_BRACE) {
+		var entry MapPatternEntry
+		if ps.matchToken(IDENTIFIER) {
+			name := ps.previous().Lexeme
+			entry.Key = NewLiteralExpr(name)
+			// `{name}` is shorthand for `{name: name}`
+			entry.Pattern = BindingPattern{Name: name}
+		} else if ps.checkTokenType(STRING) || ps.checkTokenType(NUMBER) {
+			key, err := ps.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			entry.Key = key
+		} else {
+			return nil, ParseError{message: "Expected key in map pattern"}
+		}
+
+		if ps.matchToken(COLON) {
+			value, err := ps.parsePattern()
+			if err != nil {
+				return nil, err
+			}
+			entry.Pattern = value
+		} else if entry.Pattern == nil {
+			return nil, ParseError{message: "Expected ':' after map pattern key"}
+		}
+		pattern.Entries = append(pattern.Entries, entry)
+
+		if !ps.matchToken(COMMA) {
+			err := ps.consumeToken(RIGHT_BRACE, "Expected '}' to close map pattern")
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	return pattern, nil
 }
 
 func (ps *parserState) parseWhile() (Stmt, error) {
+	line, column := ps.peekToken().Start.Line, ps.peekToken().Start.Column
 	err := ps.consumeToken(WHILE, "Expected 'while' to start")
 	if err != nil {
 		return nil, err
@@ -314,25 +803,37 @@ func (ps *parserState) parseWhile() (Stmt, error) {
 	return WhileStmt{
 		Condition: expr,
 		Body:      stmt,
+		Line:      line,
+		Column:    column,
 	}, nil
 }
 
 func (ps *parserState) parseReturn() (Stmt, error) {
+	line := ps.peekToken().Start.Line
 	err := ps.consumeToken(RETURN, "Expected 'return'")
 	if err != nil {
 		return nil, err
 	}
 
+	// A bare return yields nil
+	if ps.matchToken(SEMICOLON) || ps.checkTokenType(RIGHT_BRACE) {
+		return ReturnStmt{Line: line}, nil
+	}
+
 	expr, err := ps.parseExpr()
 	if err != nil {
 		return nil, err
 	}
 
-	return ReturnStmt{Value: expr}, nil
+	// The trailing semicolon is optional
+	ps.matchToken(SEMICOLON)
+
+	return ReturnStmt{Value: expr, Line: line}, nil
 }
 
 // Parse a for loop as a desugared while because we can
 func (ps *parserState) parseFor() (Stmt, error) {
+	line, column := ps.peekToken().Start.Line, ps.peekToken().Start.Column
 	err := ps.consumeToken(FOR, "Expected 'for' to start loop")
 	if err != nil {
 		return nil, err
@@ -343,9 +844,17 @@ func (ps *parserState) parseFor() (Stmt, error) {
 		return nil, err
 	}
 
+	// `for (var x in xs)` or `for (x in xs)`
+	start := ps.current
+	ps.matchToken(VAR)
+	if ps.matchToken(IDENTIFIER) && ps.matchToken(IN) {
+		return ps.parseForIn(ps.tokens[ps.current-2].Lexeme, line)
+	}
+	ps.current = start
+
 	// Pull out the init
 	var init Stmt
-	if ps.peekToken().type_ == VAR {
+	if ps.peekToken().Type == VAR {
 		init, err = ps.parseDeclaration()
 		if err != nil {
 			return nil, err
@@ -396,7 +905,8 @@ func (ps *parserState) parseFor() (Stmt, error) {
 	// Add the increment to the end of the while
 	if increment != nil {
 		body = BlockStmt{
-			Statements: []Stmt{body, ExprStmt{Expr: increment}},
+			Statements: []Stmt{body, ExprStmt{Expr: increment, Line: line}},
+			Line:       line,
 		}
 	}
 
@@ -407,16 +917,39 @@ func (ps *parserState) parseFor() (Stmt, error) {
 	body = WhileStmt{
 		Condition: cond,
 		Body:      body,
+		Line:      line,
+		Column:    column,
 	}
 
 	if init != nil {
-		body = BlockStmt{Statements: []Stmt{init, body}}
+		body = BlockStmt{Statements: []Stmt{init, body}, Line: line}
 	}
 
 	return body, nil
 }
 
+// Parses the rest of a for-in loop after the `in`
+func (ps *parserState) parseForIn(name string, line int) (Stmt, error) {
+	iterable, err := ps.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ps.consumeToken(RIGHT_PAREN, "Expected ')' after for-in iterable")
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ps.parseStmt()
+	if err != nil {
+		return nil, err
+	}
+
+	return ForInStmt{Name: name, Iterable: iterable, Body: body, Line: line}, nil
+}
+
 func (ps *parserState) parsePrint() (Stmt, error) {
+	line := ps.peekToken().Start.Line
 	err := ps.consumeToken(PRINT, "Expected 'print'")
 	if err != nil {
 		return nil, err
@@ -431,10 +964,11 @@ func (ps *parserState) parsePrint() (Stmt, error) {
 		return nil, err
 	}
 
-	return PrintStmt{expr}, nil
+	return PrintStmt{Expr: expr, Line: line}, nil
 }
 
 func (ps *parserState) parseBlock() (Stmt, error) {
+	line := ps.peekToken().Start.Line
 	err := ps.consumeToken(LEFT_BRACE, "Expected block to start with '{'")
 	if err != nil {
 		return nil, err
@@ -449,7 +983,7 @@ func (ps *parserState) parseBlock() (Stmt, error) {
 		stmts = append(stmts, s)
 	}
 
-	return BlockStmt{Statements: stmts}, nil
+	return BlockStmt{Statements: stmts, Line: line, EndLine: ps.previous().Start.Line}, nil
 }
 
 func (ps *parserState) parseExpr() (Expr, error) {
@@ -462,8 +996,21 @@ func (ps *parserState) parseExpr() (Expr, error) {
 }
 
 func (ps *parserState) parseAssignment() (Expr, error) {
+	if err := ps.enter(); err != nil {
+		return nil, err
+	}
+	defer ps.leave()
+
+	if ps.isArrowFunction() {
+		return ps.parseArrowFunction()
+	}
+
+	if ps.matchToken(YIELD) {
+		return ps.parseYield()
+	}
+
 	// This parses the lefthand side of the assignment
-	expr, err := ps.parseOr()
+	expr, err := ps.parseConditional()
 	if err != nil {
 		return nil, err
 	}
@@ -477,14 +1024,24 @@ func (ps *parserState) parseAssignment() (Expr, error) {
 			return nil, err
 		}
 
-		// If the LHS is a variable, we can assign to it
-		v, ok := expr.(VarExpr)
-		if ok {
+		switch target := expr.(type) {
+		case VarExpr:
 			return AssignExpr{
-				Name:  v.Name,
+				Name:  target.Name,
 				Value: value,
 			}, nil
-
+		case GetExpr:
+			return SetExpr{
+				Object: target.Object,
+				Name:   target.Name,
+				Value:  value,
+			}, nil
+		case IndexExpr:
+			return IndexSetExpr{
+				Object: target.Object,
+				Index:  target.Index,
+				Value:  value,
+			}, nil
 		}
 		return nil, ParseError{
 			message: "Invalid assignment target",
@@ -492,6 +1049,104 @@ func (ps *parserState) parseAssignment() (Expr, error) {
 		}
 	}
 
+	if ps.matchToken(PLUS_EQUAL, MINUS_EQUAL, STAR_EQUAL, SLASH_EQUAL, PERCENT_EQUAL) {
+		opToken := ps.previous()
+		if !isAssignable(expr) {
+			return nil, ParseError{
+				message: "Invalid compound assignment target",
+				token:   opToken,
+			}
+		}
+
+		value, err := ps.parseAssignment()
+		if err != nil {
+			return nil, err
+		}
+
+		return CompoundAssignExpr{
+			Target:    expr,
+			Operation: compoundOperators[opToken.Type],
+			Value:     value,
+		}, nil
+	}
+
+	return expr, nil
+}
+
+// Maps compound assignment tokens to the operator they apply
+var compoundOperators = map[TokenType]TokenType{
+	PLUS_EQUAL:    PLUS,
+	MINUS_EQUAL:   MINUS,
+	STAR_EQUAL:    STAR,
+	SLASH_EQUAL:   SLASH,
+	PERCENT_EQUAL: PERCENT,
+}
+
+// Whether the expression can be the target of a compound assignment
+// or an increment
+func isAssignable(expr Expr) bool {
+	switch expr.(type) {
+	case VarExpr, GetExpr, IndexExpr:
+		return true
+	}
+	return false
+}
+
+func (ps *parserState) parseConditional() (Expr, error) {
+	expr, err := ps.parseCoalesce()
+	if err != nil {
+		return nil, err
+	}
+
+	if !ps.matchToken(QUESTION) {
+		return expr, nil
+	}
+
+	thenExpr, err := ps.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ps.consumeToken(COLON, "Expected ':' in conditional expression")
+	if err != nil {
+		return nil, err
+	}
+
+	// Parsing the else branch as an assignment makes this right-associative
+	elseExpr, err := ps.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+
+	return ConditionalExpr{
+		Condition: expr,
+		ThenExpr:  thenExpr,
+		ElseExpr:  elseExpr,
+	}, nil
+}
+
+func (ps *parserState) parseCoalesce() (Expr, error) {
+	expr, err := ps.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	for ps.matchToken(QUESTION_QUESTION) {
+		tok := ps.previous()
+		rhs, err := ps.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		expr = LogicalExpr{
+			Operation: QUESTION_QUESTION,
+			Lhs:       expr,
+			Rhs:       rhs,
+			Line:      tok.Start.Line,
+			Column:    tok.Start.Column,
+		}
+	}
+
 	return expr, nil
 }
 
@@ -502,7 +1157,6 @@ func (ps *parserState) parseOr() (Expr, error) {
 	}
 
 	for ps.matchToken(OR) {
-		fmt.Println("parsing or")
 		tok := ps.previous()
 		rhs, err := ps.parseAnd()
 		if err != nil {
@@ -510,9 +1164,11 @@ func (ps *parserState) parseOr() (Expr, error) {
 		}
 
 		expr = LogicalExpr{
-			Operation: tok.type_,
+			Operation: tok.Type,
 			Lhs:       expr,
 			Rhs:       rhs,
+			Line:      tok.Start.Line,
+			Column:    tok.Start.Column,
 		}
 	}
 
@@ -533,9 +1189,11 @@ func (ps *parserState) parseAnd() (Expr, error) {
 		}
 
 		expr = LogicalExpr{
-			Operation: tok.type_,
+			Operation: tok.Type,
 			Lhs:       expr,
 			Rhs:       rhs,
+			Line:      tok.Start.Line,
+			Column:    tok.Start.Column,
 		}
 	}
 
@@ -548,8 +1206,8 @@ func (ps *parserState) parseEquality() (Expr, error) {
 		return nil, err
 	}
 
-	for ps.matchToken(EQUAL_EQUAL) {
-		op := ps.previous().type_
+	for ps.matchToken(EQUAL_EQUAL, BANG_EQUAL) {
+		op := ps.previous().Type
 		rhs, err := ps.parseComparison()
 		if err != nil {
 			return nil, err
@@ -566,14 +1224,14 @@ func (ps *parserState) parseEquality() (Expr, error) {
 }
 
 func (ps *parserState) parseComparison() (Expr, error) {
-	expr, err := ps.parseTerm()
+	expr, err := ps.parseBitOr()
 	if err != nil {
 		return nil, err
 	}
 
 	for ps.matchToken(LESS, LESS_EQUAL, GREATER_EQUAL, GREATER) {
-		op := ps.previous().type_
-		rhs, err := ps.parseTerm()
+		op := ps.previous().Type
+		rhs, err := ps.parseBitOr()
 		if err != nil {
 			return nil, err
 		}
@@ -587,6 +1245,49 @@ func (ps *parserState) parseComparison() (Expr, error) {
 	return expr, nil
 }
 
+// Bitwise operators bind tighter than comparisons, so `a & 1 == 0`
+// means `(a & 1) == 0`
+func (ps *parserState) parseBitOr() (Expr, error) {
+	return ps.parseBinaryLevel(ps.parseBitXor, PIPE)
+}
+
+func (ps *parserState) parseBitXor() (Expr, error) {
+	return ps.parseBinaryLevel(ps.parseBitAnd, CARET)
+}
+
+func (ps *parserState) parseBitAnd() (Expr, error) {
+	return ps.parseBinaryLevel(ps.parseShift, AMPERSAND)
+}
+
+func (ps *parserState) parseShift() (Expr, error) {
+	return ps.parseBinaryLevel(ps.parseTerm, LESS_LESS, GREATER_GREATER)
+}
+
+// Parses a left-associative chain of binary operators at one
+// precedence level
+func (ps *parserState) parseBinaryLevel(next func() (Expr, error), ops ...TokenType) (Expr, error) {
+	expr, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	for ps.matchToken(ops...) {
+		op := ps.previous().Type
+		rhs, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		expr = BinaryExpr{
+			op,
+			expr,
+			rhs,
+		}
+	}
+
+	return expr, nil
+}
+
 func (ps *parserState) parseTerm() (Expr, error) {
 	expr, err := ps.parseFactor()
 	if err != nil {
@@ -594,7 +1295,7 @@ func (ps *parserState) parseTerm() (Expr, error) {
 	}
 
 	for ps.matchToken(PLUS, MINUS) {
-		op := ps.previous().type_
+		op := ps.previous().Type
 		rhs, err := ps.parseFactor()
 		if err != nil {
 			return nil, err
@@ -616,8 +1317,8 @@ func (ps *parserState) parseFactor() (Expr, error) {
 		return nil, err
 	}
 
-	for ps.matchToken(SLASH, STAR) {
-		op := ps.previous().type_
+	for ps.matchToken(SLASH, STAR, PERCENT, TILDE_SLASH) {
+		op := ps.previous().Type
 		rhs, err := ps.parseUnary()
 		if err != nil {
 			return nil, err
@@ -634,58 +1335,195 @@ func (ps *parserState) parseFactor() (Expr, error) {
 }
 
 func (ps *parserState) parseUnary() (Expr, error) {
-	if ps.matchToken(MINUS, BANG) {
-		expr, err := ps.parsePrimary()
+	if err := ps.enter(); err != nil {
+		return nil, err
+	}
+	defer ps.leave()
+
+	if ps.matchToken(MINUS, BANG, TILDE) {
+		op := ps.previous().Type
+		expr, err := ps.parseUnary()
 		if err != nil {
 			return nil, err
 		}
 
-		return UnaryExpr{ps.previous().type_, expr}, nil
+		return UnaryExpr{op, expr}, nil
 	}
 
+	if ps.matchToken(AWAIT) {
+		operand, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return AwaitExpr{operand}, nil
+	}
+
+	if ps.matchToken(SPAWN) {
+		expr, err := ps.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+
+		call, ok := expr.(CallExpr)
+		if !ok {
+			return nil, ParseError{message: "Expected a function call after 'spawn'"}
+		}
+		return SpawnExpr{call}, nil
+	}
+
+	if ps.matchToken(PLUS_PLUS, MINUS_MINUS) {
+		op := ps.previous()
+		target, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return newIncrement(op, target, true)
+	}
+
+	return ps.parsePower()
+}
+
+// Exponentiation binds tighter than unary minus on its left, so
+// `-2 ** 2` is -4, and is right-associative
+func (ps *parserState) parsePower() (Expr, error) {
+	expr, err := ps.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+
+	if ps.matchToken(STAR_STAR) {
+		rhs, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return BinaryExpr{STAR_STAR, expr, rhs}, nil
+	}
+
+	return expr, nil
+}
+
+func (ps *parserState) parsePostfix() (Expr, error) {
 	expr, err := ps.parseCall()
 	if err != nil {
 		return nil, err
 	}
+
+	if ps.matchToken(PLUS_PLUS, MINUS_MINUS) {
+		return newIncrement(ps.previous(), expr, false)
+	}
+
 	return expr, nil
 }
 
+func newIncrement(op Token, target Expr, prefix bool) (Expr, error) {
+	if !isAssignable(target) {
+		return nil, ParseError{
+			message: fmt.Sprintf("Invalid '%s' target", op.Lexeme),
+			token:   op,
+		}
+	}
+
+	operation := TokenType(PLUS)
+	if op.Type == MINUS_MINUS {
+		operation = MINUS
+	}
+
+	return IncrementExpr{Target: target, Operation: operation, Prefix: prefix}, nil
+}
+
 func (ps *parserState) parseCall() (Expr, error) {
 	callee, err := ps.parsePrimary()
 	if err != nil {
 		return nil, err
 	}
 
-	for ps.matchToken(LEFT_PAREN) {
-		arguments := make([]Expr, 0)
-		if !ps.checkTokenType(RIGHT_PAREN) {
-			for {
-				expr, err := ps.parseExpr()
-				if err != nil {
-					return nil, err
-				}
-				arguments = append(arguments, expr)
+	optional := false
+	for {
+		if ps.matchToken(LEFT_PAREN) {
+			arguments, err := ps.parseArguments(RIGHT_PAREN)
+			if err != nil {
+				return nil, err
+			}
 
-				if len(arguments) > MAX_FUNCTION_ARGS {
-					err = ParseError{message: fmt.Sprintf("Can't have more that %d function arguments", len(arguments))}
-					return nil, err
-				}
+			if len(arguments) > MAX_FUNCTION_ARGS {
+				err = ParseError{message: fmt.Sprintf("Can't have more that %d function arguments", len(arguments))}
+				return nil, err
+			}
 
-				if !ps.matchToken(COMMA) {
-					break
-				}
+			err = ps.consumeToken(RIGHT_PAREN, "Expected ) to close function call")
+			if err != nil {
+				return nil, err
 			}
+
+			callee = CallExpr{Callee: callee, Args: arguments}
+		} else if ps.matchToken(LEFT_BRACKET) {
+			index, err := ps.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			err = ps.consumeToken(RIGHT_BRACKET, "Expected ] to close index")
+			if err != nil {
+				return nil, err
+			}
+
+			callee = IndexExpr{Object: callee, Index: index}
+		} else if ps.matchToken(DOT) {
+			err := ps.consumePropertyName("Expected property name after '.'")
+			if err != nil {
+				return nil, err
+			}
+
+			callee = GetExpr{Object: callee, Name: ps.previous().Lexeme}
+		} else if ps.matchToken(QUESTION_DOT) {
+			err := ps.consumePropertyName("Expected property name after '?.'")
+			if err != nil {
+				return nil, err
+			}
+
+			callee = GetExpr{Object: callee, Name: ps.previous().Lexeme, Optional: true}
+			optional = true
+		} else {
+			break
 		}
+	}
 
-		err := ps.consumeToken(RIGHT_PAREN, "Expected ) to close function call")
+	// The whole chain short-circuits, so `a?.b.c` is nil when a is nil
+	if optional {
+		return OptionalChainExpr{Expr: callee}, nil
+	}
+
+	return callee, nil
+}
+
+// Parses a comma separated list of expressions up to (but not including)
+// the closing token. Each entry may be spread with '...'
+func (ps *parserState) parseArguments(closing TokenType) ([]Expr, error) {
+	arguments := make([]Expr, 0)
+	if ps.checkTokenType(closing) {
+		return arguments, nil
+	}
+
+	for {
+		spread := ps.matchToken(ELLIPSIS)
+		expr, err := ps.parseExpr()
 		if err != nil {
 			return nil, err
 		}
+		if spread {
+			expr = SpreadExpr{Operand: expr}
+		}
+		arguments = append(arguments, expr)
 
-		callee = CallExpr{Callee: callee, Args: arguments}
+		if !ps.matchToken(COMMA) {
+			break
+		}
 	}
 
-	return callee, nil
+	return arguments, nil
 }
 
 func (ps *parserState) parsePrimary() (Expr, error) {
@@ -700,22 +1538,77 @@ func (ps *parserState) parsePrimary() (Expr, error) {
 	}
 
 	if ps.matchToken(IDENTIFIER) {
-		return VarExpr{Name: ps.previous().lexeme}, nil
+		return VarExpr{Name: ps.previous().Lexeme}, nil
+	}
+
+	if ps.matchToken(THIS) {
+		return ThisExpr{}, nil
+	}
+
+	isAsync := ps.checkTokenType(ASYNC) && ps.checkNextTokenType(FUN)
+	if isAsync {
+		ps.advanceToken()
+	}
+	if ps.matchToken(FUN) {
+		line := ps.previous().Start.Line
+		generator, err := ps.parseGeneratorStar(isAsync)
+		if err != nil {
+			return nil, err
+		}
+		params, body, err := ps.parseFunctionRest()
+		if err != nil {
+			return nil, err
+		}
+
+		return FunctionExpr{Parameters: params, Body: body, IsGenerator: generator, IsAsync: isAsync, Line: line}, nil
 	}
 
 	if ps.matchToken(NUMBER) {
-		result, err := strconv.ParseFloat(ps.previous().lexeme, 64)
+		switch n := ps.previous().Literal.(type) {
+		case int64:
+			return NewLiteralExpr(n), nil
+		case *big.Int:
+			return NewLiteralExpr(n), nil
+		case *big.Rat:
+			return NewLiteralExpr(n), nil
+		case float64:
+			return NewLiteralExpr(n), nil
+		}
+		return nil, ParseError{message: "Invalid number literal"}
+	}
+
+	if ps.matchToken(STRING) {
+		return NewLiteralExpr(ps.previous().Literal.(string)), nil
+	}
+
+	if ps.matchToken(REGEX) {
+		lexeme := ps.previous().Lexeme
+		end := strings.LastIndex(lexeme, "/")
+		regex, err := NewLoxRegex(lexeme[1:end], lexeme[end+1:])
 		if err != nil {
 			return nil, ParseError{
-				message: "Expected float",
+				message: fmt.Sprintf("Invalid regex %s: %v", lexeme, err),
 			}
 		}
+		return RegexExpr{Regex: regex}, nil
+	}
 
-		return NewLiteralExpr(result), nil
+	if ps.matchToken(LEFT_BRACE) {
+		return ps.parseMap()
 	}
 
-	if ps.matchToken(STRING) {
-		return NewLiteralExpr(ps.previous().lexeme), nil
+	if ps.matchToken(LEFT_BRACKET) {
+		elements, err := ps.parseArguments(RIGHT_BRACKET)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ps.consumeToken(RIGHT_BRACKET, "Expected ] to close list")
+		if err != nil {
+			return nil, err
+		}
+
+		return ListExpr{Elements: elements}, nil
 	}
 
 	if ps.matchToken(LEFT_PAREN) {
@@ -734,3 +1627,43 @@ func (ps *parserState) parsePrimary() (Expr, error) {
 
 	return nil, ParseError{message: "Couldn't parse expression"}
 }
+
+// Parses a map literal after its opening brace. Bare identifier keys
+// are shorthand for string keys, so `{a: 1}` is `{"a": 1}`
+func (ps *parserState) parseMap() (Expr, error) {
+	entries := make([]MapEntry, 0)
+	for !ps.matchToken(RIGHT_BRACE) {
+		var key Expr
+		if ps.checkTokenType(IDENTIFIER) && ps.checkNextTokenType(COLON) {
+			ps.advanceToken()
+			key = NewLiteralExpr(ps.previous().Lexeme)
+		} else {
+			var err error
+			key, err = ps.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := ps.consumeToken(COLON, "Expected ':' after map key")
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := ps.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, MapEntry{Key: key, Value: value})
+
+		if !ps.matchToken(COMMA) {
+			err := ps.consumeToken(RIGHT_BRACE, "Expected '}' to close map")
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	return MapExpr{Entries: entries}, nil
+}
@@ -6,30 +6,31 @@ import (
 	"testing"
 
 	"github.com/gkampitakis/go-snaps/snaps"
+	"github.com/matryer/is"
 )
 
-func TestParseSnapshot(t *testing.T) {
-	testCases := []struct {
-		source string
-	}{
-		{`
+// Sources for the parser snapshots, also used to seed the fuzz tests
+var parseCases = []struct {
+	source string
+}{
+	{`
 1;
         `},
-		{`
+	{`
 1 + 1;
         `},
-		{`
+	{`
 var a = 1;
         `},
-		{`
+	{`
 fun foo() {}
         `},
-		{`
+	{`
 fun foo() {
 print "hello";
 }
         `},
-		{`
+	{`
 var a = 1;
 {
 var a = 2;
@@ -37,17 +38,77 @@ print a;
 }
 print a;
         `},
-		{`
+	{`
 class Foo {}
         `},
-		{`
+	{`
 class Foo {
 bar() {}
 }
         `},
-	}
+	{`
+var f = fun (a) { return a; };
+        `},
+	{`
+var f = (a, b) => a + b;
+        `},
+	{`
+fun f(a, b = 1, ...rest) {}
+        `},
+	{`
+f(1, ...xs)[0];
+        `},
+	{`
+-a ** b ** c;
+        `},
+	{`
+a.b[0] += i++;
+        `},
+	{`
+a ?? b ? c : d;
+        `},
+	{`
+a?.b.c();
+        `},
+	{`
+match (v) {
+case [a, ...rest] if a > 0 => print a;
+case {"k": Point p, n} => print n;
+case _ => {}
+}
+        `},
+	{`
+var m = {a: 1, "b": 2};
+        `},
+	{`
+var r = /(?P<year>\d+)-\d+/i;
+print 6 / 3 / r.source;
+        `},
+	{`
+fun* count(n) {
+var sent = yield;
+yield n + sent;
+}
+for (var x in count(1)) print x;
+for (x in fun* () { yield; }()) {}
+        `},
+	{`
+var t = spawn work(1, ...rest);
+print await t + 1;
+        `},
+	{`
+async fun load(url) { return await fetch(url); }
+class Api { async get() {} }
+var f = async fun () {};
+        `},
+	{`
+import "lib/util.lox" as util;
+export fun f() {}
+        `},
+}
 
-	for _, tc := range testCases {
+func TestParseSnapshot(t *testing.T) {
+	for _, tc := range parseCases {
 		s := snaps.WithConfig()
 
 		t.Run(fmt.Sprintf("Parse(%q)", strings.Trim(tc.source, " \n")), func(t *testing.T) {
@@ -67,3 +128,27 @@ bar() {}
 		})
 	}
 }
+
+func TestParseNesting(t *testing.T) {
+	is := is.New(t)
+
+	deep := []string{
+		"print " + strings.Repeat("(", 100000) + "1;",
+		"print " + strings.Repeat("- ", 100000) + "1;",
+		strings.Repeat("{", 100000),
+		strings.Repeat("if (true) ", 100000) + "print 1;",
+		"match (x) { case " + strings.Repeat("[", 100000) + " => 1; }",
+	}
+	for _, source := range deep {
+		tokens, err := ScanTokens(source)
+		is.NoErr(err)
+		_, err = Parse(tokens)
+		is.Equal(err.(ParseError).message, "Nested more than 1000 levels deep")
+	}
+
+	// Anything a person would write is well within the limit
+	tokens, err := ScanTokens("print " + strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100) + ";")
+	is.NoErr(err)
+	_, err = Parse(tokens)
+	is.NoErr(err)
+}
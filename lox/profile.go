@@ -0,0 +1,455 @@
+package lox
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profiler attributes the time a script takes and the values it
+// allocates to the Lox functions and lines responsible. Set it as the
+// Profiler of a RuntimeState before running, then write what it found
+// with WriteProfile or WriteSummary.
+//
+// It's instrumenting rather than sampling: time is charged to the line
+// that was running whenever the next statement starts or a call begins
+// or returns. Time spent in natives, sleeping or waiting on other tasks
+// goes to the line that called them.
+type Profiler struct {
+	mu    sync.Mutex
+	now   func() time.Time
+	start time.Time
+	last  time.Time
+	// The stack that's been running since last
+	running *profileFrame
+
+	functions map[profileFunction]uint64
+	locations map[profileLocation]uint64
+	samples   map[string]*profileSample
+	// In the order they were first seen, so profiles are stable
+	functionList []profileFunction
+	locationList []profileLocation
+	sampleList   []*profileSample
+}
+
+// A Lox function, or "main" for the top level of a script
+type profileFunction struct {
+	name string
+	file string
+	line int
+}
+
+// A line within a function
+type profileLocation struct {
+	function uint64
+	line     int
+}
+
+// What was spent with a particular call stack
+type profileSample struct {
+	// Location ids, innermost first
+	locations []uint64
+	nanos     int64
+	allocs    int64
+	bytes     int64
+}
+
+// A call in progress. Frames are linked to their caller so a task or
+// generator can keep its own stack on its copy of the runtime state.
+type profileFrame struct {
+	function profileFunction
+	line     int
+	parent   *profileFrame
+}
+
+func NewProfiler() *Profiler {
+	p := &Profiler{
+		now:       time.Now,
+		functions: make(map[profileFunction]uint64),
+		locations: make(map[profileLocation]uint64),
+		samples:   make(map[string]*profileSample),
+	}
+	p.start = p.now()
+	p.last = p.start
+	return p
+}
+
+// Charges the time since the last event to the stack that was running,
+// then makes frame the running one. Must hold mu.
+func (p *Profiler) switchTo(frame *profileFrame) {
+	now := p.now()
+	if p.running != nil {
+		p.sample(p.running).nanos += int64(now.Sub(p.last))
+	}
+	p.last = now
+	p.running = frame
+}
+
+// Stops charging time until the next statement, so time between runs
+// isn't counted
+func (p *Profiler) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.switchTo(nil)
+}
+
+func (p *Profiler) sample(frame *profileFrame) *profileSample {
+	var locations []uint64
+	var key strings.Builder
+	for f := frame; f != nil; f = f.parent {
+		id := p.location(f.function, f.line)
+		locations = append(locations, id)
+		fmt.Fprintf(&key, "%d,", id)
+	}
+
+	s, ok := p.samples[key.String()]
+	if !ok {
+		s = &profileSample{locations: locations}
+		p.samples[key.String()] = s
+		p.sampleList = append(p.sampleList, s)
+	}
+	return s
+}
+
+func (p *Profiler) location(function profileFunction, line int) uint64 {
+	fid, ok := p.functions[function]
+	if !ok {
+		p.functionList = append(p.functionList, function)
+		fid = uint64(len(p.functionList))
+		p.functions[function] = fid
+	}
+
+	loc := profileLocation{function: fid, line: line}
+	id, ok := p.locations[loc]
+	if !ok {
+		p.locationList = append(p.locationList, loc)
+		id = uint64(len(p.locationList))
+		p.locations[loc] = id
+	}
+	return id
+}
+
+// Called as each statement starts
+func (rs *RuntimeState) profileStatement(line int) {
+	p := rs.Profiler
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if rs.frame == nil {
+		rs.frame = &profileFrame{function: profileFunction{name: "main", file: rs.ScriptPath}}
+	}
+	// The time so far belongs to the previous line
+	p.switchTo(rs.frame)
+	rs.frame.line = line
+}
+
+// Pushes a frame for a call to f, returning a function that pops it
+func (rs *RuntimeState) profileCall(f LoxFunction) func() {
+	p := rs.Profiler
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := f.Name
+	if name == "" {
+		name = "anonymous"
+	}
+	caller := rs.frame
+	rs.frame = &profileFrame{
+		function: profileFunction{name: name, file: f.Script, line: f.Line},
+		line:     f.Line,
+		parent:   caller,
+	}
+	p.switchTo(rs.frame)
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.switchTo(caller)
+		rs.frame = caller
+	}
+}
+
+// Counts a value of n bytes allocated by the running line
+func (rs *RuntimeState) profileAlloc(n int64) {
+	if rs.frame == nil {
+		return
+	}
+	p := rs.Profiler
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.sample(rs.frame)
+	s.allocs++
+	s.bytes += n
+}
+
+// Profile types, in the order of each sample's values
+var profileSampleTypes = [][2]string{
+	{"wall", "nanoseconds"},
+	{"alloc_objects", "count"},
+	{"alloc_space", "bytes"},
+}
+
+// WriteProfile writes a gzipped pprof protobuf profile, for `go tool
+// pprof` and flame graph tools
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.switchTo(p.running)
+
+	strs := newStringTable()
+	var b protoBuffer
+	valueType := func(field int, typ, unit string) {
+		b.message(field, func(m *protoBuffer) {
+			m.int64(1, strs.index(typ))
+			m.int64(2, strs.index(unit))
+		})
+	}
+
+	for _, t := range profileSampleTypes {
+		valueType(1, t[0], t[1])
+	}
+	for _, s := range p.sampleList {
+		b.message(2, func(m *protoBuffer) {
+			m.packed(1, s.locations)
+			m.packed(2, []uint64{uint64(s.nanos), uint64(s.allocs), uint64(s.bytes)})
+		})
+	}
+	for i, loc := range p.locationList {
+		b.message(4, func(m *protoBuffer) {
+			m.uint64(1, uint64(i+1))
+			m.message(4, func(line *protoBuffer) {
+				line.uint64(1, loc.function)
+				line.int64(2, int64(loc.line))
+			})
+		})
+	}
+	for i, f := range p.functionList {
+		b.message(5, func(m *protoBuffer) {
+			m.uint64(1, uint64(i+1))
+			m.int64(2, strs.index(f.name))
+			m.int64(3, strs.index(f.name))
+			m.int64(4, strs.index(f.file))
+			m.int64(5, int64(f.line))
+		})
+	}
+	b.int64(9, p.start.UnixNano())
+	b.int64(10, int64(p.last.Sub(p.start)))
+	valueType(11, "wall", "nanoseconds")
+	b.int64(12, 1)
+	b.int64(14, strs.index("wall"))
+	// The string table goes last since everything above adds to it
+	for _, s := range strs.strings {
+		b.string(6, s)
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Totals for a function or line in a summary
+type profileEntry struct {
+	name   string
+	flat   int64
+	cum    int64
+	allocs int64
+	bytes  int64
+}
+
+// WriteSummary writes the n functions and the n lines that took the most
+// time as plain text. Flat time is spent in the function or line
+// itself, cumulative time includes what it called.
+func (p *Profiler) WriteSummary(w io.Writer, n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.switchTo(p.running)
+
+	functions := make(map[string]*profileEntry)
+	lines := make(map[string]*profileEntry)
+	entry := func(entries map[string]*profileEntry, name string) *profileEntry {
+		e, ok := entries[name]
+		if !ok {
+			e = &profileEntry{name: name}
+			entries[name] = e
+		}
+		return e
+	}
+
+	var total, allocs, bytes int64
+	for _, s := range p.sampleList {
+		total += s.nanos
+		allocs += s.allocs
+		bytes += s.bytes
+
+		// Recursive calls only count once towards cumulative time
+		seenFunctions := make(map[string]bool)
+		seenLines := make(map[string]bool)
+		for i, id := range s.locations {
+			loc := p.locationList[id-1]
+			f := p.functionList[loc.function-1]
+			fname := fmt.Sprintf("%s %s", f.name, sourcePosition(f.file, f.line))
+			lname := sourcePosition(f.file, loc.line)
+
+			fe, le := entry(functions, fname), entry(lines, lname)
+			if i == 0 {
+				fe.flat += s.nanos
+				fe.allocs += s.allocs
+				fe.bytes += s.bytes
+				le.flat += s.nanos
+				le.allocs += s.allocs
+				le.bytes += s.bytes
+			}
+			if !seenFunctions[fname] {
+				seenFunctions[fname] = true
+				fe.cum += s.nanos
+			}
+			if !seenLines[lname] {
+				seenLines[lname] = true
+				le.cum += s.nanos
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "Total: %v, %d allocations, %d bytes\n", time.Duration(total), allocs, bytes)
+	writeProfileTable(w, "function", functions, total, n)
+	return writeProfileTable(w, "line", lines, total, n)
+}
+
+func writeProfileTable(w io.Writer, kind string, entries map[string]*profileEntry, total int64, n int) error {
+	sorted := make([]*profileEntry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.flat != b.flat {
+			return a.flat > b.flat
+		}
+		if a.cum != b.cum {
+			return a.cum > b.cum
+		}
+		return a.name < b.name
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	percent := func(d int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(d) / float64(total)
+	}
+
+	fmt.Fprintf(w, "\n%12s %6s %12s %6s %8s %10s  %s\n", "flat", "flat%", "cum", "cum%", "allocs", "bytes", kind)
+	for _, e := range sorted {
+		_, err := fmt.Fprintf(w, "%12v %5.1f%% %12v %5.1f%% %8d %10d  %s\n",
+			time.Duration(e.flat), percent(e.flat), time.Duration(e.cum), percent(e.cum), e.allocs, e.bytes, e.name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Formats a line for display, with the file when it's known. The
+// top level of a script has no line of its own.
+func sourcePosition(file string, line int) string {
+	if line == 0 {
+		return file
+	}
+	if file == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// Profiles reference strings by their index in a table, where the
+// first is always empty
+type stringTable struct {
+	strings []string
+	indices map[string]int64
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{strings: []string{""}, indices: map[string]int64{"": 0}}
+}
+
+func (t *stringTable) index(s string) int64 {
+	i, ok := t.indices[s]
+	if !ok {
+		i = int64(len(t.strings))
+		t.strings = append(t.strings, s)
+		t.indices[s] = i
+	}
+	return i
+}
+
+// protoBuffer encodes the few protobuf wire types a profile needs, to
+// avoid depending on a protobuf library
+type protoBuffer struct {
+	data []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// Zero is the default, so it's left out
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+// Strings are always written, since they may be repeated and the empty
+// one matters in the string table
+func (b *protoBuffer) string(field int, s string) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var m protoBuffer
+	for _, x := range xs {
+		m.varint(x)
+	}
+	b.key(field, wireBytes)
+	b.varint(uint64(len(m.data)))
+	b.data = append(b.data, m.data...)
+}
+
+func (b *protoBuffer) message(field int, encode func(*protoBuffer)) {
+	var m protoBuffer
+	encode(&m)
+	b.key(field, wireBytes)
+	b.varint(uint64(len(m.data)))
+	b.data = append(b.data, m.data...)
+}
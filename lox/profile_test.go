@@ -0,0 +1,158 @@
+package lox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// A profiler whose clock moves forward a millisecond every time it's read
+func newTestProfiler() *Profiler {
+	p := NewProfiler()
+	now := p.start
+	p.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+	return p
+}
+
+func TestProfileSummary(t *testing.T) {
+	is := is.New(t)
+
+	var out, summary bytes.Buffer
+	s := NewRuntimeState()
+	s.OutWriter = &out
+	s.ErrWriter = &out
+	s.ScriptPath = "main.lox"
+	s.Profiler = newTestProfiler()
+
+	err := s.Run(`fun square(x) {
+  return x * x;
+}
+var xs = [];
+for (var i = 0; i < 3; i++) {
+  xs = [...xs, square(i)];
+}
+print xs;`)
+	is.NoErr(err)
+	is.Equal(out.String(), "[0, 1, 4]\n")
+
+	is.NoErr(s.Profiler.WriteSummary(&summary, 3))
+	is.Equal(summary.String(), `Total: 27ms, 4 allocations, 160 bytes
+
+        flat  flat%          cum   cum%   allocs      bytes  function
+        21ms  77.8%         27ms 100.0%        4        160  main main.lox
+         6ms  22.2%          6ms  22.2%        0          0  square main.lox:1
+
+        flat  flat%          cum   cum%   allocs      bytes  line
+        12ms  44.4%         12ms  44.4%        0          0  main.lox:5
+         6ms  22.2%         12ms  44.4%        3        144  main.lox:6
+         4ms  14.8%          4ms  14.8%        0          0  main.lox:1
+`)
+}
+
+func TestProfileStacks(t *testing.T) {
+	is := is.New(t)
+
+	var out bytes.Buffer
+	s := NewRuntimeState()
+	s.OutWriter = &out
+	s.ErrWriter = &out
+	s.Profiler = newTestProfiler()
+
+	err := s.Run(`fun fact(n) {
+  if (n < 2) return 1;
+  return n * fact(n - 1);
+}
+fun* gen() { yield fact(2); }
+print gen().next();`)
+	is.NoErr(err)
+	is.Equal(out.String(), "2\n")
+
+	var stacks []string
+	for _, sample := range s.Profiler.sampleList {
+		stack := ""
+		for _, id := range sample.locations {
+			loc := s.Profiler.locationList[id-1]
+			f := s.Profiler.functionList[loc.function-1]
+			stack += " " + f.name + ":" + strconv.Itoa(loc.line)
+		}
+		stacks = append(stacks, stack)
+	}
+	// Recursion nests, and the generator's body starts its own stack
+	// rather than staying under the call that created it
+	is.Equal(stacks, []string{
+		" main:1",
+		" main:5",
+		" main:6",
+		" gen:5 main:6",
+		" gen:5",
+		" fact:1 gen:5",
+		" fact:2 gen:5",
+		" fact:3 gen:5",
+		" fact:1 fact:3 gen:5",
+		" fact:2 fact:3 gen:5",
+	})
+}
+
+func TestWriteProfile(t *testing.T) {
+	is := is.New(t)
+
+	s := NewRuntimeState()
+	s.OutWriter = io.Discard
+	s.ScriptPath = "loop.lox"
+	s.Profiler = newTestProfiler()
+
+	err := s.Run(`fun f(s) { return s + "!"; }
+for (var i = 0; i < 2; i++) f("x");`)
+	is.NoErr(err)
+
+	var buf bytes.Buffer
+	is.NoErr(s.Profiler.WriteProfile(&buf))
+	gz, err := gzip.NewReader(&buf)
+	is.NoErr(err)
+	data, err := io.ReadAll(gz)
+	is.NoErr(err)
+
+	// Count the top level fields and collect the string table
+	fields := make(map[uint64]int)
+	var strs []string
+	for len(data) > 0 {
+		key, n := readVarint(data)
+		data = data[n:]
+		field, wireType := key>>3, key&7
+		fields[field]++
+
+		value, n := readVarint(data)
+		data = data[n:]
+		if wireType == wireBytes {
+			if field == 6 {
+				strs = append(strs, string(data[:value]))
+			}
+			data = data[value:]
+		}
+	}
+
+	is.Equal(fields[1], 3) // sample types
+	is.Equal(fields[2], 3) // stacks: main at lines 1 and 2, and f under line 2
+	is.Equal(fields[4], 3) // locations
+	is.Equal(fields[5], 2) // functions
+	is.Equal(strs, []string{"", "wall", "nanoseconds", "alloc_objects", "count", "alloc_space", "bytes", "main", "loop.lox", "f"})
+}
+
+func readVarint(data []byte) (uint64, int) {
+	var x uint64
+	for i, b := range data {
+		x |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return x, i + 1
+		}
+	}
+	return x, len(data)
+}
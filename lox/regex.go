@@ -0,0 +1,195 @@
+package lox
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LoxRegex is a compiled regular expression, created by a /.../flags
+// literal or the Regex() builtin. Literals are compiled once when
+// they're parsed, so every evaluation of a literal shares one regex.
+type LoxRegex struct {
+	Source string
+	Flags  string
+	re     *regexp.Regexp
+}
+
+// Flags accepted after a regex literal and by Regex(), which map onto
+// Go's inline flags
+const regexFlags = "ims"
+
+func NewLoxRegex(source string, flags string) (*LoxRegex, error) {
+	for _, flag := range flags {
+		if !strings.ContainsRune(regexFlags, flag) {
+			return nil, fmt.Errorf("unknown regex flag '%c'", flag)
+		}
+	}
+
+	pattern := source
+	if flags != "" {
+		pattern = "(?" + flags + ")" + source
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoxRegex{Source: source, Flags: flags, re: re}, nil
+}
+
+func (r *LoxRegex) String() string {
+	return "/" + r.Source + "/" + r.Flags
+}
+
+// Keeps AST dumps readable instead of printing the compiled program
+func (r *LoxRegex) GoString() string {
+	return fmt.Sprintf("lox.LoxRegex{Source:%q, Flags:%q}", r.Source, r.Flags)
+}
+
+// Looks up a property of a regex, binding methods to it
+func (r *LoxRegex) get(name string) (Value, error) {
+	switch name {
+	case "source":
+		return r.Source, nil
+	case "flags":
+		return r.Flags, nil
+	case "test":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			s, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return r.re.MatchString(s), nil
+		}}, nil
+	case "match":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			s, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			loc := r.re.FindStringSubmatchIndex(s)
+			if loc == nil {
+				return Null(nil), nil
+			}
+			return r.groups(s, loc), nil
+		}}, nil
+	case "matchAll":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			s, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			matches := make([]Value, 0)
+			for _, loc := range r.re.FindAllStringSubmatchIndex(s, -1) {
+				matches = append(matches, r.groups(s, loc))
+			}
+			return NewLoxList(matches), nil
+		}}, nil
+	case "replace":
+		return &NativeFunction{Name: name, MinArity: 2, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			s, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return r.replace(rs, s, args[1])
+		}}, nil
+	case "split":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			s, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return stringList(r.re.Split(s, -1)), nil
+		}}, nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined regex property '%s'", name)}
+}
+
+// Converts the submatch indexes of a match into the value scripts see.
+// That's a list of the whole match followed by each group, or a map
+// from group numbers and names to text when the regex has named groups.
+// Groups that didn't take part in the match are nil.
+func (r *LoxRegex) groups(s string, loc []int) Value {
+	texts := make([]Value, len(loc)/2)
+	for i := range texts {
+		if loc[2*i] < 0 {
+			texts[i] = Null(nil)
+		} else {
+			texts[i] = s[loc[2*i]:loc[2*i+1]]
+		}
+	}
+
+	names := r.re.SubexpNames()
+	named := false
+	for _, name := range names {
+		named = named || name != ""
+	}
+	if !named {
+		return NewLoxList(texts)
+	}
+
+	m := NewLoxMap()
+	for i, text := range texts {
+		m.Set(int64(i), text)
+		if names[i] != "" {
+			m.Set(names[i], text)
+		}
+	}
+	return m
+}
+
+// Replaces every match. The replacement is either a string, which may
+// refer to groups as $1 or ${name}, or a function that's called with
+// each match's groups and returns the replacement text.
+func (r *LoxRegex) replace(rs *RuntimeState, s string, replacement Value) (Value, error) {
+	switch repl := replacement.(type) {
+	case string:
+		return r.re.ReplaceAllString(s, repl), nil
+	case LoxCallable:
+		var out strings.Builder
+		last := 0
+		for _, loc := range r.re.FindAllStringSubmatchIndex(s, -1) {
+			result, err := rs.call(repl, []Value{r.groups(s, loc)})
+			if err != nil {
+				return nil, err
+			}
+			text, ok := result.(string)
+			if !ok {
+				return nil, RuntimeError{
+					message: fmt.Sprintf("replace() callback must return a string, got %s", reprValue(result)),
+				}
+			}
+
+			out.WriteString(s[last:loc[0]])
+			out.WriteString(text)
+			last = loc[1]
+		}
+		out.WriteString(s[last:])
+		return out.String(), nil
+	}
+
+	return nil, argError("replace", 1, "a string or function", replacement)
+}
+
+// The Regex(pattern, flags) builtin
+var regexConstructor = &NativeFunction{Name: "Regex", MinArity: 1, MaxArity: 2, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+	source, err := stringArg("Regex", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	flags := ""
+	if len(args) > 1 {
+		flags, err = stringArg("Regex", args, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	regex, err := NewLoxRegex(source, flags)
+	if err != nil {
+		return nil, RuntimeError{message: fmt.Sprintf("Invalid regex: %v", err)}
+	}
+	return regex, nil
+}}
@@ -0,0 +1,227 @@
+package lox
+
+import (
+	"errors"
+	"fmt"
+)
+
+type ResolveError struct {
+	message string
+	line    int
+}
+
+func (e ResolveError) Error() string {
+	return fmt.Sprintf("Resolve Error: %s", e.message)
+}
+
+// Resolve runs static checks over a parsed program that the parser
+// can't do on its own, like finding match cases that can never run.
+func Resolve(node Node) error {
+	r := resolver{}
+	switch n := node.(type) {
+	case ProgramNode:
+		r.resolveStmts(n.Statements)
+	case Stmt:
+		r.resolveStmt(n)
+	}
+
+	return errors.Join(r.errors...)
+}
+
+type resolver struct {
+	errors []error
+	// The line of the statement being resolved, for errors
+	line int
+	// Whether the innermost enclosing function is a generator
+	inGenerator bool
+}
+
+func (r *resolver) report(format string, args ...any) {
+	r.errors = append(r.errors, ResolveError{message: fmt.Sprintf(format, args...), line: r.line})
+}
+
+func (r *resolver) resolveStmts(stmts []Stmt) {
+	for _, stmt := range stmts {
+		r.resolveStmt(stmt)
+	}
+}
+
+func (r *resolver) resolveStmt(stmt Stmt) {
+	if stmt != nil {
+		r.line = stmt.line()
+	}
+	switch s := stmt.(type) {
+	case ExprStmt:
+		r.resolveExpr(s.Expr)
+	case PrintStmt:
+		r.resolveExpr(s.Expr)
+	case BlockStmt:
+		r.resolveStmts(s.Statements)
+	case DeclarationStmt:
+		if s.Expr != nil {
+			r.resolveExpr(*s.Expr)
+		}
+	case FunctionDeclarationStmt:
+		r.resolveFunction(s.Parameters, s.Body, s.IsGenerator)
+	case ClassDeclarationStmt:
+		for _, f := range s.Functions {
+			r.resolveFunction(f.Parameters, f.Body, f.IsGenerator)
+		}
+	case ReturnStmt:
+		r.resolveExpr(s.Value)
+	case IfStmt:
+		r.resolveExpr(s.Condition)
+		r.resolveStmt(s.ThenBranch)
+		r.resolveStmt(s.ElseBranch)
+	case WhileStmt:
+		r.resolveExpr(s.Condition)
+		r.resolveStmt(s.Body)
+	case ForInStmt:
+		r.resolveExpr(s.Iterable)
+		r.resolveStmt(s.Body)
+	case MatchStmt:
+		r.resolveMatch(s)
+	case ExportStmt:
+		r.resolveStmt(s.Declaration)
+	}
+}
+
+func (r *resolver) resolveFunction(params []Parameter, body BlockStmt, isGenerator bool) {
+	enclosing := r.inGenerator
+	r.inGenerator = isGenerator
+	defer func() { r.inGenerator = enclosing }()
+
+	for _, param := range params {
+		r.resolveExpr(param.Default)
+	}
+	r.resolveStmt(body)
+}
+
+func (r *resolver) resolveExprs(exprs []Expr) {
+	for _, expr := range exprs {
+		r.resolveExpr(expr)
+	}
+}
+
+func (r *resolver) resolveExpr(expr Expr) {
+	switch e := expr.(type) {
+	case FunctionExpr:
+		r.resolveFunction(e.Parameters, e.Body, e.IsGenerator)
+	case YieldExpr:
+		if !r.inGenerator {
+			r.report("'yield' can only be used inside a generator function")
+		}
+		r.resolveExpr(e.Value)
+	case CallExpr:
+		r.resolveExpr(e.Callee)
+		r.resolveExprs(e.Args)
+	case UnaryExpr:
+		r.resolveExpr(e.Operand)
+	case GroupingExpr:
+		r.resolveExpr(e.Operand)
+	case BinaryExpr:
+		r.resolveExpr(e.Lhs)
+		r.resolveExpr(e.Rhs)
+	case LogicalExpr:
+		r.resolveExpr(e.Lhs)
+		r.resolveExpr(e.Rhs)
+	case ConditionalExpr:
+		r.resolveExpr(e.Condition)
+		r.resolveExpr(e.ThenExpr)
+		r.resolveExpr(e.ElseExpr)
+	case AssignExpr:
+		r.resolveExpr(e.Value)
+	case SpreadExpr:
+		r.resolveExpr(e.Operand)
+	case ListExpr:
+		r.resolveExprs(e.Elements)
+	case MapExpr:
+		for _, entry := range e.Entries {
+			r.resolveExpr(entry.Key)
+			r.resolveExpr(entry.Value)
+		}
+	case IndexExpr:
+		r.resolveExpr(e.Object)
+		r.resolveExpr(e.Index)
+	case IndexSetExpr:
+		r.resolveExpr(e.Object)
+		r.resolveExpr(e.Index)
+		r.resolveExpr(e.Value)
+	case GetExpr:
+		r.resolveExpr(e.Object)
+	case SetExpr:
+		r.resolveExpr(e.Object)
+		r.resolveExpr(e.Value)
+	case OptionalChainExpr:
+		r.resolveExpr(e.Expr)
+	case CompoundAssignExpr:
+		r.resolveExpr(e.Target)
+		r.resolveExpr(e.Value)
+	case IncrementExpr:
+		r.resolveExpr(e.Target)
+	case SpawnExpr:
+		r.resolveExpr(e.Call)
+	case AwaitExpr:
+		r.resolveExpr(e.Operand)
+	}
+}
+
+// Reports cases that can never run because an earlier unguarded case
+// already matches everything they would
+func (r *resolver) resolveMatch(stmt MatchStmt) {
+	r.resolveExpr(stmt.Subject)
+
+	catchAll := -1
+	seen := make(map[string]int)
+	for i, c := range stmt.Cases {
+		r.resolveExpr(c.Guard)
+		r.resolveStmt(c.Body)
+		r.line = stmt.Line
+
+		if catchAll >= 0 {
+			r.report("Unreachable case %d in match, case %d matches everything", i+1, catchAll+1)
+			continue
+		}
+
+		key := patternKey(c.Pattern)
+		if key != "" {
+			if first, ok := seen[key]; ok {
+				r.report("Unreachable case %d in match, case %d has the same pattern", i+1, first+1)
+				continue
+			}
+		}
+
+		// Guarded cases can fall through so they don't shadow anything
+		if c.Guard != nil {
+			continue
+		}
+		switch c.Pattern.(type) {
+		case WildcardPattern, BindingPattern:
+			catchAll = i
+		}
+		if key != "" {
+			seen[key] = i
+		}
+	}
+}
+
+// Returns a key identifying simple patterns that fully shadow later
+// identical ones, or "" for patterns that aren't compared
+func patternKey(pattern Pattern) string {
+	switch p := pattern.(type) {
+	case TypePattern:
+		return "type:" + p.TypeName
+	case LiteralPattern:
+		switch v := p.Value.(type) {
+		case LiteralExpr[bool]:
+			return fmt.Sprintf("bool:%v", v.value)
+		case LiteralExpr[string]:
+			return fmt.Sprintf("string:%q", v.value)
+		case LiteralExpr[int64]:
+			return fmt.Sprintf("number:%v", v.value)
+		case LiteralExpr[*struct{}]:
+			return "nil"
+		}
+	}
+	return ""
+}
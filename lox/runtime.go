@@ -1,9 +1,15 @@
 package lox
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/big"
 	"os"
+	"path/filepath"
 )
 
 type Value interface{}
@@ -12,53 +18,211 @@ type Null *struct{}
 
 type LoxCallable interface {
 	Call(runtimeState *RuntimeState, arguments []Value) (any, error)
-	Arity() int
+	// Arity reports the minimum and maximum number of accepted
+	// arguments. A maximum of VARIADIC means there is no upper bound.
+	Arity() (int, int)
+}
+
+const VARIADIC = -1
+
+// Describes an arity range for error messages
+func describeArity(minArity int, maxArity int) string {
+	switch {
+	case maxArity == VARIADIC:
+		return "at least " + pluralArguments(minArity)
+	case minArity == maxArity:
+		return pluralArguments(minArity)
+	}
+	return fmt.Sprintf("%d to %d arguments", minArity, maxArity)
+}
+
+func pluralArguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
 }
 
 type LoxFunction struct {
-	Params []string
+	// Name is empty for anonymous functions
+	Name   string
+	Params []Parameter
 	Stmts  []Stmt
+	// The scope the function was defined in
+	Closure *ScopeEnv
+	// Initializers always return the instance they were bound to
+	IsInitializer bool
+	// Calling a generator returns a LoxGenerator instead of running
+	// the body
+	IsGenerator bool
+	// Calling an async function returns a LoxPromise
+	IsAsync bool
+	// Where the function was defined, for profiles
+	Script string
+	Line   int
 }
 
 func (f LoxFunction) Call(rs *RuntimeState, arguments []Value) (any, error) {
-	rs.CurrEnv = NewScopeEnv(rs.CurrEnv)
+	prevEnv := rs.CurrEnv
+	defer func() { rs.CurrEnv = prevEnv }()
+
+	// A plain function called from a generator or async function can't
+	// suspend it
+	prevCoroutine := rs.coroutine
+	defer func() { rs.coroutine = prevCoroutine }()
+	rs.coroutine = nil
+
+	// Calls count as steps too, so a callback with an empty body can't
+	// run forever
+	if err := rs.step(); err != nil {
+		return nil, err
+	}
+	rs.depth++
+	defer func() { rs.depth-- }()
+	if max := rs.maxCallDepth(); rs.depth > max {
+		return nil, CallDepthError{Limit: max}
+	}
+	if rs.Profiler != nil {
+		defer rs.profileCall(f)()
+	}
+	prevScript := rs.script
+	defer func() { rs.script = prevScript }()
+	rs.script = f.Script
+	if rs.Coverage != nil {
+		// Statements after the call on the caller's line don't count
+		// it again
+		prevCovered := rs.lastCovered
+		defer func() { rs.lastCovered = prevCovered }()
+		rs.coverAgain()
+	}
+
+	err := f.bindArguments(rs, arguments)
+	if err != nil {
+		return nil, err
+	}
+	if f.IsGenerator {
+		// The body doesn't start until the generator is resumed
+		return newLoxGenerator(rs, f), nil
+	}
+	if f.IsAsync {
+		return rs.startAsync(f), nil
+	}
+	return f.run(rs)
+}
+
+// Declares the parameters in a new scope, which is left as rs.CurrEnv
+func (f LoxFunction) bindArguments(rs *RuntimeState, arguments []Value) error {
+	rs.CurrEnv = NewScopeEnv(f.Closure)
 	for i, param := range f.Params {
-		rs.CurrEnv.Declare(param, arguments[i])
+		switch {
+		case param.Rest:
+			rest := make([]Value, 0)
+			if i < len(arguments) {
+				rest = append(rest, arguments[i:]...)
+			}
+			rs.CurrEnv.Declare(param.Name, NewLoxList(rest))
+		case i < len(arguments):
+			rs.CurrEnv.Declare(param.Name, arguments[i])
+		case param.Default != nil:
+			// Defaults are evaluated in the call's scope so they can
+			// refer to earlier parameters
+			value, err := rs.Evaluate(param.Default)
+			if err != nil {
+				return err
+			}
+			rs.CurrEnv.Declare(param.Name, value)
+		default:
+			rs.CurrEnv.Declare(param.Name, Null(nil))
+		}
 	}
+	return nil
+}
 
+// Runs the body in rs.CurrEnv
+func (f LoxFunction) run(rs *RuntimeState) (Value, error) {
 	for _, stmt := range f.Stmts {
 		ret, err := rs.Interpret(stmt)
 		if err != nil {
 			return nil, err
 		}
-		if ret != nil {
-			rs.CurrEnv = rs.CurrEnv.parent
+		if ret != nil && !f.IsInitializer {
 			return ret, nil
 		}
+		if ret != nil {
+			break
+		}
 	}
 
-	rs.CurrEnv = rs.CurrEnv.parent
-	return nil, nil
+	if f.IsInitializer {
+		return f.Closure.Lookup("this")
+	}
+	return Null(nil), nil
 }
 
-func (f LoxFunction) Arity() int {
-	return len(f.Params)
+// Binds a method to an instance by wrapping its closure in a scope
+// that defines `this`
+func (f LoxFunction) bind(instance *LoxInstance) LoxFunction {
+	env := NewScopeEnv(f.Closure)
+	env.Declare("this", instance)
+	f.Closure = env
+	return f
+}
+
+func (f LoxFunction) Arity() (int, int) {
+	minArity := 0
+	for _, param := range f.Params {
+		if param.Rest {
+			return minArity, VARIADIC
+		}
+		if param.Default == nil {
+			minArity++
+		}
+	}
+	return minArity, len(f.Params)
+}
+
+func (f LoxFunction) String() string {
+	if f.Name == "" {
+		return "<fn anonymous>"
+	}
+	return fmt.Sprintf("<fn %s>", f.Name)
 }
 
 type LoxClass struct {
-	Name      string
-	Functions []LoxFunction
+	Name    string
+	Methods map[string]LoxFunction
 }
 
 type LoxInstance struct {
-	Class *LoxClass
+	Class  *LoxClass
+	Fields map[string]Value
 }
 
-func (c LoxClass) Call(runtimeState *RuntimeState, arguments []Value) (any, error) {
-	return LoxInstance{Class: &c}, nil
+func (i *LoxInstance) String() string {
+	return fmt.Sprintf("<%s instance>", i.Class.Name)
 }
-func (c LoxClass) Arity() int {
-	return 0
+
+func (c *LoxClass) Call(rs *RuntimeState, arguments []Value) (any, error) {
+	instance := &LoxInstance{Class: c, Fields: make(map[string]Value)}
+	if init, ok := c.Methods["init"]; ok {
+		_, err := init.bind(instance).Call(rs, arguments)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return instance, nil
+}
+
+// A class takes the same arguments as its initializer
+func (c *LoxClass) Arity() (int, int) {
+	if init, ok := c.Methods["init"]; ok {
+		return init.Arity()
+	}
+	return 0, 0
+}
+
+func (c *LoxClass) String() string {
+	return fmt.Sprintf("<class %s>", c.Name)
 }
 
 // Determines whether a value is truthy.
@@ -83,11 +247,49 @@ func isEqual(lhs any, rhs any) bool {
 		return false
 	}
 
+	// Numbers compare by value across the numeric tower
+	if isNumber(lhs) && isNumber(rhs) {
+		c, ordered := compareNumbers(lhs, rhs)
+		return ordered && c == 0
+	}
+	if isNumber(lhs) || isNumber(rhs) {
+		return false
+	}
+
+	// Functions hold slices, so == would panic on them
+	if lf, ok := lhs.(LoxFunction); ok {
+		rf, ok := rhs.(LoxFunction)
+		return ok && lf.sameAs(rf)
+	}
+
 	return lhs == rhs
 }
 
+// Whether two functions come from the same definition and close over
+// the same scope. Binding a method makes a new scope for this, so
+// methods bound to the same instance count as the same too.
+func (f LoxFunction) sameAs(other LoxFunction) bool {
+	if f.Name != other.Name || f.Script != other.Script || f.Line != other.Line ||
+		len(f.Stmts) != len(other.Stmts) || len(f.Params) != len(other.Params) {
+		return false
+	}
+	if len(f.Stmts) > 0 && &f.Stmts[0] != &other.Stmts[0] {
+		return false
+	}
+	if f.Closure == other.Closure {
+		return true
+	}
+
+	this, bound := f.Closure.vars["this"]
+	otherThis, otherBound := other.Closure.vars["this"]
+	return bound && otherBound && this == otherThis && f.Closure.parent == other.Closure.parent
+}
+
 type RuntimeError struct {
 	message string
+	// The line of the innermost statement the error came from, or 0
+	// if it wasn't raised by a statement
+	line int
 }
 
 func (e RuntimeError) Error() string {
@@ -99,47 +301,291 @@ type RuntimeState struct {
 	GlobalEnv *ScopeEnv
 	CurrEnv   *ScopeEnv
 	OutWriter io.Writer
+	// Standard streams for the io module. Either can be nil to deny
+	// scripts access.
+	InReader  io.Reader
+	ErrWriter io.Writer
+
+	// FS serves the fs module. It's read-only unless it's also a
+	// WriteFS, and nil denies file access entirely.
+	FS fs.FS
+	// Slash separated directory in FS that relative paths start from
+	WorkDir string
+
+	// Command-line arguments, set with SetArgs
+	Args []string
+
+	// Clock is the time source for timers and the time module. nil
+	// means the system clock.
+	Clock Clock
+
+	// Context stops the script once it's done, e.g. at a deadline
+	Context context.Context
+	Limits  Limits
+	// Profiler, when set, records where the script spends its time
+	Profiler *Profiler
+	// Coverage, when set, records which lines and branches run
+	Coverage *Coverage
+
+	// ModuleFS, when set, serves every import instead of the OS file
+	// system, e.g. from an embed.FS or fstest.MapFS
+	ModuleFS fs.FS
+	// Directories searched for imports that aren't found relative to
+	// the importing script. Defaults to the GLOX_PATH list.
+	SearchPath []string
+	// Path of the script being run, used to resolve relative imports
+	ScriptPath string
+
+	// Report errors with their lines the way the book's interpreters
+	// do: compile errors as "[line N] Error at 'x': message", and
+	// runtime errors followed by "[line N]"
+	ErrorLines bool
+	// Set by Run once the source fails to compile, or once a runtime
+	// error isn't handled. The glox command exits with 65 and 70 for
+	// them, like the book's interpreters.
+	HadError        bool
+	HadRuntimeError bool
+
+	modules *moduleCache
+	// What builtins may access on the host, set with WithCapabilities
+	capabilities map[Capability]bool
+	// Names exported so far by the module being run
+	exports []string
+	// Buffers InReader so lines can be read one at a time
+	stdin *bufio.Reader
+	// Set while running the body of a generator, for yield to use
+	coroutine *coroutine
+	// Shared with spawned tasks, which take turns holding its lock
+	sched     *scheduler
+	holdsLock bool
+	// Timers and promise callbacks, run once the script's statements
+	// have finished
+	loop *eventLoop
+	// What's been used so far towards Limits
+	usage *usage
+	// Function calls in progress on this task
+	depth int
+	// The innermost call on this task, while profiling
+	frame *profileFrame
+	// The line last counted on this task, while measuring coverage
+	lastCovered coveredLine
+	// Path of the script the running code is from. Functions keep the
+	// path of the script that defined them.
+	script string
 }
 
-func NewRuntimeState() RuntimeState {
+// NewRuntimeState makes a runtime with every builtin declared. Without
+// options it has DefaultCapabilities.
+func NewRuntimeState(opts ...Option) RuntimeState {
 	global_scope := NewScopeEnv(nil)
 
 	// Declare builtin functions
 	global_scope.Declare("clock", ClockFn{})
+	global_scope.Declare("math", newMathModule())
+	global_scope.Declare("strings", newStringsModule())
+	global_scope.Declare("Regex", regexConstructor)
+	global_scope.Declare("fs", newFSModule())
+	global_scope.Declare("io", newIOModule())
+	global_scope.Declare("json", newJSONModule())
+	global_scope.Declare("os", newOSModule())
+	global_scope.Declare("time", newTimeModule())
+	global_scope.Declare("Channel", channelConstructor)
+	global_scope.Declare("select", selectFn)
+	global_scope.Declare("Mutex", mutexConstructor)
+	global_scope.Declare("setTimeout", timerFunction("setTimeout", false))
+	global_scope.Declare("setInterval", timerFunction("setInterval", true))
+	global_scope.Declare("clearTimeout", clearTimerFunction("clearTimeout"))
+	global_scope.Declare("clearInterval", clearTimerFunction("clearInterval"))
+	global_scope.Declare("Promise", promiseConstructor)
+	global_scope.Declare("args", NewLoxList(nil))
+
+	// Scripts see the whole OS file system, with relative paths
+	// starting from the working directory
+	workDir, _ := os.Getwd()
 
-	return RuntimeState{
-		GlobalEnv: global_scope,
-		CurrEnv:   global_scope,
-		OutWriter: os.Stdout,
+	rs := RuntimeState{
+		GlobalEnv:  global_scope,
+		CurrEnv:    global_scope,
+		OutWriter:  os.Stdout,
+		InReader:   os.Stdin,
+		ErrWriter:  os.Stderr,
+		FS:         DirFS("/"),
+		WorkDir:    filepath.ToSlash(workDir),
+		SearchPath: defaultSearchPath(),
+		modules:    newModuleCache(),
+		sched:      &scheduler{},
+		loop:       newEventLoop(),
+		usage:      &usage{},
 	}
+	WithCapabilities(DefaultCapabilities...)(&rs)
+	for _, opt := range opts {
+		opt(&rs)
+	}
+	return rs
 }
 
-func (rs *RuntimeState) Run(source string) {
-	// Tokenize the source string
+// Lexes, parses and resolves source into a program
+func compile(source string) (ProgramNode, error) {
 	tokens, err := ScanTokens(source)
 	if err != nil {
-		fmt.Fprintf(rs.OutWriter, "Lexing Error %v\n", tokens)
-		return
+		return ProgramNode{}, err
 	}
 
 	root, err := Parse(tokens)
 	if err != nil {
-		fmt.Fprintln(rs.OutWriter, err)
+		return ProgramNode{}, err
+	}
+
+	err = Resolve(root)
+	if err != nil {
+		return ProgramNode{}, err
+	}
+
+	return root.(ProgramNode), nil
+}
+
+// Run executes source, reporting any errors to ErrWriter and carrying
+// on with the next statement. It stops early only when the script calls
+// os.exit or goes over a limit, returning the ExitError or LimitError.
+// HadError and HadRuntimeError record whether anything was reported.
+func (rs *RuntimeState) Run(source string) error {
+	pStmts, err := compile(source)
+	if err != nil {
+		rs.HadError = true
+		rs.reportCompileError(err)
+		return nil
+	}
+	rs.script = rs.ScriptPath
+	if rs.Coverage != nil {
+		rs.Coverage.register(rs.script, source, pStmts)
+	}
+
+	return rs.execute(func() error {
+		for _, stmt := range pStmts.Statements {
+			_, err := rs.Interpret(stmt)
+			if err := rs.stopError(err); err != nil {
+				return err
+			}
+			if err != nil {
+				rs.reportError(err)
+			}
+		}
+		return nil
+	})
+}
+
+// Where errors are reported: ErrWriter, or OutWriter when scripts are
+// denied standard error
+func (rs *RuntimeState) errWriter() io.Writer {
+	if rs.ErrWriter == nil {
+		return rs.OutWriter
+	}
+	return rs.ErrWriter
+}
+
+// Reports the errors that stopped a script compiling
+func (rs *RuntimeState) reportCompileError(err error) {
+	w := rs.errWriter()
+	if !rs.ErrorLines {
+		fmt.Fprintln(w, err)
 		return
 	}
 
-	pStmts := root.(ProgramNode)
-	for _, stmt := range pStmts.Statements {
-		_, err := rs.Interpret(stmt)
-		if err != nil {
-			fmt.Fprintln(rs.OutWriter, err.Error())
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		switch e := err.(type) {
+		case ScanError:
+			fmt.Fprintf(w, "[line %d] Error: %s\n", e.Start.Line, e.Message)
+		case ParseError:
+			fmt.Fprintf(w, "[line %d] Error %s: %s\n", e.line, e.where(), e.message)
+		case ResolveError:
+			fmt.Fprintf(w, "[line %d] Error: %s\n", e.line, e.message)
+		default:
+			fmt.Fprintln(w, err)
 		}
 	}
 }
 
+// Reports a runtime error nothing in the script handled
+func (rs *RuntimeState) reportError(err error) {
+	rs.HadRuntimeError = true
+	w := rs.errWriter()
+	fmt.Fprintln(w, err.Error())
+	var runtimeErr RuntimeError
+	if rs.ErrorLines && errors.As(err, &runtimeErr) && runtimeErr.line > 0 {
+		fmt.Fprintf(w, "[line %d]\n", runtimeErr.line)
+	}
+}
+
+// Calls body holding the interpreter lock, then runs the event loop
+func (rs *RuntimeState) execute(body func() error) error {
+	if rs.sched == nil {
+		rs.sched = &scheduler{}
+	}
+	rs.eventLoop()
+	if rs.usage == nil {
+		rs.usage = &usage{}
+	}
+	if rs.Profiler != nil {
+		defer rs.Profiler.pause()
+	}
+	// An import runs on the task that imported it, as part of the
+	// same run
+	if rs.holdsLock {
+		return rs.executeBody(body)
+	}
+
+	rs.sched.lock.Lock()
+	rs.holdsLock = true
+	defer func() {
+		rs.holdsLock = false
+		rs.sched.lock.Unlock()
+	}()
+	rs.sched.start(rs.Context)
+	return rs.finish(rs.executeBody(body))
+}
+
+func (rs *RuntimeState) executeBody(body func() error) error {
+	if err := body(); err != nil {
+		return err
+	}
+
+	// Like a browser or node, the script runs until nothing's left
+	// waiting on a timer or promise
+	return rs.stopError(rs.runLoop(nil))
+}
+
 // Interpret the stmt and apply the changes to the RuntimeState
 func (rs *RuntimeState) Interpret(stmt Stmt) (Value, error) {
+	ret, err := rs.interpret(stmt)
+	// Errors are reported on the line of the innermost statement
+	if runtimeErr, ok := err.(RuntimeError); ok && runtimeErr.line == 0 && stmt != nil {
+		runtimeErr.line = stmt.line()
+		err = runtimeErr
+	}
+	return ret, err
+}
+
+func (rs *RuntimeState) interpret(stmt Stmt) (Value, error) {
 	var ret Value
+	if err := rs.step(); err != nil {
+		return nil, err
+	}
+	rs.tick()
+	// A missing else branch is interpreted as a nil statement
+	if rs.Profiler != nil && stmt != nil {
+		rs.profileStatement(stmt.line())
+	}
+	if rs.Coverage != nil && stmt != nil {
+		// The declaration an export wraps is counted on its own
+		if _, isExport := stmt.(ExportStmt); !isExport {
+			rs.coverStatement(stmt.line())
+		}
+	}
+
 	switch stype := stmt.(type) {
 	case PrintStmt:
 		value, err := rs.Evaluate(stype.Expr)
@@ -147,7 +593,7 @@ func (rs *RuntimeState) Interpret(stmt Stmt) (Value, error) {
 			return nil, err
 		}
 
-		fmt.Fprintln(rs.OutWriter, value)
+		fmt.Fprintln(rs.OutWriter, stringify(value))
 	case ExprStmt:
 		// We don't actually do anything with an ExprStmt value
 		_, err := rs.Evaluate(stype.Expr)
@@ -156,7 +602,7 @@ func (rs *RuntimeState) Interpret(stmt Stmt) (Value, error) {
 		}
 
 	case DeclarationStmt:
-		var init any
+		var init any = Null(nil)
 		if stype.Expr != nil {
 			v, err := rs.Evaluate(*stype.Expr)
 			if err != nil {
@@ -169,27 +615,41 @@ func (rs *RuntimeState) Interpret(stmt Stmt) (Value, error) {
 	case FunctionDeclarationStmt:
 		// Add the function to the current scope as a LoxCallable
 		f := LoxFunction{
-			Params: stype.Parameters,
-			Stmts:  stype.Body.Statements,
+			Name:        stype.Name,
+			Params:      stype.Parameters,
+			Stmts:       stype.Body.Statements,
+			Closure:     rs.CurrEnv,
+			IsGenerator: stype.IsGenerator,
+			IsAsync:     stype.IsAsync,
+			Script:      rs.script,
+			Line:        stype.Line,
 		}
 		rs.CurrEnv.Declare(stype.Name, f)
 	case ClassDeclarationStmt:
-		cls_funcs := make([]LoxFunction, 0)
+		methods := make(map[string]LoxFunction)
 		for _, func_node := range stype.Functions {
-			f := LoxFunction{
-				Params: func_node.Parameters,
-				Stmts:  func_node.Body.Statements,
+			methods[func_node.Name] = LoxFunction{
+				Name:          func_node.Name,
+				Params:        func_node.Parameters,
+				Stmts:         func_node.Body.Statements,
+				Closure:       rs.CurrEnv,
+				IsInitializer: func_node.Name == "init",
+				IsGenerator:   func_node.IsGenerator,
+				IsAsync:       func_node.IsAsync,
+				Script:        rs.script,
+				Line:          func_node.Line,
 			}
-			cls_funcs = append(cls_funcs, f)
-
 		}
-		cls := LoxClass{
-			Name:      stype.Name,
-			Functions: cls_funcs,
+		cls := &LoxClass{
+			Name:    stype.Name,
+			Methods: methods,
 		}
 		rs.CurrEnv.Declare(stype.Name, cls)
 		return nil, nil
 	case ReturnStmt:
+		if stype.Value == nil {
+			return Null(nil), nil
+		}
 		value, err := rs.Evaluate(stype.Value)
 		if err != nil {
 			return nil, err
@@ -197,24 +657,29 @@ func (rs *RuntimeState) Interpret(stmt Stmt) (Value, error) {
 		return value, nil
 	case BlockStmt:
 		// Create a new variable scope
+		prevEnv := rs.CurrEnv
 		rs.CurrEnv = NewScopeEnv(rs.CurrEnv)
 		for _, stmt := range stype.Statements {
 			ret, err := rs.Interpret(stmt)
 			if err != nil {
+				rs.CurrEnv = prevEnv
 				return nil, err
 			}
 			if ret != nil {
-				rs.CurrEnv = rs.CurrEnv.parent
+				rs.CurrEnv = prevEnv
 				return ret, nil
 			}
 		}
-		rs.CurrEnv = rs.CurrEnv.parent
+		rs.CurrEnv = prevEnv
 	case IfStmt:
 		cond, err := rs.Evaluate(stype.Condition)
 		if err != nil {
 			return nil, err
 		}
 
+		if rs.Coverage != nil {
+			rs.coverBranch(stype.Line, stype.Column, isTruthy(cond))
+		}
 		if isTruthy(cond) {
 			ret, err = rs.Interpret(stype.ThenBranch)
 		} else {
@@ -227,6 +692,12 @@ func (rs *RuntimeState) Interpret(stmt Stmt) (Value, error) {
 		if ret != nil {
 			return ret, nil
 		}
+	case MatchStmt:
+		return rs.interpretMatch(stype)
+	case ImportStmt:
+		return nil, rs.interpretImport(stype)
+	case ExportStmt:
+		return nil, rs.interpretExport(stype)
 	case WhileStmt:
 		for {
 			cond, err := rs.Evaluate(stype.Condition)
@@ -234,10 +705,16 @@ func (rs *RuntimeState) Interpret(stmt Stmt) (Value, error) {
 				return nil, err
 			}
 
+			if rs.Coverage != nil {
+				rs.coverBranch(stype.Line, stype.Column, isTruthy(cond))
+			}
 			if !isTruthy(cond) {
 				break
 			}
 
+			if rs.Coverage != nil {
+				rs.coverAgain()
+			}
 			ret, err = rs.Interpret(stype.Body)
 			if err != nil {
 				return nil, err
@@ -246,22 +723,263 @@ func (rs *RuntimeState) Interpret(stmt Stmt) (Value, error) {
 				return ret, nil
 			}
 		}
+	case ForInStmt:
+		return rs.interpretForIn(stype)
 	}
 	return nil, nil
 }
 
+func (rs *RuntimeState) interpretForIn(stmt ForInStmt) (Value, error) {
+	iterable, err := rs.Evaluate(stmt.Iterable)
+	if err != nil {
+		return nil, err
+	}
+	it, err := rs.iterate(iterable)
+	if err != nil {
+		return nil, err
+	}
+	// Leaving early still releases whatever the iterator holds, like a
+	// suspended generator
+	defer it.Close()
+
+	prevEnv := rs.CurrEnv
+	defer func() { rs.CurrEnv = prevEnv }()
+
+	for {
+		ok, err := it.HasNext()
+		if err != nil || !ok {
+			return nil, err
+		}
+		value, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// Each iteration gets its own variable so closures capture the
+		// value from their iteration
+		rs.CurrEnv = NewScopeEnv(prevEnv)
+		rs.CurrEnv.Declare(stmt.Name, value)
+		if rs.Coverage != nil {
+			rs.coverAgain()
+		}
+		ret, err := rs.Interpret(stmt.Body)
+		rs.CurrEnv = prevEnv
+		if err != nil {
+			return nil, err
+		}
+		if ret != nil {
+			return ret, nil
+		}
+	}
+}
+
 func (rs *RuntimeState) Evaluate(node Expr) (Value, error) {
 	switch nt := node.(type) {
 	case LiteralExpr[bool]:
 		return nt.value, nil
 	case LiteralExpr[float64]:
 		return nt.value, nil
+	case LiteralExpr[int64]:
+		return nt.value, nil
+	case LiteralExpr[*big.Int]:
+		return nt.value, nil
+	case LiteralExpr[*big.Rat]:
+		return nt.value, nil
 	case LiteralExpr[string]:
 		return nt.value, nil
 	case LiteralExpr[*struct{}]:
 		return Null(nil), nil
+	case RegexExpr:
+		return nt.Regex, nil
 	case VarExpr:
 		return rs.CurrEnv.Lookup(nt.Name)
+	case FunctionExpr:
+		return LoxFunction{
+			Params:      nt.Parameters,
+			Stmts:       nt.Body.Statements,
+			Closure:     rs.CurrEnv,
+			IsGenerator: nt.IsGenerator,
+			IsAsync:     nt.IsAsync,
+			Script:      rs.script,
+			Line:        nt.Line,
+		}, nil
+	case ListExpr:
+		elements, err := rs.evaluateArguments(nt.Elements)
+		if err != nil {
+			return nil, err
+		}
+		return rs.account(NewLoxList(elements))
+	case MapExpr:
+		m := NewLoxMap()
+		for _, entry := range nt.Entries {
+			key, err := rs.Evaluate(entry.Key)
+			if err != nil {
+				return nil, err
+			}
+			value, err := rs.Evaluate(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+			err = m.Set(key, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return rs.account(m)
+	case IndexExpr:
+		object, err := rs.Evaluate(nt.Object)
+		if err != nil {
+			return nil, err
+		}
+		index, err := rs.Evaluate(nt.Index)
+		if err != nil {
+			return nil, err
+		}
+		return getIndex(object, index)
+	case SpreadExpr:
+		return nil, RuntimeError{message: "Spread is only allowed in argument lists and list literals"}
+	case GetExpr:
+		object, err := rs.Evaluate(nt.Object)
+		if err != nil {
+			return nil, err
+		}
+		if _, isNull := object.(Null); isNull && nt.Optional {
+			return nil, errShortCircuit
+		}
+		return getProperty(object, nt.Name)
+	case OptionalChainExpr:
+		value, err := rs.Evaluate(nt.Expr)
+		if err == errShortCircuit {
+			return Null(nil), nil
+		}
+		return value, err
+	case ThisExpr:
+		return rs.CurrEnv.Lookup("this")
+	case ConditionalExpr:
+		cond, err := rs.Evaluate(nt.Condition)
+		if err != nil {
+			return nil, err
+		}
+		if isTruthy(cond) {
+			return rs.Evaluate(nt.ThenExpr)
+		}
+		return rs.Evaluate(nt.ElseExpr)
+	case SetExpr:
+		object, err := rs.Evaluate(nt.Object)
+		if err != nil {
+			return nil, err
+		}
+		value, err := rs.Evaluate(nt.Value)
+		if err != nil {
+			return nil, err
+		}
+		if instance, ok := object.(*LoxInstance); ok {
+			if _, exists := instance.Fields[nt.Name]; !exists {
+				if err := rs.allocate(mapEntrySize); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return setProperty(object, nt.Name, value)
+	case IndexSetExpr:
+		object, err := rs.Evaluate(nt.Object)
+		if err != nil {
+			return nil, err
+		}
+		index, err := rs.Evaluate(nt.Index)
+		if err != nil {
+			return nil, err
+		}
+		value, err := rs.Evaluate(nt.Value)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := object.(*LoxMap); ok {
+			if _, exists, _ := m.Get(index); !exists {
+				if err := rs.allocate(mapEntrySize); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return setIndex(object, index, value)
+	case CompoundAssignExpr:
+		ref, err := rs.resolveReference(nt.Target)
+		if err != nil {
+			return nil, err
+		}
+		current, err := ref.get()
+		if err != nil {
+			return nil, err
+		}
+		value, err := rs.Evaluate(nt.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := binaryOperation(rs, nt.Operation, current, value)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rs.account(result); err != nil {
+			return nil, err
+		}
+		return ref.set(result)
+	case SpawnExpr:
+		callee, err := rs.Evaluate(nt.Call.Callee)
+		if err != nil {
+			return nil, err
+		}
+		args, err := rs.evaluateArguments(nt.Call.Args)
+		if err != nil {
+			return nil, err
+		}
+		callable, ok := callee.(LoxCallable)
+		if !ok {
+			return nil, RuntimeError{message: fmt.Sprintf("Can only spawn a function call, got %s", reprValue(callee))}
+		}
+		return rs.spawn(callable, args)
+	case AwaitExpr:
+		value, err := rs.Evaluate(nt.Operand)
+		if err != nil {
+			return nil, err
+		}
+		return rs.await(value)
+	case YieldExpr:
+		var value Value = Null(nil)
+		if nt.Value != nil {
+			var err error
+			value, err = rs.Evaluate(nt.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if rs.coroutine == nil {
+			return nil, RuntimeError{message: "'yield' can only be used inside a generator function"}
+		}
+		return rs.coroutine.yield(value)
+	case IncrementExpr:
+		ref, err := rs.resolveReference(nt.Target)
+		if err != nil {
+			return nil, err
+		}
+		current, err := ref.get()
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := arithmetic(nt.Operation, current, int64(1))
+		if err != nil {
+			return nil, err
+		}
+		_, err = ref.set(result)
+		if err != nil {
+			return nil, err
+		}
+
+		if nt.Prefix {
+			return result, nil
+		}
+		return current, nil
 	case AssignExpr:
 		v, err := rs.Evaluate(nt.Value)
 		if err != nil {
@@ -270,19 +988,18 @@ func (rs *RuntimeState) Evaluate(node Expr) (Value, error) {
 
 		return rs.CurrEnv.Assign(nt.Name, v)
 	case UnaryExpr:
-		value, err := rs.Evaluate(nt)
+		value, err := rs.Evaluate(nt.Operand)
 		if err != nil {
 			return nil, err
 		}
 
-		if nt.Operation == BANG {
-			// Assert that the value is a bool?
-			return isTruthy(value), nil
-		}
-		if nt.Operation == MINUS {
-			v := value.(float64)
-			return float64(v), nil
-
+		switch nt.Operation {
+		case BANG:
+			return !isTruthy(value), nil
+		case MINUS:
+			return negate(value)
+		case TILDE:
+			return bitwiseNot(value)
 		}
 
 		return nil, RuntimeError{
@@ -300,51 +1017,36 @@ func (rs *RuntimeState) Evaluate(node Expr) (Value, error) {
 			return nil, err
 		}
 
-		// Handle equals first since it may not have numbers
-		if nt.Operation == BANG_EQUAL {
-			return !isEqual(lhs, rhs), nil
-		}
-		if nt.Operation == EQUAL_EQUAL {
-			return isEqual(lhs, rhs), nil
-		}
-
-		// All the other operations need numbers
-		nl, nr := lhs.(float64), rhs.(float64)
-		switch nt.Operation {
-		case STAR:
-			return nl * nr, nil
-		case SLASH:
-			if nr == 0 {
-				return nil, RuntimeError{message: "Division by zero"}
-			}
-			return nl / nr, nil
-		case PLUS:
-			return nl + nr, nil
-		case MINUS:
-			return nl - nr, nil
-		case GREATER:
-			return nl > nr, nil
-		case GREATER_EQUAL:
-			return nl >= nr, nil
-		case LESS:
-			return nl < nr, nil
-		case LESS_EQUAL:
-			return nl <= nr, nil
-		}
-
-		return nil, RuntimeError{
-			message: fmt.Sprintf("Bad operand '%s' in unary expression", nt.Operation),
+		result, err := binaryOperation(rs, nt.Operation, lhs, rhs)
+		if err != nil {
+			return nil, err
 		}
+		return rs.account(result)
 	case LogicalExpr:
 		left, err := rs.Evaluate(nt.Lhs)
 		if err != nil {
 			return nil, err
 		}
 
+		// Nil-coalescing yields the left value itself unless it's nil
+		if nt.Operation == QUESTION_QUESTION {
+			_, isNull := left.(Null)
+			shortCircuit := !isNull && left != nil
+			if rs.Coverage != nil {
+				rs.coverBranch(nt.Line, nt.Column, shortCircuit)
+			}
+			if shortCircuit {
+				return left, nil
+			}
+			return rs.Evaluate(nt.Rhs)
+		}
+
 		// Short circuit
-		if nt.Operation == OR && isTruthy(left) {
-			return isTruthy(left), nil
-		} else if nt.Operation == AND && !isTruthy(left) {
+		shortCircuit := nt.Operation == OR && isTruthy(left) || nt.Operation == AND && !isTruthy(left)
+		if rs.Coverage != nil {
+			rs.coverBranch(nt.Line, nt.Column, shortCircuit)
+		}
+		if shortCircuit {
 			return isTruthy(left), nil
 		}
 
@@ -363,14 +1065,9 @@ func (rs *RuntimeState) Evaluate(node Expr) (Value, error) {
 			return nil, err
 		}
 
-		argValues := make([]Value, 0)
-		for _, arg := range nt.Args {
-			argValue, err := rs.Evaluate(arg)
-			if err != nil {
-				return nil, err
-			}
-
-			argValues = append(argValues, argValue)
+		argValues, err := rs.evaluateArguments(nt.Args)
+		if err != nil {
+			return nil, err
 		}
 
 		// Cast callee to function type
@@ -382,19 +1079,192 @@ func (rs *RuntimeState) Evaluate(node Expr) (Value, error) {
 			return nil, err
 		}
 
-		if len(argValues) != callable.Arity() {
-			err := RuntimeError{message: fmt.Sprintf("Function expects %d args but got %d", callable.Arity(), len(argValues))}
-			return nil, err
+		return rs.call(callable, argValues)
+
+	}
+
+	return nil, RuntimeError{
+		message: fmt.Sprintf("Attempting to evaluate an unsupported type %+v", node),
+	}
+}
+
+// Calls a function after checking the number of arguments. Natives
+// use this to call back into Lox code.
+func (rs *RuntimeState) call(callable LoxCallable, args []Value) (Value, error) {
+	minArity, maxArity := callable.Arity()
+	if len(args) < minArity || (maxArity != VARIADIC && len(args) > maxArity) {
+		return nil, RuntimeError{message: fmt.Sprintf("Function expected %s but got %d", describeArity(minArity, maxArity), len(args))}
+	}
+	result, err := callable.Call(rs, args)
+	if err != nil {
+		return nil, err
+	}
+	// Natives are charged for what they return, since they can build
+	// strings and lists of any size
+	if _, ok := callable.(*NativeFunction); ok {
+		return rs.account(result)
+	}
+	return result, nil
+}
+
+// Evaluates a list of argument expressions, expanding any spread lists
+func (rs *RuntimeState) evaluateArguments(args []Expr) ([]Value, error) {
+	values := make([]Value, 0, len(args))
+	for _, arg := range args {
+		spread, ok := arg.(SpreadExpr)
+		if !ok {
+			value, err := rs.Evaluate(arg)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			continue
 		}
-		value, err := callable.Call(rs, argValues)
+
+		value, err := rs.Evaluate(spread.Operand)
 		if err != nil {
 			return nil, err
 		}
-		return value, err
+		list, ok := value.(*LoxList)
+		if !ok {
+			return nil, RuntimeError{message: fmt.Sprintf("Can only spread lists, got %s", stringify(value))}
+		}
+		values = append(values, list.Elements...)
+	}
 
+	return values, nil
+}
+
+// Applies a binary operator to two already evaluated operands
+func binaryOperation(rs *RuntimeState, op TokenType, lhs Value, rhs Value) (Value, error) {
+	switch op {
+	// Handle equals first since it may not have numbers
+	case BANG_EQUAL:
+		return !isEqual(lhs, rhs), nil
+	case EQUAL_EQUAL:
+		return isEqual(lhs, rhs), nil
+
+	case PLUS:
+		if l, ok := lhs.(string); ok {
+			if r, ok := rhs.(string); ok {
+				return l + r, nil
+			}
+		}
+		if !isNumber(lhs) || !isNumber(rhs) {
+			return nil, RuntimeError{
+				message: fmt.Sprintf("Operands of '+' must be two numbers or two strings, got %s and %s", reprValue(lhs), reprValue(rhs)),
+			}
+		}
+		return arithmetic(op, lhs, rhs)
+
+	// All the other operations need numbers
+	case STAR, SLASH, MINUS, PERCENT, TILDE_SLASH:
+		return arithmetic(op, lhs, rhs)
+	case STAR_STAR:
+		return power(rs, lhs, rhs)
+	case GREATER, GREATER_EQUAL, LESS, LESS_EQUAL:
+		return compare(op, lhs, rhs)
+	case AMPERSAND, PIPE, CARET, LESS_LESS, GREATER_GREATER:
+		return bitwise(op, lhs, rhs)
 	}
 
 	return nil, RuntimeError{
-		message: fmt.Sprintf("Attempting to evaluate an unsupported type %+v", node),
+		message: fmt.Sprintf("Bad operand '%s' in binary expression", op),
+	}
+}
+
+// Returned by optional property accesses on nil and caught by the
+// enclosing OptionalChainExpr
+var errShortCircuit = errors.New("optional chain short-circuited")
+
+// Looks up a field or, failing that, a bound method on an instance
+func getProperty(object Value, name string) (Value, error) {
+	switch obj := object.(type) {
+	case *LoxModule:
+		return obj.get(name)
+	case string:
+		return stringMethod(obj, name)
+	case *LoxRegex:
+		return obj.get(name)
+	case *LoxIterator:
+		return obj.get(name)
+	case *LoxDate:
+		return obj.get(name)
+	case *LoxGenerator:
+		return obj.get(name)
+	case *LoxTask:
+		return obj.get(name)
+	case *LoxChannel:
+		return obj.get(name)
+	case *LoxMutex:
+		return obj.get(name)
+	case *LoxPromise:
+		return obj.get(name)
 	}
+
+	instance, ok := object.(*LoxInstance)
+	if !ok {
+		return nil, RuntimeError{message: fmt.Sprintf("Only instances have properties, got %s", stringify(object))}
+	}
+
+	if value, ok := instance.Fields[name]; ok {
+		return value, nil
+	}
+	if method, ok := instance.Class.Methods[name]; ok {
+		return method.bind(instance), nil
+	}
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined property '%s'", name)}
+}
+
+func setProperty(object Value, name string, value Value) (Value, error) {
+	instance, ok := object.(*LoxInstance)
+	if !ok {
+		return nil, RuntimeError{message: fmt.Sprintf("Only instances have fields, got %s", stringify(object))}
+	}
+
+	instance.Fields[name] = value
+	return value, nil
+}
+
+// reference is an assignable location. The target's subexpressions are
+// evaluated once when it's resolved so that compound assignments and
+// increments don't repeat their side effects.
+type reference struct {
+	get func() (Value, error)
+	set func(Value) (Value, error)
+}
+
+func (rs *RuntimeState) resolveReference(target Expr) (reference, error) {
+	switch t := target.(type) {
+	case VarExpr:
+		env := rs.CurrEnv
+		return reference{
+			get: func() (Value, error) { return env.Lookup(t.Name) },
+			set: func(v Value) (Value, error) { return env.Assign(t.Name, v) },
+		}, nil
+	case GetExpr:
+		object, err := rs.Evaluate(t.Object)
+		if err != nil {
+			return reference{}, err
+		}
+		return reference{
+			get: func() (Value, error) { return getProperty(object, t.Name) },
+			set: func(v Value) (Value, error) { return setProperty(object, t.Name, v) },
+		}, nil
+	case IndexExpr:
+		object, err := rs.Evaluate(t.Object)
+		if err != nil {
+			return reference{}, err
+		}
+		index, err := rs.Evaluate(t.Index)
+		if err != nil {
+			return reference{}, err
+		}
+		return reference{
+			get: func() (Value, error) { return getIndex(object, index) },
+			set: func(v Value) (Value, error) { return setIndex(object, index, v) },
+		}, nil
+	}
+
+	return reference{}, RuntimeError{message: fmt.Sprintf("Invalid assignment target %+v", target)}
 }
@@ -2,8 +2,10 @@ package lox
 
 import (
 	"bytes"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 )
@@ -85,6 +87,514 @@ func TestOutut(t *testing.T) {
             count(3);`,
 			"1\n2\n3\n",
 		},
+		{"function: return with semicolon",
+			`fun f() { return 1; }
+            print f();`,
+			"1\n",
+		},
+		{"function expression",
+			`var add = fun (a, b) { return a + b; };
+            print add(1, 2);`,
+			"3\n",
+		},
+		{"arrow function",
+			`var add = (a, b) => a + b;
+            var inc = x => x + 1;
+            print add(1, 2);
+            print inc(1);`,
+			"3\n2\n",
+		},
+		{"arrow function: block body",
+			`var f = () => { print 1; return 2; };
+            print f();`,
+			"1\n2\n",
+		},
+		{"function as callback",
+			`fun apply(f, x) { return f(x); }
+            print apply(x => x + 1, 1);
+            print apply(fun (x) { return x + 2; }, 1);`,
+			"2\n3\n",
+		},
+		{"closure",
+			`fun counter() {
+                var n = 0;
+                return () => { n = n + 1; return n; };
+            }
+            var c = counter();
+            c();
+            print c();`,
+			"2\n",
+		},
+		{"print function",
+			`fun f() {}
+            print f;
+            print fun () {};`,
+			"<fn f>\n<fn anonymous>\n",
+		},
+		{"function: implicit nil return",
+			`fun f() {}
+            print f();`,
+			"nil\n",
+		},
+		{"list literal",
+			`var xs = [1, "a", [true, nil]];
+            print xs;
+            print xs[1];`,
+			"[1, \"a\", [true, nil]]\na\n",
+		},
+		{"list index out of range",
+			`print [1][1];`,
+			"RuntimeError: List index 1 out of range\n",
+		},
+		{"default parameters",
+			`fun f(a, b = 2, c = a + b) { print a + b + c; }
+            f(1);
+            f(1, 1);
+            f(1, 1, 1);`,
+			"6\n4\n3\n",
+		},
+		{"rest parameter",
+			`fun f(a, ...rest) { print rest; }
+            f(1);
+            f(1, 2, 3);`,
+			"[]\n[2, 3]\n",
+		},
+		{"spread arguments",
+			`fun f(a, b, c) { return a + b + c; }
+            var xs = [2, 3];
+            print f(1, ...xs);
+            print [0, ...xs, 4];`,
+			"6\n[0, 2, 3, 4]\n",
+		},
+		{"arity error: range",
+			`fun f(a, b = 2) {}
+            f();`,
+			"RuntimeError: Function expected 1 to 2 arguments but got 0\n",
+		},
+		{"arity error: exact",
+			`fun f(a) {}
+            f(1, 2);`,
+			"RuntimeError: Function expected 1 argument but got 2\n",
+		},
+		{"arity error: rest",
+			`fun f(a, ...rest) {}
+            f();`,
+			"RuntimeError: Function expected at least 1 argument but got 0\n",
+		},
+		{"integer arithmetic",
+			`print 7 + 2 * 3;
+            print 7 / 2;
+            print 7 ~/ 2;
+            print -7 ~/ 2;
+            print 7 % 3;
+            print -7 % 3;`,
+			"13\n3.5\n3\n-4\n1\n2\n",
+		},
+		{"integer overflow promotes",
+			`print 9223372036854775807 + 1;
+            print 9223372036854775807 * 9223372036854775807;
+            print 9223372036854775808 - 1 == 9223372036854775807;`,
+			"9223372036854775808\n85070591730234615847396907784232501249\ntrue\n",
+		},
+		{"decimal literals",
+			`print 0.1d + 0.2d;
+            print 0.1d + 0.2d == 0.3d;
+            print 1d / 3d * 3d;
+            print 1.50d * 2;`,
+			"0.3\ntrue\n1\n3\n",
+		},
+		{"mixed arithmetic",
+			`print 1 + 0.5;
+            print 1 == 1.0;
+            print 1.5d + 0.25;
+            print 2 < 2.5;`,
+			"1.5\ntrue\n1.75\ntrue\n",
+		},
+		{"number literal bases",
+			`print 0xff;
+            print 0b1010;
+            print 0o17;
+            print 1_000_000;`,
+			"255\n10\n15\n1000000\n",
+		},
+		{"bitwise operators",
+			`print 6 & 3;
+            print 6 | 3;
+            print 6 ^ 3;
+            print ~5;
+            print 1 << 3;
+            print -16 >> 2;
+            print 1 << 64;
+            print 5 & 1 == 1;`,
+			"2\n7\n5\n-6\n8\n-4\n18446744073709551616\ntrue\n",
+		},
+		{"unary operators",
+			`print -(1 + 2);
+            print -(-1);
+            print !true;
+            print !nil;`,
+			"-3\n1\nfalse\ntrue\n",
+		},
+		{"not equal",
+			`print 1 != 2;
+            print 1 != 1;`,
+			"true\nfalse\n",
+		},
+		{"function equality",
+			`fun f() {}
+            fun g() {}
+            class A { m() {} }
+            var a = A();
+            print f == f;
+            print f == g;
+            print a.m == a.m;
+            print a.m == A().m;`,
+			"true\nfalse\ntrue\nfalse\n",
+		},
+		{"bitwise on float",
+			`print 1.5 & 1;`,
+			"RuntimeError: Operands of 'AMPERSAND' must be integers, got 1.5 and 1\n",
+		},
+		{"integer division by zero",
+			`print 1 ~/ 0;`,
+			"RuntimeError: Division by zero\n",
+		},
+		{"exponent",
+			`print 2 ** 10;
+            print 2 ** 3 ** 2;
+            print -2 ** 2;
+            print 2 ** -1;
+            print 2 ** 100;
+            print 1.5d ** 2;`,
+			"1024\n512\n-4\n0.5\n1267650600228229401496703205376\n2.25\n",
+		},
+		{"compound assignment: variables",
+			`var a = 10;
+            a += 5;
+            print a;
+            a -= 3;
+            print a;
+            a *= 2;
+            print a;
+            a %= 5;
+            print a;
+            a /= 4;
+            print a;
+            print a += 1;`,
+			"15\n12\n24\n4\n1\n2\n",
+		},
+		{"compound assignment: indexes",
+			`var xs = [1, 2];
+            xs[1] += 10;
+            xs[0] = 5;
+            print xs;`,
+			"[5, 12]\n",
+		},
+		{"compound assignment: properties",
+			`class Point {}
+            var p = Point();
+            p.x = 1;
+            p.x += 2;
+            p.x++;
+            print p.x;`,
+			"4\n",
+		},
+		{"increment and decrement",
+			`var i = 0;
+            print i++;
+            print i;
+            print ++i;
+            print i--;
+            print --i;`,
+			"0\n1\n2\n2\n0\n",
+		},
+		{"increment: index evaluated once",
+			`var n = 0;
+            fun next() { n += 1; return 0; }
+            var xs = [0];
+            xs[next()]++;
+            print n;
+            print xs;`,
+			"1\n[1]\n",
+		},
+		{"undefined property",
+			`class Point {}
+            print Point().x;`,
+			"RuntimeError: Undefined property 'x'\n",
+		},
+		{"methods and initializers",
+			`class Counter {
+                init(start) { this.n = start; }
+                inc() { this.n += 1; return this; }
+            }
+            var c = Counter(1);
+            c.inc().inc();
+            print c.n;
+            print c;
+            print Counter;`,
+			"3\n<Counter instance>\n<class Counter>\n",
+		},
+		{"conditional expression",
+			`print true ? 1 : 2;
+            print false ? 1 : nil ? 2 : 3;
+            var f = false ? (x => x) : (x => x + 1);
+            print f(1);`,
+			"1\n3\n2\n",
+		},
+		{"nil-coalescing",
+			`print nil ?? 1;
+            print false ?? 1;
+            print 0 ?? 1 / 0;
+            var a;
+            print a ?? "default";`,
+			"1\nfalse\n0\ndefault\n",
+		},
+		{"optional chaining",
+			`class Box { init(v) { this.v = v; } get() { return this.v; } }
+            var b = Box(Box(1));
+            var n = nil;
+            print b?.v?.v;
+            print n?.v;
+            print n?.v.w.x;
+            print n?.get();
+            print b?.get()?.get();
+            print n?.v ?? "empty";`,
+			"1\nnil\nnil\nnil\n1\nempty\n",
+		},
+		{"optional chaining: non-nil errors",
+			`print 1?.v;`,
+			"RuntimeError: Only instances have properties, got 1\n",
+		},
+		{"map literal",
+			`var m = {a: 1, "b": 2, 3: [4]};
+            print m;
+            print m["a"];
+            print m[3.0];
+            print m["missing"];
+            m["a"] += 10;
+            print m["a"];`,
+			"{\"a\": 1, \"b\": 2, 3: [4]}\n1\n[4]\nnil\n11\n",
+		},
+		{"collections that contain themselves",
+			`var a = [1];
+            a[0] = a;
+            print a;
+            var m = {"self": nil, "list": [a]};
+            m["self"] = m;
+            print m;
+            print [a, a];`,
+			"[[...]]\n{\"self\": {...}, \"list\": [[[...]]]}\n[[[...]], [[...]]]\n",
+		},
+		{"match: literals",
+			`fun describe(v) {
+                match (v) {
+                    case 1 => return "one";
+                    case -1 => return "minus one";
+                    case "a" => return "letter a";
+                    case nil => return "nothing";
+                    case true => return "yes";
+                    case _ => return "other";
+                }
+            }
+            print describe(1);
+            print describe(1.0);
+            print describe(-1);
+            print describe("a");
+            print describe(nil);
+            print describe(true);
+            print describe(2);`,
+			"one\none\nminus one\nletter a\nnothing\nyes\nother\n",
+		},
+		{"match: types",
+			`class Point { init(x) { this.x = x; } }
+            fun describe(v) {
+                match (v) {
+                    case Number n if n > 0 => return "positive";
+                    case Number => return "number";
+                    case String s => return s;
+                    case Point p => return p.x;
+                    case List => return "list";
+                    case x => return x;
+                }
+            }
+            print describe(5);
+            print describe(-5);
+            print describe(Point(3));
+            print describe([]);
+            print describe(false);`,
+			"positive\nnumber\n3\nlist\nfalse\n",
+		},
+		{"match: destructuring",
+			`fun describe(v) {
+                match (v) {
+                    case [] => print "empty";
+                    case [x] => print x;
+                    case [x, 0] => print "ends with zero";
+                    case [first, ...rest] => print rest;
+                    case {"type": "circle", r} => print r;
+                    case {type: "square", "side": [s, _]} => print s;
+                    case {} => print "map";
+                }
+            }
+            describe([]);
+            describe([1]);
+            describe([1, 0]);
+            describe([1, 2, 3]);
+            describe({type: "circle", r: 2});
+            describe({type: "square", side: [3, 4]});
+            describe({type: "other"});`,
+			"empty\n1\nends with zero\n[2, 3]\n2\n3\nmap\n",
+		},
+		{"match: guards",
+			`fun sign(n) {
+                match (n) {
+                    case x if x > 0 => return 1;
+                    case x if x < 0 => return -1;
+                    case _ => return 0;
+                }
+            }
+            print sign(5);
+            print sign(-5);
+            print sign(0);`,
+			"1\n-1\n0\n",
+		},
+		{"match: bindings are scoped",
+			`var x = "outer";
+            match (1) { case x => print x; }
+            print x;`,
+			"1\nouter\n",
+		},
+		{"match: no case matched",
+			`match (3) { case 1 => print 1; case 2 => print 2; }`,
+			"RuntimeError: No case matched 3\n",
+		},
+		{"match: unreachable after wildcard",
+			`match (3) { case _ => print 1; case 2 => print 2; }`,
+			"Resolve Error: Unreachable case 2 in match, case 1 matches everything\n",
+		},
+		{"match: unreachable duplicate",
+			`match (3) { case 2 => print 1; case Number => print 2; case 2 => print 3; }`,
+			"Resolve Error: Unreachable case 3 in match, case 1 has the same pattern\n",
+		},
+		{"generator: next",
+			`fun* count(n) {
+                for (var i = 0; i < n; i++) yield i;
+                return "done";
+            }
+            var g = count(2);
+            print g;
+            print g.next();
+            print g.done;
+            print g.next();
+            print g.next();
+            print g.done;
+            print g.next();`,
+			"<generator count>\n0\nfalse\n1\ndone\ntrue\nnil\n",
+		},
+		{"generator: send",
+			`fun* echo() {
+                var received = yield "ready";
+                while (received != nil) received = yield received * 2;
+            }
+            var g = echo();
+            print g.next();
+            print g.send(1);
+            print g.send(5);
+            print g.send(nil);
+            print g.done;`,
+			"ready\n2\n10\nnil\ntrue\n",
+		},
+		{"generator: send before start",
+			`fun* g() { yield 1; }
+            g().send(1);`,
+			"RuntimeError: Can't send a value to generator g before it has started\n",
+		},
+		{"generator: arguments are bound at the call",
+			`fun* from(start, step = 1) { while (true) { yield start; start = start + step; } }
+            var g = from(10, 5);
+            g.next();
+            print g.next();`,
+			"15\n",
+		},
+		{"generator: methods and expressions",
+			`class Tree {
+                init(items) { this.items = items; }
+                *walk() { for (x in this.items) yield x; }
+            }
+            for (x in Tree([1, 2]).walk()) print x;
+            var g = fun* () { yield "anon"; }();
+            print g;
+            print g.next();`,
+			"1\n2\n<generator anonymous>\nanon\n",
+		},
+		{"generator: errors propagate",
+			`fun* bad() { yield 1; print nope; }
+            var g = bad();
+            print g.next();
+            g.next();
+            print g.done;
+            print g.next();`,
+			"1\nVar nope has never been declared\ntrue\nnil\n",
+		},
+		{"generator: already running",
+			`var g;
+            fun* self() { g.next(); }
+            g = self();
+            g.next();`,
+			"RuntimeError: Generator self is already running\n",
+		},
+		{"generator: close",
+			`fun* g() { yield 1; yield 2; }
+            var it = g();
+            print it.next();
+            it.close();
+            print it.done;
+            print it.next();`,
+			"1\ntrue\nnil\n",
+		},
+		{"generator: yield outside a generator",
+			`fun f() { yield 1; }`,
+			"Resolve Error: 'yield' can only be used inside a generator function\n",
+		},
+		{"generator: yield in a nested function",
+			`fun* g() { var f = fun () { yield 1; }; }`,
+			"Resolve Error: 'yield' can only be used inside a generator function\n",
+		},
+		{"generator: type pattern",
+			`fun* g() {}
+            match (g()) { case Generator => print "generator"; }`,
+			"generator\n",
+		},
+		{"for-in: lists, maps and strings",
+			`for (var x in [1, 2]) print x;
+            for (k in {a: 1, b: 2}) print k;
+            for (c in "hé") print c;`,
+			"1\n2\na\nb\nh\né\n",
+		},
+		{"for-in: return from the body",
+			`fun* naturals() { var n = 0; while (true) yield n++; }
+            fun firstOver(limit) {
+                for (n in naturals()) if (n > limit) return n;
+            }
+            print firstOver(3);`,
+			"4\n",
+		},
+		{"for-in: each iteration has its own variable",
+			`var fns = [];
+            for (x in [1, 2]) fns = [...fns, fun () { return x; }];
+            print fns[0]();
+            print fns[1]();`,
+			"1\n2\n",
+		},
+		{"for-in: classic for loop still works",
+			`var in_ = 0;
+            for (var i = 0; i < 2; i++) print i;`,
+			"0\n1\n",
+		},
+		{"for-in: not iterable",
+			`for (x in 5) print x;`,
+			"RuntimeError: Can't iterate over 5\n",
+		},
 	}
 	is := is.New(t)
 
@@ -106,3 +616,33 @@ func TestOutut(t *testing.T) {
 		})
 	}
 }
+
+func TestGeneratorCleanup(t *testing.T) {
+	is := is.New(t)
+	before := runtime.NumGoroutine()
+
+	var buf bytes.Buffer
+	s := RuntimeState{CurrEnv: NewScopeEnv(nil), OutWriter: &buf}
+	s.Run(`
+        fun* naturals() { var n = 0; while (true) yield n++; }
+        fun first(limit) { for (n in naturals()) if (n == limit) return n; }
+        for (var i = 0; i < 100; i++) first(i);
+
+        var g = naturals();
+        g.next();
+        g.close();
+        print g.done;
+
+        fun* short() { yield 1; }
+        for (x in short()) {}
+    `)
+	is.Equal(buf.String(), "true\n")
+
+	// A finished generator's goroutine exits just after handing back its
+	// last value
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	is.True(runtime.NumGoroutine() <= before)
+}
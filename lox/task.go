@@ -0,0 +1,464 @@
+package lox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+)
+
+// How many statements a task runs before letting other tasks have a
+// turn
+const switchInterval = 1000
+
+// scheduler is shared by a runtime and every task spawned from it.
+// Tasks run on their own goroutines, but only the one holding lock
+// runs Lox code, so scripts can share globals, lists and maps without
+// racing. A task gives up the lock while it's blocked on a channel, an
+// await or a Mutex, and every switchInterval statements.
+type scheduler struct {
+	lock sync.Mutex
+	// Spawned tasks that haven't finished yet
+	tasks   int
+	running sync.WaitGroup
+	steps   int
+	// Broadcast when a task finishes or a channel or Mutex changes,
+	// for the tasks waiting on one
+	changed *sync.Cond
+	// Tasks, counting the one that called Run, waiting on changed.
+	// Once all of them are, nothing is left to wake them up.
+	waiting int
+	// Done once the run is over or a task has stopped it. The cause
+	// is the ExitError or LimitError that stopped it, if any.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// The cause a run's context is canceled with once its statements and
+// event loop have finished
+var errRunFinished = errors.New("the script has finished")
+
+// Starts a run, which every task spawned until finish shares
+func (s *scheduler) start(parent context.Context) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	if s.changed == nil {
+		s.changed = sync.NewCond(&s.lock)
+	}
+	s.ctx, s.cancel = context.WithCancelCause(parent)
+	// Waiting tasks have to wake up to see that the run has stopped
+	context.AfterFunc(s.ctx, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.wake()
+	})
+}
+
+// Wakes every waiting task to check whether what it's waiting for has
+// happened. Called with the lock held.
+func (s *scheduler) wake() {
+	if s == nil || s.changed == nil {
+		return
+	}
+	s.waiting = 0
+	s.changed.Broadcast()
+}
+
+// Waits until ready, which is called with the lock held, returns true,
+// letting other tasks run in the meantime. If every other task is
+// waiting too, nothing can make ready true, so the wait fails with
+// message instead of hanging.
+func (rs *RuntimeState) waitUntil(message string, ready func() bool) error {
+	s := rs.sched
+	for !ready() {
+		select {
+		case <-rs.canceled():
+			return rs.canceledError()
+		default:
+		}
+		if !rs.holdsLock || s.waiting == s.tasks {
+			return RuntimeError{message: message}
+		}
+		s.waiting++
+		s.changed.Wait()
+	}
+	return nil
+}
+
+// Stops the tasks that are still going and waits for them to return.
+// err is what the run itself returned. If it finished cleanly but a
+// task stopped it with os.exit or a limit, that error is returned
+// instead.
+func (rs *RuntimeState) finish(err error) error {
+	s := rs.sched
+	s.cancel(errRunFinished)
+	rs.blocking(s.running.Wait)
+	if cause := context.Cause(s.ctx); err == nil && isStopError(cause) {
+		err = rs.stopError(cause)
+	}
+	s.ctx, s.cancel = nil, nil
+	return err
+}
+
+// Gives other tasks a turn now and then
+func (rs *RuntimeState) tick() {
+	if !rs.holdsLock || rs.sched.tasks == 0 {
+		return
+	}
+	rs.sched.steps++
+	if rs.sched.steps%switchInterval == 0 {
+		rs.sched.lock.Unlock()
+		runtime.Gosched()
+		rs.sched.lock.Lock()
+	}
+}
+
+// Runs f, which may block, without holding the lock so other tasks
+// can run in the meantime
+func (rs *RuntimeState) blocking(f func()) {
+	if !rs.holdsLock {
+		f()
+		return
+	}
+	rs.sched.lock.Unlock()
+	defer rs.sched.lock.Lock()
+	f()
+}
+
+// LoxTask is a call running concurrently, started with `spawn`
+type LoxTask struct {
+	Name string
+	// Closed once the call has returned
+	finished chan struct{}
+	result   Value
+	err      error
+}
+
+func (t *LoxTask) String() string {
+	return fmt.Sprintf("<task %s>", t.Name)
+}
+
+func (t *LoxTask) isDone() bool {
+	select {
+	case <-t.finished:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *LoxTask) get(name string) (Value, error) {
+	switch name {
+	case "done":
+		return t.isDone(), nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined task property '%s'", name)}
+}
+
+// Starts the call on a new goroutine with its own copy of the runtime
+// state, so it has its own current scope
+func (rs *RuntimeState) spawn(callable LoxCallable, args []Value) (*LoxTask, error) {
+	// Without the lock there'd be nothing stopping the task racing the
+	// code that spawned it
+	if !rs.holdsLock {
+		return nil, RuntimeError{message: "Tasks can only be spawned by a script started with Run"}
+	}
+
+	task := &LoxTask{Name: callableName(callable), finished: make(chan struct{})}
+	ts := *rs
+	ts.coroutine = nil
+	// The task outlives the call that spawned it, so it starts its own
+	// stack in profiles
+	ts.frame = nil
+	rs.sched.tasks++
+	rs.sched.running.Add(1)
+
+	go func() {
+		defer ts.sched.running.Done()
+		ts.sched.lock.Lock()
+		defer ts.sched.lock.Unlock()
+		defer func() {
+			ts.sched.tasks--
+			ts.sched.wake()
+		}()
+		defer close(task.finished)
+
+		task.result, task.err = ts.call(callable, args)
+		// os.exit or a limit in any task stops the whole run, even if
+		// nothing awaits the task
+		if isStopError(task.err) {
+			ts.sched.cancel(task.err)
+		}
+	}()
+	return task, nil
+}
+
+// Waits for a task or promise and returns its result, or the error it
+// failed with
+func (rs *RuntimeState) await(value Value) (Value, error) {
+	switch v := value.(type) {
+	case *LoxTask:
+		if err := rs.waitUntil("Awaited a task that can never finish", v.isDone); err != nil {
+			return nil, err
+		}
+		return v.result, v.err
+	case *LoxPromise:
+		// Async functions give the event loop back while they wait
+		if rs.coroutine != nil && rs.coroutine.async {
+			return rs.coroutine.yield(v)
+		}
+		return rs.awaitPromise(v)
+	}
+	return nil, RuntimeError{message: fmt.Sprintf("Can only await a task or promise, got %s", reprValue(value))}
+}
+
+func callableName(callable LoxCallable) string {
+	switch c := callable.(type) {
+	case LoxFunction:
+		if c.Name != "" {
+			return c.Name
+		}
+	case *NativeFunction:
+		return c.Name
+	case *LoxClass:
+		return c.Name
+	}
+	return "anonymous"
+}
+
+// LoxChannel passes values between tasks, created with Channel(cap).
+// Sends block until a receiver takes the value, or until there's room
+// in the buffer if the channel has a capacity.
+type LoxChannel struct {
+	capacity int
+	// Values sent but not received yet. The first capacity of them are
+	// buffered and the rest belong to senders waiting for a receiver.
+	queue []Value
+	// How many values have been sent and received, so a sender can
+	// tell when its value has been taken
+	sent, received int64
+	// How many values will ever be received, set by close(). Senders
+	// still waiting after those get an error.
+	delivered int64
+	isClosed  bool
+}
+
+var channelConstructor = &NativeFunction{Name: "Channel", MinArity: 0, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+	capacity := int64(0)
+	if len(args) > 0 {
+		var err error
+		capacity, err = intArg("Channel", args, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if capacity < 0 || capacity > 1<<20 {
+		return nil, RuntimeError{message: fmt.Sprintf("Channel() capacity must be between 0 and %d, got %d", 1<<20, capacity)}
+	}
+	return &LoxChannel{capacity: int(capacity)}, nil
+}}
+
+func (c *LoxChannel) String() string {
+	return fmt.Sprintf("<channel %d>", c.capacity)
+}
+
+func (c *LoxChannel) send(rs *RuntimeState, value Value) error {
+	if c.isClosed {
+		return RuntimeError{message: "Send on closed channel"}
+	}
+
+	c.queue = append(c.queue, value)
+	c.sent++
+	n := c.sent
+	rs.sched.wake()
+	err := rs.waitUntil("Sent on a channel that no task can ever receive from", func() bool {
+		return c.isClosed || c.received >= n-int64(c.capacity)
+	})
+	if err != nil {
+		// Take the value back. Counting it as received keeps the
+		// senders after this one in the right place.
+		i := n - c.received - 1
+		c.queue = append(c.queue[:i], c.queue[i+1:]...)
+		c.received++
+		return err
+	}
+	if c.isClosed && n > c.delivered {
+		return RuntimeError{message: "Send on closed channel"}
+	}
+	return nil
+}
+
+// Whether a receive would return straight away
+func (c *LoxChannel) ready() bool {
+	return len(c.queue) > 0 || c.isClosed
+}
+
+// Waits for a value. Returns false once the channel is closed and
+// every buffered value has been received.
+func (c *LoxChannel) recv(rs *RuntimeState) (Value, bool, error) {
+	err := rs.waitUntil("Received from a channel that can never get a value", c.ready)
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := c.take(rs)
+	return value, ok, nil
+}
+
+// Takes the next value without blocking, or returns false if there
+// isn't one
+func (c *LoxChannel) take(rs *RuntimeState) (Value, bool) {
+	if len(c.queue) == 0 {
+		return Null(nil), false
+	}
+	value := c.queue[0]
+	c.queue = c.queue[1:]
+	c.received++
+	rs.sched.wake()
+	return value, true
+}
+
+func (c *LoxChannel) close(rs *RuntimeState) error {
+	if c.isClosed {
+		return RuntimeError{message: "Channel is already closed"}
+	}
+	c.isClosed = true
+	// Buffered values can still be received, but senders waiting for
+	// a receiver fail
+	if len(c.queue) > c.capacity {
+		c.queue = c.queue[:c.capacity]
+	}
+	c.delivered = c.received + int64(len(c.queue))
+	rs.sched.wake()
+	return nil
+}
+
+func (c *LoxChannel) get(name string) (Value, error) {
+	switch name {
+	case "capacity":
+		return int64(c.capacity), nil
+	case "closed":
+		return c.isClosed, nil
+	case "send":
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return Null(nil), c.send(rs, args[0])
+		}}, nil
+	case "recv":
+		// nil once the channel is closed and empty
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			value, _, err := c.recv(rs)
+			return value, err
+		}}, nil
+	case "close":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return Null(nil), c.close(rs)
+		}}, nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined channel property '%s'", name)}
+}
+
+// select(a, b, ...) waits until any of the channels has a value and
+// returns [channel, value]. A closed channel that's empty is ready too,
+// with a nil value.
+var selectFn = &NativeFunction{Name: "select", MinArity: 1, MaxArity: VARIADIC, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+	channels := make([]*LoxChannel, len(args))
+	for i, arg := range args {
+		c, ok := arg.(*LoxChannel)
+		if !ok {
+			return nil, argError("select", i, "a channel", arg)
+		}
+		channels[i] = c
+	}
+
+	// Like Go's select, a random one of the ready channels is picked
+	var c *LoxChannel
+	err := rs.waitUntil("select() on channels that can never get a value", func() bool {
+		start := rand.Intn(len(channels))
+		for i := range channels {
+			if ch := channels[(start+i)%len(channels)]; ch.ready() {
+				c = ch
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	value, _ := c.take(rs)
+	return NewLoxList([]Value{c, value}), nil
+}}
+
+// LoxMutex lets tasks take turns with shared state, created with
+// Mutex()
+type LoxMutex struct {
+	locked bool
+}
+
+var mutexConstructor = &NativeFunction{Name: "Mutex", MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+	return &LoxMutex{}, nil
+}}
+
+func (m *LoxMutex) String() string {
+	return "<mutex>"
+}
+
+func (m *LoxMutex) lock(rs *RuntimeState) error {
+	err := rs.waitUntil("Locked a Mutex that can never be unlocked", func() bool { return !m.locked })
+	if err != nil {
+		return err
+	}
+	m.locked = true
+	return nil
+}
+
+func (m *LoxMutex) unlock(rs *RuntimeState) error {
+	if !m.locked {
+		return RuntimeError{message: "Unlock of unlocked Mutex"}
+	}
+	m.locked = false
+	rs.sched.wake()
+	return nil
+}
+
+func (m *LoxMutex) get(name string) (Value, error) {
+	switch name {
+	case "locked":
+		return m.locked, nil
+	case "lock":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return Null(nil), m.lock(rs)
+		}}, nil
+	case "tryLock":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			if m.locked {
+				return false, nil
+			}
+			m.locked = true
+			return true, nil
+		}}, nil
+	case "unlock":
+		return &NativeFunction{Name: name, MinArity: 0, MaxArity: 0, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			return Null(nil), m.unlock(rs)
+		}}, nil
+	case "withLock":
+		// Calls fn while holding the lock, unlocking even if it fails
+		return &NativeFunction{Name: name, MinArity: 1, MaxArity: 1, Fn: func(rs *RuntimeState, args []Value) (Value, error) {
+			fn, ok := args[0].(LoxCallable)
+			if !ok {
+				return nil, argError(name, 0, "a function", args[0])
+			}
+			if err := m.lock(rs); err != nil {
+				return nil, err
+			}
+			defer m.unlock(rs)
+			return rs.call(fn, nil)
+		}}, nil
+	}
+
+	return nil, RuntimeError{message: fmt.Sprintf("Undefined Mutex property '%s'", name)}
+}
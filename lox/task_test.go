@@ -0,0 +1,229 @@
+package lox
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestTasks(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"spawn and await",
+			`fun add(a, b) { return a + b; }
+            var t = spawn add(1, 2);
+            print await t;
+            print t.done;
+            print t;
+            print await t;`,
+			"3\ntrue\n<task add>\n3\n"},
+		{"await propagates errors",
+			`fun bad() { return 1 + "a"; }
+            var t = spawn bad();
+            await t;
+            print "after";`,
+			"RuntimeError: Operands of '+' must be two numbers or two strings, got 1 and \"a\"\nafter\n"},
+		{"spawn needs a call",
+			`spawn f;`,
+			"Parse Error: Expected a function call after 'spawn'\n"},
+		{"await needs a task",
+			`await 1;`,
+			"RuntimeError: Can only await a task or promise, got 1\n"},
+		{"channel between tasks",
+			`fun produce(ch, n) {
+                for (var i = 0; i < n; i++) ch.send(i);
+                ch.close();
+            }
+            var ch = Channel();
+            spawn produce(ch, 3);
+            var v = ch.recv();
+            while (v != nil) { print v; v = ch.recv(); }
+            print ch.closed;`,
+			"0\n1\n2\ntrue\n"},
+		{"for-in over a channel",
+			`fun produce(ch) { ch.send("a"); ch.send("b"); ch.close(); }
+            var ch = Channel(1);
+            spawn produce(ch);
+            for (v in ch) print v;`,
+			"a\nb\n"},
+		{"buffered channel",
+			`var ch = Channel(2);
+            ch.send(1);
+            ch.send(2);
+            ch.close();
+            print ch.capacity;
+            print ch.recv();
+            print ch.recv();
+            print ch.recv();`,
+			"2\n1\n2\nnil\n"},
+		{"closed channel",
+			`var ch = Channel(1);
+            ch.close();
+            ch.send(1);
+            ch.close();`,
+			"RuntimeError: Send on closed channel\nRuntimeError: Channel is already closed\n"},
+		{"blocked send fails when closed",
+			`var ch = Channel();
+            fun send() { ch.send(1); }
+            var t = spawn send();
+            time.sleep(5);
+            ch.close();
+            await t;`,
+			"RuntimeError: Send on closed channel\n"},
+		{"select",
+			`var a = Channel(1);
+            var b = Channel(1);
+            b.send("from b");
+            var r = select(a, b);
+            print r[0] == b;
+            print r[1];
+            a.close();
+            print select(a)[1];
+            select(a, 1);`,
+			"true\nfrom b\nnil\nRuntimeError: select() argument 2 must be a channel, got 1\n"},
+		{"mutex",
+			`var counter = 0;
+            var m = Mutex();
+            fun work() {
+                for (var i = 0; i < 500; i++) {
+                    m.lock();
+                    var read = counter;
+                    counter = read + 1;
+                    m.unlock();
+                }
+            }
+            var tasks = [spawn work(), spawn work(), spawn work()];
+            for (t in tasks) await t;
+            print counter;
+            print m.withLock(fun () { return m.locked; });
+            print m.locked;`,
+			"1500\ntrue\nfalse\n"},
+		{"tryLock and unlock",
+			`var m = Mutex();
+            print m.tryLock();
+            print m.tryLock();
+            m.unlock();
+            m.unlock();`,
+			"true\nfalse\nRuntimeError: Unlock of unlocked Mutex\n"},
+		{"shared globals",
+			`var seen = {};
+            var list = [];
+            fun fill(prefix) {
+                for (var i = 0; i < 2000; i++) {
+                    seen[prefix + strings.toString(i)] = i;
+                    list = [...list, i];
+                }
+            }
+            var tasks = [spawn fill("a"), spawn fill("b"), spawn fill("c")];
+            for (t in tasks) await t;
+            var keys = 0;
+            for (k in seen) keys++;
+            var items = 0;
+            for (v in list) items++;
+            print keys;
+            print items;`,
+			"6000\n6000\n"},
+		{"busy tasks take turns",
+			`var stop = false;
+            fun spin() { while (!stop) {} return "stopped"; }
+            var t = spawn spin();
+            time.sleep(5);
+            stop = true;
+            print await t;`,
+			"stopped\n"},
+		{"receive with every task blocked",
+			`var c = Channel();
+            print c.recv();
+            print "after";`,
+			"RuntimeError: Received from a channel that can never get a value\nafter\n"},
+		{"send with every task blocked",
+			`var c = Channel();
+            c.send(1);
+            c.close();
+            print c.recv();`,
+			"RuntimeError: Sent on a channel that no task can ever receive from\nnil\n"},
+		{"lock with every task blocked",
+			`var m = Mutex();
+            m.lock();
+            m.lock();`,
+			"RuntimeError: Locked a Mutex that can never be unlocked\n"},
+		{"await a blocked task",
+			`var t = spawn Channel().recv();
+            await t;`,
+			"RuntimeError: Received from a channel that can never get a value\n"},
+		{"type patterns",
+			`fun f() {}
+            match (spawn f()) { case Task => print "task"; }
+            match (Channel()) { case Channel => print "channel"; }
+            match (Mutex()) { case Mutex => print "mutex"; }`,
+			"task\nchannel\nmutex\n"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			s := NewRuntimeState()
+			s.OutWriter = &buf
+			s.ErrWriter = &buf
+
+			err := s.Run(tc.input)
+
+			is.NoErr(err)
+			is.Equal(buf.String(), tc.output)
+		})
+	}
+}
+
+func TestUnfinishedTasks(t *testing.T) {
+	is := is.New(t)
+
+	t.Run("stopped when the script ends", func(t *testing.T) {
+		var buf bytes.Buffer
+		s := NewRuntimeState()
+		s.OutWriter = &buf
+		s.ErrWriter = &buf
+
+		err := s.Run(`fun forever() { while (true) time.sleep(1); }
+            var t = spawn forever();
+            print "done";`)
+		is.NoErr(err)
+		is.NoErr(s.Run(`print t.done;`))
+		is.Equal(buf.String(), "done\ntrue\n")
+	})
+
+	t.Run("os.exit stops the run", func(t *testing.T) {
+		var buf bytes.Buffer
+		s := NewRuntimeState()
+		s.OutWriter = &buf
+		s.ErrWriter = &buf
+
+		err := s.Run(`fun quit() { os.exit(3); }
+            spawn quit();
+            time.sleep(10000);
+            print "unreached";`)
+		is.Equal(err, ExitError{Code: 3})
+		is.Equal(buf.String(), "")
+	})
+
+	t.Run("limits stop the run", func(t *testing.T) {
+		var buf bytes.Buffer
+		s := NewRuntimeState()
+		s.OutWriter = &buf
+		s.ErrWriter = &buf
+		s.Limits = Limits{MaxSteps: 1000}
+
+		err := s.Run(`fun spin() { while (true) {} }
+            spawn spin();
+            time.sleep(10000);
+            print "unreached";`)
+		is.True(errors.As(err, new(StepLimitError)))
+		is.Equal(buf.String(), "Limit Error: exceeded the limit of 1000 steps\n")
+	})
+}
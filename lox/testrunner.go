@@ -0,0 +1,300 @@
+package lox
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TestRunner runs the test_* functions of Lox test files, each in a
+// fresh runtime. A file's top level runs again before every test, then
+// its setup function if it has one, the test, and teardown.
+type TestRunner struct {
+	// When set, only tests whose names match run
+	Filter *regexp.Regexp
+	// Options for each test's runtime
+	Options []Option
+	// Shared by every test when set
+	Coverage *Coverage
+
+	// Replaced in tests for repeatable timings
+	now func() time.Time
+}
+
+// TestResult is the outcome of running one test function
+type TestResult struct {
+	File string
+	Name string
+	// Nil when the test passed
+	Err      error
+	Duration time.Duration
+	// Everything the test printed
+	Output string
+}
+
+// The names of the test_* functions a program declares at the top
+// level, in order
+func testFunctions(program ProgramNode) []string {
+	var names []string
+	for _, stmt := range program.Statements {
+		if f, ok := stmt.(FunctionDeclarationStmt); ok && strings.HasPrefix(f.Name, "test_") {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// RunFile runs the tests in source, which was read from path. It only
+// returns an error when the file doesn't compile.
+func (r *TestRunner) RunFile(path string, source string) ([]TestResult, error) {
+	program, err := compile(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []TestResult
+	for _, name := range testFunctions(program) {
+		if r.Filter != nil && !r.Filter.MatchString(name) {
+			continue
+		}
+		results = append(results, r.runTest(path, source, program, name))
+	}
+	return results, nil
+}
+
+func (r *TestRunner) runTest(path string, source string, program ProgramNode, name string) TestResult {
+	now := r.now
+	if now == nil {
+		now = time.Now
+	}
+
+	var out bytes.Buffer
+	rs := NewRuntimeState(r.Options...)
+	rs.OutWriter = &out
+	rs.ErrWriter = &out
+	rs.ScriptPath = path
+	rs.script = path
+	rs.Coverage = r.Coverage
+	if rs.Coverage != nil {
+		rs.Coverage.register(path, source, program)
+	}
+	declareAssertions(rs.GlobalEnv)
+
+	start := now()
+	err := rs.execute(func() error {
+		for _, stmt := range program.Statements {
+			if _, err := rs.Interpret(stmt); err != nil {
+				return err
+			}
+		}
+
+		if err := rs.callHook("setup"); err != nil {
+			return err
+		}
+		err := rs.callTest(name)
+		// Teardown runs even when the test fails, but its own error
+		// is only reported if the test passed
+		if teardownErr := rs.callHook("teardown"); err == nil {
+			err = teardownErr
+		}
+		return err
+	})
+
+	return TestResult{
+		File:     path,
+		Name:     name,
+		Err:      err,
+		Duration: now().Sub(start),
+		Output:   out.String(),
+	}
+}
+
+// Calls the global function name if the test file declares one
+func (rs *RuntimeState) callHook(name string) error {
+	if hook, err := rs.GlobalEnv.Lookup(name); err != nil || !isLoxFunction(hook) {
+		return nil
+	}
+	return rs.callTest(name)
+}
+
+func isLoxFunction(v Value) bool {
+	_, ok := v.(LoxFunction)
+	return ok
+}
+
+// Calls a global function, waiting for it to finish if it's async
+func (rs *RuntimeState) callTest(name string) error {
+	value, err := rs.GlobalEnv.Lookup(name)
+	if err != nil {
+		return err
+	}
+	f, ok := value.(LoxCallable)
+	if !ok {
+		return RuntimeError{message: fmt.Sprintf("%s is not a function, got %s", name, reprValue(value))}
+	}
+
+	result, err := rs.call(f, nil)
+	if promise, ok := result.(*LoxPromise); ok && err == nil {
+		_, err = rs.await(promise)
+	}
+	return err
+}
+
+// TestReport collects the results of a test run
+type TestReport []TestResult
+
+// Failed counts the tests that didn't pass
+func (r TestReport) Failed() int {
+	failed := 0
+	for _, result := range r {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+func (r TestReport) duration() time.Duration {
+	var total time.Duration
+	for _, result := range r {
+		total += result.Duration
+	}
+	return total
+}
+
+func indent(text string, prefix string) string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	return prefix + strings.Join(lines, "\n"+prefix) + "\n"
+}
+
+// WriteText lists failed tests with their error and output, then a
+// summary line. verbose lists the tests that passed too.
+func (r TestReport) WriteText(w io.Writer, verbose bool) error {
+	var b strings.Builder
+	for _, result := range r {
+		status := "ok  "
+		if result.Err != nil {
+			status = "FAIL"
+		} else if !verbose {
+			continue
+		}
+		fmt.Fprintf(&b, "%s %s %s (%.3fs)\n", status, result.File, result.Name, result.Duration.Seconds())
+		if result.Err != nil {
+			b.WriteString(indent(result.Err.Error(), "    "))
+		}
+		if result.Output != "" && (result.Err != nil || verbose) {
+			b.WriteString(indent(result.Output, "    | "))
+		}
+	}
+
+	if failed := r.Failed(); failed > 0 {
+		fmt.Fprintf(&b, "FAIL: %d of %d tests failed (%.3fs)\n", failed, len(r), r.duration().Seconds())
+	} else {
+		fmt.Fprintf(&b, "ok: %d tests passed (%.3fs)\n", len(r), r.duration().Seconds())
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteTAP writes the results in the Test Anything Protocol, version 13
+func (r TestReport) WriteTAP(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TAP version 13\n1..%d\n", len(r))
+	for i, result := range r {
+		status := "ok"
+		if result.Err != nil {
+			status = "not ok"
+		}
+		fmt.Fprintf(&b, "%s %d - %s %s\n", status, i+1, result.File, result.Name)
+
+		// Details go in a YAML block. Go's quoting is valid YAML for
+		// the printable text errors and output are made of.
+		b.WriteString("  ---\n")
+		fmt.Fprintf(&b, "  duration_ms: %.3f\n", float64(result.Duration)/float64(time.Millisecond))
+		if result.Err != nil {
+			fmt.Fprintf(&b, "  message: %q\n", result.Err.Error())
+		}
+		if result.Output != "" {
+			fmt.Fprintf(&b, "  output: %q\n", result.Output)
+		}
+		b.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the results as JUnit XML, with a test suite for
+// each file
+func (r TestReport) WriteJUnit(w io.Writer) error {
+	suites := junitSuites{Tests: len(r), Failures: r.Failed(), Time: junitTime(r.duration())}
+
+	var files []string
+	byFile := make(map[string]TestReport)
+	for _, result := range r {
+		if _, ok := byFile[result.File]; !ok {
+			files = append(files, result.File)
+		}
+		byFile[result.File] = append(byFile[result.File], result)
+	}
+
+	for _, file := range files {
+		results := byFile[file]
+		suite := junitSuite{Name: file, Tests: len(results), Failures: results.Failed(), Time: junitTime(results.duration())}
+		for _, result := range results {
+			c := junitCase{Name: result.Name, ClassName: file, Time: junitTime(result.Duration), SystemOut: result.Output}
+			if result.Err != nil {
+				c.Failure = &junitFailure{Message: result.Err.Error(), Text: result.Err.Error()}
+			}
+			suite.Cases = append(suite.Cases, c)
+		}
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,208 @@
+package lox
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// A test runner where every test takes half a millisecond
+func newTestRunner() *TestRunner {
+	r := &TestRunner{}
+	now := time.Unix(0, 0)
+	r.now = func() time.Time {
+		now = now.Add(time.Millisecond / 2)
+		return now
+	}
+	return r
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestAssertions(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"assert", `assert(1 < 2);`, ""},
+		{"assert fails", `assert(1 > 2);`, "AssertionError: assertion failed"},
+		{"assert message", `assert(false, "custom");`, "AssertionError: custom"},
+		{"equal numbers", `assertEqual(1, 1.0);`, ""},
+		{"not equal", `assertEqual(1 + 1, 3);`, "AssertionError: expected 3, got 2"},
+		{"equal message", `assertEqual("a", "b", "letters");`, "AssertionError: letters"},
+		{"deep lists", `assertEqual([1, [2, "x"]], [1, [2, "x"]]);`, ""},
+		{"deep lists differ", `assertEqual([1, [2]], [1, [3]]);`, "AssertionError: expected [1, [3]], got [1, [2]]"},
+		{"list lengths", `assertEqual([1], [1, 1]);`, "AssertionError: expected [1, 1], got [1]"},
+		{"maps ignore order", `assertEqual({"a": [1], "b": 2}, {"b": 2, "a": [1]});`, ""},
+		{"maps differ", `assertEqual({"a": 1}, {"a": 2});`, `AssertionError: expected {"a": 2}, got {"a": 1}`},
+		{"instances", `class P { init(x) { this.x = [x]; } }
+assertEqual(P(1), P(1));`, ""},
+		{"instance fields", `class P { init(x) { this.x = x; } }
+assertEqual(P(1), P(2));`, "AssertionError: expected <P instance>, got <P instance>"},
+		{"instance classes", `class P {} class Q {}
+assertEqual(P(), Q());`, "AssertionError: expected <Q instance>, got <P instance>"},
+		{"cycles", `var a = [1, nil]; a[1] = a; var b = [1, nil]; b[1] = b;
+assertEqual(a, b);`, ""},
+		{"cycles differ", `var a = [1]; a[0] = a;
+assertEqual(a, [2]);`, "AssertionError: expected [2], got [[...]]"},
+		{"throws", `var msg = assertThrows(fun() { return 1 / nil; });
+assertEqual(msg, "RuntimeError: Operands of 'SLASH' must be numbers, got 1 and nil");`, ""},
+		{"throws text", `assertThrows(fun() { assert(false, "boom"); }, "boom");`, ""},
+		{"throws wrong text", `assertThrows(fun() { assert(false, "boom"); }, "bang");`,
+			`AssertionError: expected an error containing "bang", got "AssertionError: boom"`},
+		{"doesn't throw", `fun ok() {} assertThrows(ok);`, "AssertionError: expected <fn ok> to throw"},
+		{"throws needs a function", `assertThrows(1);`, "RuntimeError: assertThrows() argument 1 must be a function, got 1"},
+	}
+	is := is.New(t)
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := newTestRunner().RunFile("assert_test.lox", tc.input+"\nfun test_it() {}")
+			is.NoErr(err)
+			is.Equal(len(results), 1)
+			is.Equal(errorText(results[0].Err), tc.err)
+		})
+	}
+}
+
+const runnerScript = `var log = [];
+var count = 0;
+fun setup() { count++; log = [...log, "setup"]; }
+fun teardown() { log = [...log, "teardown"]; print log; }
+
+fun test_fresh_runtime() {
+  assertEqual(count, 1);
+}
+fun test_fails() {
+  print "some output";
+  assertEqual([1, 2], [1, 3]);
+}
+fun test_teardown_after_failure() {
+  log = [...log, "test"];
+  1 / nil;
+}
+async fun test_async() {
+  var p = Promise(fun(resolve, reject) { setTimeout(fun() { reject("late"); }, 0); });
+  await p;
+}
+fun helper() {}`
+
+func TestRunnerResults(t *testing.T) {
+	is := is.New(t)
+
+	results, err := newTestRunner().RunFile("runner_test.lox", runnerScript)
+	is.NoErr(err)
+
+	var names, errs, outputs []string
+	for _, r := range results {
+		names = append(names, r.Name)
+		errs = append(errs, errorText(r.Err))
+		outputs = append(outputs, r.Output)
+		is.Equal(r.Duration, time.Millisecond/2)
+	}
+	is.Equal(names, []string{"test_fresh_runtime", "test_fails", "test_teardown_after_failure", "test_async"})
+	is.Equal(errs, []string{
+		"",
+		"AssertionError: expected [1, 3], got [1, 2]",
+		"RuntimeError: Operands of 'SLASH' must be numbers, got 1 and nil",
+		`RuntimeError: Promise rejected with "late"`,
+	})
+	is.Equal(outputs, []string{
+		`["setup", "teardown"]` + "\n",
+		"some output\n" + `["setup", "teardown"]` + "\n",
+		`["setup", "test", "teardown"]` + "\n",
+		`["setup", "teardown"]` + "\n",
+	})
+}
+
+func TestRunnerFilter(t *testing.T) {
+	is := is.New(t)
+
+	r := newTestRunner()
+	r.Filter = regexp.MustCompile("fresh|async")
+	results, err := r.RunFile("runner_test.lox", runnerScript)
+	is.NoErr(err)
+	is.Equal(len(results), 2)
+	is.Equal(results[0].Name, "test_fresh_runtime")
+	is.Equal(results[1].Name, "test_async")
+
+	_, err = r.RunFile("broken_test.lox", "fun test_x( {}")
+	is.True(err != nil)
+}
+
+func TestRunnerTopLevelError(t *testing.T) {
+	is := is.New(t)
+
+	results, err := newTestRunner().RunFile("top_test.lox", `var x = nil + 1;
+fun test_a() {}`)
+	is.NoErr(err)
+	is.Equal(errorText(results[0].Err), "RuntimeError: Operands of '+' must be two numbers or two strings, got nil and 1")
+}
+
+func TestReports(t *testing.T) {
+	is := is.New(t)
+
+	results, err := newTestRunner().RunFile("runner_test.lox", runnerScript)
+	is.NoErr(err)
+	report := TestReport(results[:2])
+	is.Equal(report.Failed(), 1)
+
+	var text, verbose, tap, junit bytes.Buffer
+	is.NoErr(report.WriteText(&text, false))
+	is.Equal(text.String(), `FAIL runner_test.lox test_fails (0.001s)
+    AssertionError: expected [1, 3], got [1, 2]
+    | some output
+    | ["setup", "teardown"]
+FAIL: 1 of 2 tests failed (0.001s)
+`)
+
+	is.NoErr(report.WriteText(&verbose, true))
+	is.Equal(verbose.String(), `ok   runner_test.lox test_fresh_runtime (0.001s)
+    | ["setup", "teardown"]
+FAIL runner_test.lox test_fails (0.001s)
+    AssertionError: expected [1, 3], got [1, 2]
+    | some output
+    | ["setup", "teardown"]
+FAIL: 1 of 2 tests failed (0.001s)
+`)
+
+	is.NoErr(report.WriteTAP(&tap))
+	is.Equal(tap.String(), `TAP version 13
+1..2
+ok 1 - runner_test.lox test_fresh_runtime
+  ---
+  duration_ms: 0.500
+  output: "[\"setup\", \"teardown\"]\n"
+  ...
+not ok 2 - runner_test.lox test_fails
+  ---
+  duration_ms: 0.500
+  message: "AssertionError: expected [1, 3], got [1, 2]"
+  output: "some output\n[\"setup\", \"teardown\"]\n"
+  ...
+`)
+
+	is.NoErr(report.WriteJUnit(&junit))
+	is.Equal(junit.String(), `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites tests="2" failures="1" time="0.001">
+  <testsuite name="runner_test.lox" tests="2" failures="1" time="0.001">
+    <testcase name="test_fresh_runtime" classname="runner_test.lox" time="0.001">
+      <system-out>[&#34;setup&#34;, &#34;teardown&#34;]&#xA;</system-out>
+    </testcase>
+    <testcase name="test_fails" classname="runner_test.lox" time="0.001">
+      <failure message="AssertionError: expected [1, 3], got [1, 2]">AssertionError: expected [1, 3], got [1, 2]</failure>
+      <system-out>some output&#xA;[&#34;setup&#34;, &#34;teardown&#34;]&#xA;</system-out>
+    </testcase>
+  </testsuite>
+</testsuites>
+`)
+}
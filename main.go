@@ -2,18 +2,84 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/drewhayward/glox/lox"
 )
 
-func runFile(path string) {
+var (
+	allowRun = flag.Bool("allow-run", false, "Allow scripts to run subprocesses with os.run")
+	sandbox  = flag.Bool("sandbox", false, "Deny scripts access to files, the environment, processes and the clock")
+
+	maxSteps = flag.Int64("max-steps", 0, "Stop the script after `n` statements and calls")
+	maxDepth = flag.Int("max-depth", 0, "Stop the script when calls nest deeper than `n`")
+	maxAlloc = flag.Int64("max-alloc", 0, "Stop the script after it allocates about `n` bytes")
+	timeout  = flag.Duration("timeout", 0, "Stop the script after `duration`")
+
+	cpuProfile = flag.String("cpuprofile", "", "Write a pprof profile of the script's time and allocations to `file`")
+	profileTop = flag.Int("profile-top", 0, "Print the `n` functions and lines that took the most time to stderr")
+)
+
+// The capabilities granted by the command-line flags
+func capabilities() []lox.Capability {
+	caps := lox.DefaultCapabilities
+	if *sandbox {
+		caps = nil
+	}
+	if *allowRun {
+		caps = append([]lox.Capability{lox.CapProcess}, caps...)
+	}
+	return caps
+}
+
+// Exit statuses, besides the code a script passes to os.exit. Compile
+// and runtime errors use the same ones as the book's interpreters, and
+// a script that can't be read uses EX_NOINPUT from sysexits.h.
+const (
+	limitExitCode   = 3
+	compileExitCode = 65
+	noInputExitCode = 66
+	runtimeExitCode = 70
+)
+
+// Makes a runtime with the capabilities and limits from the
+// command-line flags. cancel releases the -timeout.
+func newRuntime() (rs lox.RuntimeState, cancel context.CancelFunc) {
+	rs = lox.NewRuntimeState(lox.WithCapabilities(capabilities()...))
+	rs.ErrorLines = true
+	rs.Limits = lox.Limits{MaxSteps: *maxSteps, MaxCallDepth: *maxDepth, MaxAlloc: *maxAlloc}
+	cancel = func() {}
+	if *timeout > 0 {
+		rs.Context, cancel = context.WithTimeout(context.Background(), *timeout)
+	}
+	return rs, cancel
+}
+
+// The exit status for an error returned by Run, and whether it should
+// end the process: the code given to os.exit, or limitExitCode for a
+// limit or timeout
+func exitCode(err error) (int, bool) {
+	var exit lox.ExitError
+	if errors.As(err, &exit) {
+		return exit.Code, true
+	}
+	if errors.As(err, new(lox.LimitError)) {
+		return limitExitCode, true
+	}
+	return 0, false
+}
+
+func runFile(path string, args []string) {
 	file, err := os.Open(path)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(noInputExitCode)
 	}
 
 	defer file.Close()
@@ -21,18 +87,78 @@ func runFile(path string) {
 	data, err := io.ReadAll(file)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
+		file.Close()
+		os.Exit(noInputExitCode)
+	}
+	rs, cancel := newRuntime()
+	defer cancel()
+	rs.ScriptPath = path
+	if *sandbox {
+		// Sandboxed scripts can only import from their own directory
+		rs.ModuleFS = lox.DirFS(filepath.Dir(path))
+		rs.ScriptPath = filepath.Base(path)
+	}
+	rs.SetArgs(args)
+	if *cpuProfile != "" || *profileTop > 0 {
+		rs.Profiler = lox.NewProfiler()
+	}
+
+	err = rs.Run(string(data))
+	if rs.Profiler != nil {
+		writeProfile(rs.Profiler)
+	}
+	code, ok := exitCode(err)
+	switch {
+	case ok:
+	case rs.HadError:
+		code = compileExitCode
+	case rs.HadRuntimeError:
+		code = runtimeExitCode
+	default:
+		return
+	}
+	file.Close()
+	cancel()
+	os.Exit(code)
+}
+
+func writeProfile(p *lox.Profiler) {
+	if *profileTop > 0 {
+		p.WriteSummary(os.Stderr, *profileTop)
+	}
+	if *cpuProfile == "" {
+		return
+	}
+
+	f, err := os.Create(*cpuProfile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+	defer f.Close()
+	if err := p.WriteProfile(f); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
 	}
-	rs := lox.NewRuntimeState()
-	rs.Run(string(data))
 }
 
 func runPrompt() {
 	scanner := bufio.NewScanner(os.Stdin)
-	rs := lox.NewRuntimeState()
+	rs, cancel := newRuntime()
+	defer cancel()
+	if *sandbox {
+		rs.ModuleFS = lox.DirFS(".")
+	}
 	print("> ")
 	for scanner.Scan() {
 		line := scanner.Text()
-		rs.Run(line)
+		// Limits count the whole session, so once one is hit every
+		// line after it would fail too
+		if code, ok := exitCode(rs.Run(line)); ok {
+			cancel()
+			os.Exit(code)
+		}
+		// A mistake on one line doesn't end the session
+		rs.HadError, rs.HadRuntimeError = false, false
 
 		print("> ")
 	}
@@ -40,12 +166,26 @@ func runPrompt() {
 
 func main() {
 	flag.Bool("v", false, "Verbose parsing and lexing")
-	flag.Parse()
 
-	if len(os.Args) == 1 {
-		fmt.Println("Usage: glox [script]")
+	// `glox run script.lox` is the same as `glox script.lox`
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "run":
+			args = args[1:]
+		case "test":
+			os.Exit(testCommand(args[1:]))
+		case "cover":
+			os.Exit(coverCommand(args[1:]))
+		}
+	}
+	flag.CommandLine.Parse(args)
+
+	// Arguments after the script path are passed on to the script
+	if flag.NArg() == 0 {
+		fmt.Println("Usage: glox [run] [flags] [script [args...]] | glox test [flags] [paths...] | glox cover [flags] profiles...")
 		runPrompt()
-	} else if len(os.Args) == 2 {
-		runFile(os.Args[1])
+	} else {
+		runFile(flag.Arg(0), flag.Args()[1:])
 	}
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/drewhayward/glox/lox"
+)
+
+// Finds the *_test.lox files under each path, or in the current
+// directory when there are none
+func findTestFiles(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var files []string
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(path, "_test.lox") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Converts path to a name in the sandbox's lox.DirFS("."), so imports
+// resolve next to the test file. Files outside the current directory
+// keep their path, and can't import anything.
+func moduleFSPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || !fs.ValidPath(filepath.ToSlash(rel)) {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func isTestFile(path string) bool {
+	return strings.HasSuffix(path, "_test.lox")
+}
+
+// `glox test [flags] [paths...]` runs the test_* functions in every
+// test file it finds
+func testCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	run := flags.String("run", "", "Only run tests whose names match `regexp`")
+	verbose := flags.Bool("v", false, "List every test and what it printed, not just failures")
+	format := flags.String("format", "text", "Report results as text, tap or junit")
+	out := flags.String("o", "", "Write the report to `file` instead of standard output")
+	cover := flags.Bool("cover", false, "Print how much of the code the tests ran")
+	coverProfile := flags.String("coverprofile", "", "Write an LCOV coverage profile to `file`")
+	coverHTML := flags.String("coverhtml", "", "Write the source annotated with coverage to `file`")
+	flags.BoolVar(allowRun, "allow-run", *allowRun, "Allow tests to run subprocesses with os.run")
+	flags.BoolVar(sandbox, "sandbox", *sandbox, "Deny tests access to files, the environment, processes and the clock")
+	flags.Parse(args)
+
+	runner := &lox.TestRunner{Options: []lox.Option{lox.WithCapabilities(capabilities()...)}}
+	if *sandbox {
+		// Sandboxed tests can only import from the current directory
+		runner.Options = append(runner.Options, lox.WithModuleFS(lox.DirFS(".")))
+	}
+	if *run != "" {
+		filter, err := regexp.Compile(*run)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 2
+		}
+		runner.Filter = filter
+	}
+	if *cover || *coverProfile != "" || *coverHTML != "" {
+		runner.Coverage = lox.NewCoverage()
+	}
+
+	files, err := findTestFiles(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	var report lox.TestReport
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		if *sandbox {
+			path = moduleFSPath(path)
+		}
+		results, err := runner.RunFile(path, string(data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+		report = append(report, results...)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		defer w.Close()
+	}
+	switch *format {
+	case "text":
+		err = report.WriteText(w, *verbose)
+	case "tap":
+		err = report.WriteTAP(w)
+	case "junit":
+		err = report.WriteJUnit(w)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	status := 0
+	if report.Failed() > 0 {
+		status = 1
+	}
+	if runner.Coverage == nil {
+		return status
+	}
+	runner.Coverage.Filter(func(path string) bool { return !isTestFile(path) })
+	if *cover {
+		// A TAP or JUnit report on standard output is read by CI, which
+		// the summary after it would break
+		summary := os.Stdout
+		if *format != "text" && *out == "" {
+			summary = os.Stderr
+		}
+		runner.Coverage.WriteSummary(summary)
+	}
+	return max(status, writeCoverage(runner.Coverage, *coverProfile, *coverHTML))
+}
+
+// `glox cover [flags] profiles...` merges LCOV profiles, e.g. from
+// separate test runs
+func coverCommand(args []string) int {
+	flags := flag.NewFlagSet("cover", flag.ExitOnError)
+	out := flags.String("o", "", "Write the merged LCOV profile to `file`")
+	html := flags.String("html", "", "Write the source annotated with coverage to `file`")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: glox cover [-o file] [-html file] profiles...")
+		return 2
+	}
+
+	coverage := lox.NewCoverage()
+	for _, path := range flags.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		profile, err := lox.ReadLCOV(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+			return 1
+		}
+		coverage.Merge(profile)
+	}
+
+	coverage.WriteSummary(os.Stdout)
+	return writeCoverage(coverage, *out, *html)
+}
+
+func writeCoverage(c *lox.Coverage, lcovPath, htmlPath string) int {
+	write := func(path string, writeTo func(*os.File) error) bool {
+		f, err := os.Create(path)
+		if err == nil {
+			err = writeTo(f)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return false
+		}
+		return true
+	}
+
+	if lcovPath != "" && !write(lcovPath, func(f *os.File) error { return c.WriteLCOV(f) }) {
+		return 1
+	}
+	if htmlPath != "" && !write(htmlPath, func(f *os.File) error { return c.WriteHTML(f) }) {
+		return 1
+	}
+	return 0
+}